@@ -0,0 +1,369 @@
+// Package alerting evaluates threshold rules against command metrics and
+// notifies about alerts that start or stop firing.
+package alerting
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+)
+
+var (
+	// Error indicating that the rule has no name or its thresholds are invalid.
+	InvalidRuleError = errors.New("invalid alert rule")
+	// Error indicating that a rule with the same name was already added.
+	DuplicateRuleError = errors.New("duplicate alert rule")
+)
+
+// Metric is a value of command metrics a rule is evaluated against.
+type Metric int
+
+const (
+	// ErrorPercentage is the percentage of failed requests.
+	ErrorPercentage Metric = iota
+	// TimeoutPercentage is the percentage of requests that timed out.
+	TimeoutPercentage
+	// LatencyP99 is the 99th percentile of the execution time in milliseconds.
+	LatencyP99
+	// RejectionCount is the number of requests rejected by the semaphore.
+	RejectionCount
+)
+
+func (m Metric) String() string {
+	switch m {
+	case ErrorPercentage:
+		return "errorPercentage"
+	case TimeoutPercentage:
+		return "timeoutPercentage"
+	case LatencyP99:
+		return "latencyP99"
+	case RejectionCount:
+		return "rejectionCount"
+	default:
+		return "unknown"
+	}
+}
+
+// value returns the value of the metric in the rolling statistical window.
+func (m Metric) value(cm *metrics.CommandMetrics) float64 {
+	switch m {
+	case ErrorPercentage:
+		return float64(cm.ErrorPercentage())
+	case TimeoutPercentage:
+		if total := cm.TotalRequests(); total > 0 {
+			return float64(cm.RollingSum(requestlog.Timeout)) / float64(total) * 100
+		}
+		return 0
+	case LatencyP99:
+		return float64(cm.ExecutionTimePercentile(99)) / float64(time.Millisecond)
+	case RejectionCount:
+		return float64(cm.RollingSum(requestlog.SemaphoreRejected))
+	default:
+		return 0
+	}
+}
+
+// Rule fires an alert for a command when the value of the metric is above the
+// threshold.
+type Rule struct {
+	// Name uniquely identifies the rule.
+	Name string
+	// Command is the name of the command the rule applies to. Empty name
+	// applies the rule to all commands.
+	Command   string
+	Metric    Metric
+	Threshold float64
+	// ResolveThreshold is the value the metric must drop to for a firing alert
+	// to resolve. Together with the threshold it prevents alerts from flapping.
+	// Nil means the same as the threshold.
+	ResolveThreshold *float64
+	// For is the duration the value must stay above the threshold before the
+	// alert fires.
+	For time.Duration
+}
+
+func (r *Rule) resolveThreshold() float64 {
+	if r.ResolveThreshold == nil {
+		return r.Threshold
+	}
+	return *r.ResolveThreshold
+}
+
+// State is the state of an alert.
+type State int
+
+const (
+	Resolved State = iota
+	Firing
+)
+
+func (s State) String() string {
+	if s == Firing {
+		return "FIRING"
+	}
+	return "RESOLVED"
+}
+
+// Event is an alert of a rule for a command that started or stopped firing.
+type Event struct {
+	Rule        Rule
+	CommandName string
+	State       State
+	Value       float64
+	Time        time.Time
+}
+
+// Notifier is called for every alert event. Notifiers are called from the
+// goroutine evaluating the rules and must not block.
+type Notifier func(e Event)
+
+type alertKey struct {
+	rule    string
+	command string
+}
+
+// alert holds the evaluation state of a rule for a single command.
+type alert struct {
+	// pendingSince is the time the value first exceeded the threshold. It is
+	// zero if the value is below the threshold.
+	pendingSince time.Time
+	firing       *Event
+}
+
+// Registry holds the alert rules and evaluates them against the metrics of all
+// commands.
+type Registry struct {
+	metrics     *metrics.ExecutionMetrics
+	clock       util.Clock
+	rules       []Rule
+	alerts      map[alertKey]*alert
+	notifiers   []Notifier
+	subscribers map[chan Event]struct{}
+	stop        chan struct{}
+	lock        *sync.Mutex
+}
+
+// NewRegistry constructs a new empty registry for the metrics.
+func NewRegistry(m *metrics.ExecutionMetrics) *Registry {
+	return NewRegistryWithClock(m, util.NewClock())
+}
+
+func NewRegistryWithClock(m *metrics.ExecutionMetrics, clock util.Clock) *Registry {
+	return &Registry{
+		metrics:     m,
+		clock:       clock,
+		rules:       make([]Rule, 0),
+		alerts:      make(map[alertKey]*alert),
+		notifiers:   make([]Notifier, 0),
+		subscribers: make(map[chan Event]struct{}),
+		lock:        new(sync.Mutex),
+	}
+}
+
+// AddRule adds a rule to the registry.
+func (r *Registry) AddRule(rule Rule) error {
+	if rule.Name == "" || rule.resolveThreshold() > rule.Threshold || rule.For < 0 {
+		return InvalidRuleError
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.rules {
+		if existing.Name == rule.Name {
+			return DuplicateRuleError
+		}
+	}
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Rules returns all the rules in the order they were added.
+func (r *Registry) Rules() []Rule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rules := make([]Rule, len(r.rules))
+	copy(rules, r.rules)
+	return rules
+}
+
+// Notify adds a notifier called for every alert event.
+func (r *Registry) Notify(n Notifier) {
+	r.lock.Lock()
+	r.notifiers = append(r.notifiers, n)
+	r.lock.Unlock()
+}
+
+// Firing returns the events of all currently firing alerts.
+func (r *Registry) Firing() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.firing()
+}
+
+// firing returns the events of all currently firing alerts. The caller must
+// hold the lock.
+func (r *Registry) firing() []Event {
+	events := make([]Event, 0)
+	for _, rule := range r.rules {
+		firing := make([]Event, 0)
+		for key, a := range r.alerts {
+			if key.rule == rule.Name && a.firing != nil {
+				firing = append(firing, *a.firing)
+			}
+		}
+		sort.Sort(byCommandName(firing))
+		events = append(events, firing...)
+	}
+	return events
+}
+
+type byCommandName []Event
+
+func (e byCommandName) Len() int           { return len(e) }
+func (e byCommandName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byCommandName) Less(i, j int) bool { return e[i].CommandName < e[j].CommandName }
+
+// Start evaluates the rules on the health snapshot interval of the metrics
+// until Stop is called.
+func (r *Registry) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	go r.run(r.stop)
+}
+
+// Stop stops the periodic evaluation of the rules.
+func (r *Registry) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *Registry) run(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-util.After(r.clock, r.metrics.Properties().HealthSnapshotInterval.Get()):
+		}
+		r.Evaluate()
+	}
+}
+
+// Evaluate evaluates all the rules against the current metrics and notifies
+// about alerts that started or stopped firing. Alerts of commands that are no
+// longer tracked by the metrics are resolved and removed.
+func (r *Registry) Evaluate() {
+	all := r.metrics.All()
+	r.lock.Lock()
+	now := r.clock.Now()
+	events := make([]Event, 0)
+	evaluated := make(map[alertKey]struct{}, len(r.alerts))
+	for _, rule := range r.rules {
+		for _, cm := range all {
+			if rule.Command != "" && rule.Command != cm.CommandName() {
+				continue
+			}
+			evaluated[alertKey{rule.Name, cm.CommandName()}] = struct{}{}
+			if e, ok := r.evaluate(rule, cm, now); ok {
+				events = append(events, e)
+			}
+		}
+	}
+	events = append(events, r.prune(evaluated, now)...)
+	notifiers := r.notifiers
+	for _, e := range events {
+		for s := range r.subscribers {
+			select {
+			case s <- e:
+			default:
+				// Slow subscribers miss events rather than block the evaluation.
+			}
+		}
+	}
+	r.lock.Unlock()
+	for _, e := range events {
+		for _, n := range notifiers {
+			n(e)
+		}
+	}
+}
+
+// evaluate updates the state of the alert of the rule for the command and
+// returns an event if the alert started or stopped firing.
+func (r *Registry) evaluate(rule Rule, cm *metrics.CommandMetrics, now time.Time) (Event, bool) {
+	key := alertKey{rule.Name, cm.CommandName()}
+	a, ok := r.alerts[key]
+	if !ok {
+		a = &alert{}
+		r.alerts[key] = a
+	}
+	value := rule.Metric.value(cm)
+	if a.firing != nil {
+		if value <= rule.resolveThreshold() {
+			a.firing = nil
+			a.pendingSince = time.Time{}
+			return Event{rule, key.command, Resolved, value, now}, true
+		}
+		return Event{}, false
+	}
+	if value <= rule.Threshold {
+		a.pendingSince = time.Time{}
+		return Event{}, false
+	}
+	if a.pendingSince.IsZero() {
+		a.pendingSince = now
+	}
+	if now.Sub(a.pendingSince) < rule.For {
+		return Event{}, false
+	}
+	e := Event{rule, key.command, Firing, value, now}
+	a.firing = &e
+	return e, true
+}
+
+// prune removes the alerts that were not evaluated because their rule or
+// command no longer exists and returns the events of the firing ones that were
+// resolved. The caller must hold the lock.
+func (r *Registry) prune(evaluated map[alertKey]struct{}, now time.Time) []Event {
+	events := make([]Event, 0)
+	for key, a := range r.alerts {
+		if _, ok := evaluated[key]; ok {
+			continue
+		}
+		if a.firing != nil {
+			events = append(events, Event{a.firing.Rule, key.command, Resolved, 0, now})
+		}
+		delete(r.alerts, key)
+	}
+	sort.Sort(byCommandName(events))
+	return events
+}
+
+// subscribe returns a channel receiving all alert events together with the
+// events of the alerts firing at the time of the subscription. Events of the
+// later evaluations are only sent to the channel, so none is missed or
+// received twice.
+func (r *Registry) subscribe() (chan Event, []Event) {
+	c := make(chan Event, 16)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subscribers[c] = struct{}{}
+	return c, r.firing()
+}
+
+func (r *Registry) unsubscribe(c chan Event) {
+	r.lock.Lock()
+	delete(r.subscribers, c)
+	r.lock.Unlock()
+}
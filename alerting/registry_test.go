@@ -0,0 +1,161 @@
+package alerting_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/alerting"
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestingMetrics(clock util.Clock) *metrics.ExecutionMetrics {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.healthSnapshot.intervalInMilliseconds", "1")
+	return metrics.NewExecutionMetrics(metrics.NewMetricsProperties(cfg), clock)
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestRegistryAddRuleValidation(t *testing.T) {
+	r := alerting.NewRegistry(newTestingMetrics(util.NewClock()))
+	assert.Equal(t, alerting.InvalidRuleError, r.AddRule(alerting.Rule{Threshold: 10}))
+	assert.Equal(t, alerting.InvalidRuleError, r.AddRule(alerting.Rule{Name: "r", Threshold: 10, ResolveThreshold: float(20)}))
+	assert.NoError(t, r.AddRule(alerting.Rule{Name: "r", Threshold: 10}))
+	assert.Equal(t, alerting.DuplicateRuleError, r.AddRule(alerting.Rule{Name: "r", Threshold: 20}))
+	assert.Len(t, r.Rules(), 1)
+}
+
+func TestRegistryForDurationAndHysteresis(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	m := newTestingMetrics(clock)
+	r := alerting.NewRegistryWithClock(m, clock)
+	assert.NoError(t, r.AddRule(alerting.Rule{
+		Name:             "errors",
+		Command:          "cmd",
+		Metric:           alerting.ErrorPercentage,
+		Threshold:        50,
+		ResolveThreshold: float(20),
+		For:              time.Second,
+	}))
+	events := make([]alerting.Event, 0)
+	r.Notify(func(e alerting.Event) {
+		events = append(events, e)
+	})
+
+	m.Update("other", 0, requestlog.Failure)
+	m.Update("cmd", 0, requestlog.Failure)
+	m.Update("cmd", 0, requestlog.Failure)
+	m.Update("cmd", 0, requestlog.Success)
+	r.Evaluate()
+	assert.Empty(t, events, "The alert is pending")
+
+	clock.Add(time.Second)
+	r.Evaluate()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "errors", events[0].Rule.Name)
+		assert.Equal(t, "cmd", events[0].CommandName)
+		assert.Equal(t, alerting.Firing, events[0].State)
+		assert.Equal(t, 66.0, events[0].Value)
+	}
+	assert.Len(t, r.Firing(), 1)
+
+	// 40% is below the threshold but above the resolve threshold.
+	m.Update("cmd", 0, requestlog.Success)
+	m.Update("cmd", 0, requestlog.Success)
+	r.Evaluate()
+	assert.Len(t, events, 1)
+
+	for i := 0; i < 6; i++ {
+		m.Update("cmd", 0, requestlog.Success)
+	}
+	r.Evaluate()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, alerting.Resolved, events[1].State)
+	}
+	assert.Empty(t, r.Firing())
+}
+
+func TestRegistryResetsPendingAlert(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	m := newTestingMetrics(clock)
+	r := alerting.NewRegistryWithClock(m, clock)
+	r.AddRule(alerting.Rule{Name: "rejections", Metric: alerting.RejectionCount, Threshold: 0, For: time.Second})
+	events := make([]alerting.Event, 0)
+	r.Notify(func(e alerting.Event) {
+		events = append(events, e)
+	})
+
+	m.Update("cmd", 0, requestlog.SemaphoreRejected)
+	r.Evaluate()
+	clock.Add(10 * time.Second)
+	r.Evaluate()
+	assert.Empty(t, events, "The rejection fell out of the window")
+
+	m.Update("cmd", 0, requestlog.SemaphoreRejected)
+	r.Evaluate()
+	clock.Add(time.Second)
+	r.Evaluate()
+	assert.Len(t, events, 1)
+}
+
+func TestRegistryResolveThresholdOfZero(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	m := newTestingMetrics(clock)
+	r := alerting.NewRegistryWithClock(m, clock)
+	assert.NoError(t, r.AddRule(alerting.Rule{
+		Name:             "errors",
+		Metric:           alerting.ErrorPercentage,
+		Threshold:        10,
+		ResolveThreshold: float(0),
+	}))
+	m.Update("cmd", 0, requestlog.Failure)
+	m.Update("cmd", 0, requestlog.Success)
+	r.Evaluate()
+	assert.Len(t, r.Firing(), 1)
+
+	for i := 0; i < 10; i++ {
+		m.Update("cmd", 0, requestlog.Success)
+	}
+	r.Evaluate()
+	assert.Len(t, r.Firing(), 1, "The alert resolves only when there are no errors")
+
+	clock.Add(10 * time.Second)
+	r.Evaluate()
+	assert.Empty(t, r.Firing())
+}
+
+func TestRegistryResolvesAlertsOfEvictedCommands(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.commandIdleTimeoutInMilliseconds", "60000")
+	m := metrics.NewExecutionMetrics(metrics.NewMetricsProperties(cfg), clock)
+	r := alerting.NewRegistryWithClock(m, clock)
+	assert.NoError(t, r.AddRule(alerting.Rule{
+		Name:      "errors",
+		Metric:    alerting.ErrorPercentage,
+		Threshold: 50,
+	}))
+	events := make([]alerting.Event, 0)
+	r.Notify(func(e alerting.Event) {
+		events = append(events, e)
+	})
+
+	m.Update("cmd", 0, requestlog.Failure)
+	r.Evaluate()
+	assert.Len(t, r.Firing(), 1)
+
+	clock.Add(2 * time.Minute)
+	assert.Equal(t, 1, m.EvictIdle())
+	r.Evaluate()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "cmd", events[1].CommandName)
+		assert.Equal(t, alerting.Resolved, events[1].State)
+	}
+	assert.Empty(t, r.Firing())
+}
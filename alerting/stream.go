@@ -0,0 +1,82 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamPingInterval is the interval of keep-alive pings sent while there are
+// no alert events.
+const streamPingInterval = 10 * time.Second
+
+// Stream is a http.Handler streaming the alert events of a registry as
+// server-sent events. Alerts that are firing when the client connects are sent
+// first so dashboards can mark ongoing incidents.
+type Stream struct {
+	registry *Registry
+}
+
+// NewStream constructs a new Stream of the alert events of the registry.
+func NewStream(r *Registry) *Stream {
+	return &Stream{
+		registry: r,
+	}
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	events, firing := s.registry.subscribe()
+	defer s.registry.unsubscribe(events)
+	encoder := json.NewEncoder(w)
+	for _, e := range firing {
+		writeEvent(w, encoder, e)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			writeEvent(w, encoder, e)
+		case <-time.After(streamPingInterval):
+			fmt.Fprintln(w, "ping: ")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, encoder *json.Encoder, e Event) {
+	event := struct {
+		Type             string  `json:"type"`
+		Rule             string  `json:"rule"`
+		Name             string  `json:"name"`
+		Metric           string  `json:"metric"`
+		Threshold        float64 `json:"threshold"`
+		ResolveThreshold float64 `json:"resolveThreshold"`
+		State            string  `json:"state"`
+		Value            float64 `json:"value"`
+		CurrentTime      int64   `json:"currentTime"`
+	}{
+		"CuirassAlert",
+		e.Rule.Name,
+		e.CommandName,
+		e.Rule.Metric.String(),
+		e.Rule.Threshold,
+		e.Rule.resolveThreshold(),
+		e.State.String(),
+		e.Value,
+		e.Time.UnixNano() / int64(time.Millisecond),
+	}
+	w.Write([]byte("data: "))
+	encoder.Encode(&event)
+	w.Write([]byte("\n"))
+}
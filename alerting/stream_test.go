@@ -0,0 +1,55 @@
+package alerting_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arjantop/cuirass/alerting"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSendsFiringAlerts(t *testing.T) {
+	m := newTestingMetrics(util.NewClock())
+	r := alerting.NewRegistry(m)
+	r.AddRule(alerting.Rule{Name: "errors", Metric: alerting.ErrorPercentage, Threshold: 50})
+	m.Update("cmd", 0, requestlog.Failure)
+	r.Evaluate()
+
+	server := httptest.NewServer(alerting.NewStream(r))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream;charset=utf-8", resp.Header.Get("Content-Type"))
+
+	lines := bufio.NewReader(resp.Body)
+	readEvent := func() map[string]interface{} {
+		line, err := lines.ReadString('\n')
+		assert.NoError(t, err)
+		lines.ReadString('\n')
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		return event
+	}
+	event := readEvent()
+	assert.Equal(t, "CuirassAlert", event["type"])
+	assert.Equal(t, "errors", event["rule"])
+	assert.Equal(t, "cmd", event["name"])
+	assert.Equal(t, "FIRING", event["state"])
+
+	for i := 0; i < 3; i++ {
+		m.Update("cmd", 0, requestlog.Success)
+	}
+	r.Evaluate()
+	event = readEvent()
+	assert.Equal(t, "RESOLVED", event["state"])
+	assert.Equal(t, 25.0, event["value"])
+}
@@ -3,6 +3,7 @@ package circuitbreaker
 import (
 	"errors"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/arjantop/cuirass/num"
@@ -14,8 +15,28 @@ var (
 	// Error indicating that the circuit is open and the request was not executed
 	// or an attempt to reset the circuit failed.
 	CircuitOpenError = errors.New("circuit open")
+	// Error indicating that the health probe panicked.
+	probePanicError = errors.New("probe panic")
 )
 
+// rejectedError wraps an error of a request that was not executed by the
+// function passed to Do.
+type rejectedError struct {
+	err error
+}
+
+func (e rejectedError) Error() string {
+	return e.err.Error()
+}
+
+// Rejected wraps the error of a request that the function passed to Do rejected
+// without executing it, eg. because a nested circuit breaker is open. Do returns
+// the wrapped error and the request is not counted in the health of the circuit
+// breaker.
+func Rejected(err error) error {
+	return rejectedError{err}
+}
+
 // Integer constants to be used as true and false constants with circuit breaker.
 const (
 	intTrue  = 1
@@ -29,6 +50,21 @@ type CircuitBreakerProperties struct {
 	ErrorThresholdPercentage vaquita.IntProperty
 	ForceOpen                vaquita.BoolProperty
 	ForceClosed              vaquita.BoolProperty
+	// Size and number of buckets of the statistical window used for health
+	// calculation.
+	RollingStatisticalWindow        vaquita.DurationProperty
+	RollingStatisticalWindowBuckets vaquita.IntProperty
+	// Execution time over which successful requests are considered slow and
+	// the circuit is opened if the configured percentile of the execution time
+	// exceeds it. Zero disables latency based circuit breaking.
+	LatencyThreshold  vaquita.DurationProperty
+	LatencyPercentile vaquita.IntProperty
+}
+
+// LatencySource provides the rolling percentiles of execution time used for
+// latency based circuit breaking.
+type LatencySource interface {
+	ExecutionTimePercentile(p float64) time.Duration
 }
 
 // CircuitBreaker is an implementation of circuit breaker pattern.
@@ -39,19 +75,48 @@ type CircuitBreaker struct {
 	// uint32 is used instead of bool so we can use atomic operations.
 	circuitOpen   uint32
 	lastTrialTime int64
+	// Times of the last change of the circuit state.
+	openTime  int64
+	closeTime int64
 
 	health breakerHealth
 
+	// Optional store for sharing the state with circuit breakers of other processes.
+	store        StateStore
+	storeName    string
+	instance     string
+	lastSyncTime int64
+	// syncing is intTrue while a synchronization with the store is running.
+	syncing uint32
+
+	// Optional function checking the health of the dependency while the circuit
+	// is open.
+	probe func() error
+	// probing is intTrue while the probes are running and probeTrial is intTrue
+	// after a successful probe until a trial request is made.
+	probing    uint32
+	probeTrial uint32
+	// stop is closed when the circuit breaker is stopped.
+	stop    chan struct{}
+	stopped uint32
+
 	clock util.Clock
 }
 
 type breakerHealth struct {
 	healthSnapshotInterval vaquita.DurationProperty
+	windowSize             vaquita.DurationProperty
+	windowBuckets          vaquita.IntProperty
 	clock                  util.Clock
 	errorCounter           *num.RollingNumber
 	requestCounter         *num.RollingNumber
+	slowCounter            *num.RollingNumber
+	latency                LatencySource
+	latencyPercentile      vaquita.IntProperty
 	healthSnapshot         *health
 	snapshotTime           int64
+	// Aggregated health counts of other processes read from the state store.
+	remoteHealth unsafe.Pointer
 }
 
 func (h *breakerHealth) IncRequest() {
@@ -62,9 +127,31 @@ func (h *breakerHealth) IncError() {
 	h.errorCounter.Increment()
 }
 
+func (h *breakerHealth) IncSlow() {
+	h.slowCounter.Increment()
+}
+
+// updateWindow rebuilds the counters if the statistical window properties changed.
+// It is called once per health snapshot so the properties are not read on every
+// request. Invalid windows are ignored by the counters.
+func (h *breakerHealth) updateWindow() {
+	windowSize, windowBuckets := h.windowSize.Get(), h.windowBuckets.Get()
+	h.requestCounter.SetWindow(windowSize, windowBuckets)
+	h.errorCounter.SetWindow(windowSize, windowBuckets)
+	h.slowCounter.SetWindow(windowSize, windowBuckets)
+}
+
 func (h *breakerHealth) Reset() {
 	h.errorCounter.Reset()
 	h.requestCounter.Reset()
+	h.slowCounter.Reset()
+	atomic.StorePointer(&h.remoteHealth, nil)
+}
+
+// setRemote sets the aggregated health counts of other processes that are taken
+// into account when calculating the health. Nil means there are no remote counts.
+func (h *breakerHealth) setRemote(remote *State) {
+	atomic.StorePointer(&h.remoteHealth, unsafe.Pointer(remote))
 }
 
 func (h *breakerHealth) Health() *health {
@@ -73,10 +160,20 @@ func (h *breakerHealth) Health() *health {
 	dest := unsafe.Pointer(h.healthSnapshot)
 	if timestamp > lastSnapshotTime+int64(h.healthSnapshotInterval.Get()) {
 		if atomic.CompareAndSwapInt64(&h.snapshotTime, lastSnapshotTime, timestamp) {
+			h.updateWindow()
 			reqCount := h.requestCounter.Sum()
+			errCount := h.errorCounter.Sum()
+			if remote := (*State)(atomic.LoadPointer(&h.remoteHealth)); remote != nil {
+				reqCount += remote.NumRequests
+				errCount += remote.NumErrors
+			}
 			newSnapshot := &health{
 				NumRequests:     reqCount,
-				ErrorPercentage: float64(h.errorCounter.Sum()) * 100.0 / float64(reqCount),
+				NumSlow:         h.slowCounter.Sum(),
+				ErrorPercentage: float64(errCount) * 100.0 / float64(reqCount),
+			}
+			if h.latency != nil {
+				newSnapshot.LatencyPercentile = h.latency.ExecutionTimePercentile(float64(h.latencyPercentile.Get()))
 			}
 			atomic.StorePointer(&dest, unsafe.Pointer(newSnapshot))
 		}
@@ -85,8 +182,10 @@ func (h *breakerHealth) Health() *health {
 }
 
 type health struct {
-	NumRequests     int64
-	ErrorPercentage float64
+	NumRequests       int64
+	NumSlow           int64
+	ErrorPercentage   float64
+	LatencyPercentile time.Duration
 }
 
 // Constructs a new circuit breaker. The circuit is closed by default and allowed
@@ -98,27 +197,91 @@ func New(props *CircuitBreakerProperties, healthSnapshotInterval vaquita.Duratio
 		lastTrialTime: 0,
 		health: breakerHealth{
 			healthSnapshotInterval: healthSnapshotInterval,
-			clock:          clock,
-			errorCounter:   num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock),
-			requestCounter: num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock),
-			healthSnapshot: new(health),
+			windowSize:             props.RollingStatisticalWindow,
+			windowBuckets:          props.RollingStatisticalWindowBuckets,
+			clock:                  clock,
+			errorCounter:           num.NewRollingNumber(props.RollingStatisticalWindow.Get(), props.RollingStatisticalWindowBuckets.Get(), clock),
+			requestCounter:         num.NewRollingNumber(props.RollingStatisticalWindow.Get(), props.RollingStatisticalWindowBuckets.Get(), clock),
+			slowCounter:            num.NewRollingNumber(props.RollingStatisticalWindow.Get(), props.RollingStatisticalWindowBuckets.Get(), clock),
+			latencyPercentile:      props.LatencyPercentile,
+			healthSnapshot:         new(health),
 		},
+		stop:  make(chan struct{}),
 		clock: clock,
 	}
 }
 
+// Stop stops the background probes of the circuit breaker. It must be called
+// when the circuit breaker is discarded.
+func (cb *CircuitBreaker) Stop() {
+	if atomic.CompareAndSwapUint32(&cb.stopped, intFalse, intTrue) {
+		close(cb.stop)
+	}
+}
+
+// SetStateStore configures the circuit breaker to share its state with circuit
+// breakers of other processes through the store. Name identifies the circuit
+// breaker in the store and instance identifies this process.
+// The state is published and the states of other instances are read in the
+// background at most once per health snapshot interval, so the remote state is
+// taken into account after the synchronization finishes. Open decisions of
+// other instances open this circuit and health counts of instances with closed
+// circuits are added to the local ones. When the store is not available only
+// the local state is used.
+// SetStateStore must be called before the circuit breaker is used.
+func (cb *CircuitBreaker) SetStateStore(store StateStore, name, instance string) {
+	cb.store = store
+	cb.storeName = name
+	cb.instance = instance
+}
+
+// SetLatencySource sets the source of execution time percentiles used for latency
+// based circuit breaking.
+// SetLatencySource must be called before the circuit breaker is used.
+func (cb *CircuitBreaker) SetLatencySource(latency LatencySource) {
+	cb.health.latency = latency
+}
+
+// SetProbe sets a function that checks the health of the protected dependency.
+// While the circuit is open the probe is executed in the background once per
+// sleep window. A successful probe allows a single trial request that closes
+// the circuit if it succeeds, a failed probe or trial keeps the circuit open
+// until the next probe. When a probe is set trial requests are only allowed
+// after successful probes so all other requests fail fast.
+// SetProbe must be called before the circuit breaker is used.
+func (cb *CircuitBreaker) SetProbe(probe func() error) {
+	cb.probe = probe
+}
+
 // Do executes a function in the context of this circuit breaker.
 // If the circuit is open the function is not executed and an error CircuitOpenError
 // is returned.
 func (cb *CircuitBreaker) Do(f func() error) error {
 	if !cb.props.Enabled.Get() {
-		return f()
+		err := f()
+		if rejected, ok := err.(rejectedError); ok {
+			return rejected.err
+		}
+		return err
 	} else if cb.props.ForceOpen.Get() {
 		return CircuitOpenError
 	}
-	cb.health.IncRequest()
 	if allowed, trial := cb.isRequestAllowed(); allowed {
+		start := cb.clock.Now()
 		err := f()
+		if rejected, ok := err.(rejectedError); ok {
+			// The request was not executed so it does not affect the health.
+			if trial {
+				cb.releaseTrial()
+			}
+			return rejected.err
+		}
+		cb.health.IncRequest()
+		slow := err == nil && cb.isSlow(cb.clock.Now().Sub(start))
+		if slow {
+			// Slow requests are successful so they are not counted as errors.
+			cb.health.IncSlow()
+		}
 		if err != nil {
 			if trial {
 				// If the request was a trial then the real error does not matter
@@ -127,20 +290,27 @@ func (cb *CircuitBreaker) Do(f func() error) error {
 			}
 			// If error occurs we increment the request error counter.
 			cb.health.IncError()
-		} else if trial {
+		} else if trial && !slow {
 			// If the request was a trial and it succeeded reset all the counters
 			// and reset the breaker state to closed.
-			cb.health.Reset()
-			atomic.StoreUint32(&cb.circuitOpen, intFalse)
+			cb.close()
 		}
 		return err
 	} else {
 		// Circuit is open so we fail fast and return the error.
+		cb.health.IncRequest()
 		cb.health.IncError()
 		return CircuitOpenError
 	}
 }
 
+// isSlow returns true if the execution time of a successful request exceeds
+// the configured latency threshold.
+func (cb *CircuitBreaker) isSlow(executionTime time.Duration) bool {
+	threshold := cb.props.LatencyThreshold.Get()
+	return threshold > 0 && executionTime > threshold
+}
+
 // isRequestAllowed returns true as first return value when a request is allowed
 // to be made. Second return value indicated if the allowed request is a trial
 // in half-open state with attempt to close the circuit on trial request success.
@@ -157,6 +327,11 @@ func (cb *CircuitBreaker) isRequestAllowed() (bool, bool) {
 // istrialcallallowed returns true is the trial call is allowed to close the circuit.
 // Time of last request trial is updated to the current time.
 func (cb *CircuitBreaker) isTrialCallAllowed() bool {
+	if cb.probe != nil {
+		// Recovery is detected by the probe, only a single request after a
+		// successful probe is a trial.
+		return cb.IsOpen() && atomic.CompareAndSwapUint32(&cb.probeTrial, intTrue, intFalse)
+	}
 	lastTrialTime := atomic.LoadInt64(&cb.lastTrialTime)
 	timestamp := cb.clock.Now().UnixNano()
 	if cb.IsOpen() && timestamp > lastTrialTime+int64(cb.props.SleepWindow.Get()) {
@@ -167,6 +342,16 @@ func (cb *CircuitBreaker) isTrialCallAllowed() bool {
 	return false
 }
 
+// releaseTrial allows another trial request after the trial request was
+// rejected without being executed.
+func (cb *CircuitBreaker) releaseTrial() {
+	if cb.probe != nil {
+		atomic.StoreUint32(&cb.probeTrial, intTrue)
+	} else {
+		atomic.StoreInt64(&cb.lastTrialTime, 0)
+	}
+}
+
 // IsOpen returns true if the state of circuit breaker is open or half-open
 func (cb *CircuitBreaker) IsOpen() bool {
 	if cb.props.ForceClosed.Get() {
@@ -175,6 +360,10 @@ func (cb *CircuitBreaker) IsOpen() bool {
 		return true
 	}
 
+	if cb.store != nil {
+		cb.syncState()
+	}
+
 	if atomic.LoadUint32(&cb.circuitOpen) == intTrue {
 		return true
 	}
@@ -188,12 +377,137 @@ func (cb *CircuitBreaker) IsOpen() bool {
 	if health.ErrorPercentage > float64(cb.props.ErrorThresholdPercentage.Get()) {
 		// If the error request rate is greater that configured threshold attempt
 		// to change circuit to Open.
-		if atomic.CompareAndSwapUint32(&cb.circuitOpen, intFalse, intTrue) {
-			// If we set the circuit state successfully update the request
-			// trial time to a current time.
-			atomic.StoreInt64(&cb.lastTrialTime, cb.clock.Now().UnixNano())
-		}
+		cb.open(cb.clock.Now().UnixNano())
+		return true
+	}
+	if threshold := cb.props.LatencyThreshold.Get(); threshold > 0 && health.NumSlow > 0 && health.LatencyPercentile > threshold {
+		// The execution time percentile exceeds the configured threshold.
+		// Slow requests must be present in the current window so the latencies
+		// from before the circuit was last closed do not open it again.
+		cb.open(cb.clock.Now().UnixNano())
 		return true
 	}
 	return false
 }
+
+// open attempts to change the circuit to open. OpenTime is the time when the
+// decision to open the circuit was made.
+func (cb *CircuitBreaker) open(openTime int64) {
+	if atomic.CompareAndSwapUint32(&cb.circuitOpen, intFalse, intTrue) {
+		// If we set the circuit state successfully update the request
+		// trial time to a current time.
+		atomic.StoreInt64(&cb.openTime, openTime)
+		atomic.StoreInt64(&cb.lastTrialTime, cb.clock.Now().UnixNano())
+		if cb.probe != nil && atomic.CompareAndSwapUint32(&cb.probing, intFalse, intTrue) {
+			go cb.runProbes()
+		}
+	}
+}
+
+// close resets all the counters and changes the circuit to closed.
+func (cb *CircuitBreaker) close() {
+	cb.health.Reset()
+	atomic.StoreInt64(&cb.closeTime, cb.clock.Now().UnixNano())
+	atomic.StoreUint32(&cb.probeTrial, intFalse)
+	atomic.StoreUint32(&cb.circuitOpen, intFalse)
+}
+
+// runProbes executes the probe once per sleep window until the circuit is
+// closed or the circuit breaker is stopped. After a successful probe no probes
+// are executed until the trial request is made.
+func (cb *CircuitBreaker) runProbes() {
+	for {
+		select {
+		case <-cb.stop:
+			return
+		case <-util.After(cb.clock, cb.props.SleepWindow.Get()):
+		}
+		if atomic.LoadUint32(&cb.circuitOpen) == intFalse {
+			atomic.StoreUint32(&cb.probing, intFalse)
+			// The circuit could have been opened again before the probing
+			// stopped, in that case the probing continues.
+			if atomic.LoadUint32(&cb.circuitOpen) == intFalse ||
+				!atomic.CompareAndSwapUint32(&cb.probing, intFalse, intTrue) {
+				return
+			}
+		} else if atomic.LoadUint32(&cb.probeTrial) == intFalse && cb.runProbe() == nil {
+			// The dependency looks healthy, the next request is a trial.
+			atomic.StoreUint32(&cb.probeTrial, intTrue)
+		}
+	}
+}
+
+// runProbe executes the probe and converts panics to errors.
+func (cb *CircuitBreaker) runProbe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = probePanicError
+		}
+	}()
+	return cb.probe()
+}
+
+// syncState starts a synchronization with the state store in the background at
+// most once per health snapshot interval so requests never wait for the store.
+// Only one synchronization runs at a time, if the previous one did not finish
+// the synchronization is skipped until the next interval.
+func (cb *CircuitBreaker) syncState() {
+	lastSyncTime := atomic.LoadInt64(&cb.lastSyncTime)
+	now := cb.clock.Now()
+	if now.UnixNano() <= lastSyncTime+int64(cb.health.healthSnapshotInterval.Get()) ||
+		!atomic.CompareAndSwapInt64(&cb.lastSyncTime, lastSyncTime, now.UnixNano()) ||
+		!atomic.CompareAndSwapUint32(&cb.syncing, intFalse, intTrue) {
+		return
+	}
+	go func() {
+		defer atomic.StoreUint32(&cb.syncing, intFalse)
+		cb.sync(now)
+	}()
+}
+
+// sync publishes the local state to the state store and reads the states of
+// other instances. The aggregated remote state replaces the previous one
+// atomically.
+func (cb *CircuitBreaker) sync(now time.Time) {
+	local := State{
+		NumRequests: cb.health.requestCounter.Sum(),
+		NumErrors:   cb.health.errorCounter.Sum(),
+		Time:        now,
+	}
+	if atomic.LoadUint32(&cb.circuitOpen) == intTrue {
+		local.Open = true
+		local.OpenTime = time.Unix(0, atomic.LoadInt64(&cb.openTime))
+	}
+	// Publishing errors are ignored, other instances will just not see our state.
+	cb.store.Publish(cb.storeName, cb.instance, local)
+
+	states, err := cb.store.States(cb.storeName)
+	if err != nil {
+		// The store is not available so only the local state is used.
+		cb.health.setRemote(nil)
+		return
+	}
+	remote := new(State)
+	closeTime := atomic.LoadInt64(&cb.closeTime)
+	for instance, s := range states {
+		if instance == cb.instance || now.Sub(s.Time) > cb.props.RollingStatisticalWindow.Get() {
+			// Skip our own and stale states.
+			continue
+		}
+		if !s.Open {
+			remote.NumRequests += s.NumRequests
+			remote.NumErrors += s.NumErrors
+		} else if s.OpenTime.UnixNano() > closeTime && (!remote.Open || s.OpenTime.Before(remote.OpenTime)) {
+			// Circuits opened before our circuit was last closed are not relevant
+			// any more because we already verified that the dependency recovered.
+			remote.Open = true
+			remote.OpenTime = s.OpenTime
+		}
+	}
+	cb.health.setRemote(remote)
+	if remote.Open {
+		// Keep the original time of opening so the instances that closed the circuit
+		// after that are not affected by our decision.
+		cb.open(remote.OpenTime.UnixNano())
+	}
+}
@@ -28,6 +28,10 @@ func newTestingCircuitBreaker(cfg vaquita.DynamicConfig, clock util.Clock) *circ
 		f.GetIntProperty("errorThreshold", 50),
 		f.GetBoolProperty("forceOpen", false),
 		f.GetBoolProperty("forceClosed", false),
+		f.GetDurationProperty("windowSize", 10*time.Second, time.Millisecond),
+		f.GetIntProperty("windowBuckets", 10),
+		f.GetDurationProperty("latencyThreshold", 0, time.Millisecond),
+		f.GetIntProperty("latencyPercentile", 99),
 	}, f.GetDurationProperty("healthSnapshot", 0, time.Millisecond), clock)
 }
 
@@ -138,6 +142,225 @@ func TestCircuitBreakerStaysOpenOnTrialFailure(t *testing.T) {
 	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { panic("unreachable") }))
 }
 
+func TestCircuitBreakerWindowChanged(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "2")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+
+	cb.Do(func() error { return testErr })
+	cfg.SetProperty("windowSize", "1000")
+	cfg.SetProperty("windowBuckets", "5")
+	// Counters are rebuilt on the next health snapshot so the first error is
+	// discarded.
+	clock.Add(time.Millisecond)
+	assert.False(t, cb.IsOpen())
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.False(t, cb.IsOpen())
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+}
+
+func TestCircuitBreakerInvalidWindowIgnored(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "2")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+
+	cb.Do(func() error { return testErr })
+	cfg.SetProperty("windowBuckets", "0")
+	clock.Add(time.Millisecond)
+	assert.False(t, cb.IsOpen())
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen(), "Previous window is kept")
+}
+
+func TestCircuitBreakerRejectedRequestsNotCounted(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+
+	for i := 0; i < 5; i++ {
+		err := cb.Do(func() error { return circuitbreaker.Rejected(testErr) })
+		assert.Equal(t, testErr, err, "Wrapped error is returned")
+		clock.Add(time.Millisecond)
+	}
+	assert.False(t, cb.IsOpen())
+}
+
+func TestCircuitBreakerRejectedTrialIsReleased(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+
+	clock.Add(501 * time.Millisecond)
+	err := cb.Do(func() error { return circuitbreaker.Rejected(testErr) })
+	assert.Equal(t, testErr, err, "Trial request is allowed")
+	assert.Nil(t, cb.Do(func() error { return nil }), "Rejected trial does not use up the trial")
+	assert.False(t, cb.IsOpen())
+}
+
+type fixedLatency time.Duration
+
+func (l fixedLatency) ExecutionTimePercentile(p float64) time.Duration {
+	return time.Duration(l)
+}
+
+func TestCircuitBreakerOpensOnLatency(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "4")
+	cfg.SetProperty("latencyThreshold", "100")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	cb.SetLatencySource(fixedLatency(200 * time.Millisecond))
+
+	slow := func() error {
+		clock.Add(200 * time.Millisecond)
+		return nil
+	}
+	assert.Nil(t, cb.Do(func() error { return nil }))
+	assert.False(t, cb.IsOpen(), "No slow requests in the window")
+	assert.Nil(t, cb.Do(slow), "Slow requests are not errors")
+	assert.Nil(t, cb.Do(slow))
+	assert.False(t, cb.IsOpen(), "Not enough requests")
+	assert.Nil(t, cb.Do(slow))
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { return nil }))
+}
+
+func TestCircuitBreakerSlowTrialKeepsCircuitOpen(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	cfg.SetProperty("latencyThreshold", "100")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	cb.SetLatencySource(fixedLatency(200 * time.Millisecond))
+
+	slow := func() error {
+		clock.Add(200 * time.Millisecond)
+		return nil
+	}
+	cb.Do(slow)
+	cb.Do(slow)
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+
+	clock.Add(501 * time.Millisecond)
+	assert.Nil(t, cb.Do(slow), "Result of a slow trial is returned")
+	assert.True(t, cb.IsOpen())
+	clock.Add(501 * time.Millisecond)
+	assert.Nil(t, cb.Do(func() error { return nil }))
+	assert.False(t, cb.IsOpen())
+}
+
+// waitForProbes waits until the probes wait for the end of the sleep window.
+func waitForProbes(t *testing.T, clock *util.TestableClock) {
+	for i := 0; clock.Waiters() == 0; i++ {
+		if i == 1000 {
+			t.Fatal("probes are not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCircuitBreakerProbeAllowsTrial(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	cfg.SetProperty("sleepWindow", "5")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	defer cb.Stop()
+	probes := make(chan error)
+	cb.SetProbe(func() error { return <-probes })
+
+	cb.Do(func() error { return testErr })
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+
+	waitForProbes(t, clock)
+	clock.Add(5 * time.Millisecond)
+	probes <- testErr
+	waitForProbes(t, clock)
+	// Requests are not trials until a probe succeeds.
+	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { panic("unreachable") }))
+
+	clock.Add(5 * time.Millisecond)
+	probes <- nil
+	waitForProbes(t, clock)
+	assert.True(t, cb.IsOpen(), "Circuit is half-open after a successful probe")
+	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { return testErr }), "Failed trial")
+	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { panic("unreachable") }))
+
+	clock.Add(5 * time.Millisecond)
+	probes <- nil
+	waitForProbes(t, clock)
+	assert.Nil(t, cb.Do(func() error { return nil }))
+	assert.False(t, cb.IsOpen(), "Circuit is closed after a successful trial")
+}
+
+func TestCircuitBreakerStopStopsProbes(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	cfg.SetProperty("sleepWindow", "5")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	probed := make(chan bool, 1)
+	cb.SetProbe(func() error {
+		probed <- true
+		return testErr
+	})
+
+	cb.Do(func() error { return testErr })
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+	waitForProbes(t, clock)
+	cb.Stop()
+	cb.Stop()
+	time.Sleep(time.Millisecond)
+	clock.Add(5 * time.Millisecond)
+	select {
+	case <-probed:
+		t.Fatal("probe executed after stop")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestCircuitBreakerProbePanic(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	cfg.SetProperty("sleepWindow", "1")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	defer cb.Stop()
+	probed := make(chan bool, 1)
+	cb.SetProbe(func() error {
+		probed <- true
+		panic("probe")
+	})
+
+	cb.Do(func() error { return testErr })
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+	waitForProbes(t, clock)
+	clock.Add(time.Millisecond)
+	<-probed
+	waitForProbes(t, clock)
+	assert.True(t, cb.IsOpen(), "Panicking probe keeps the circuit open")
+	assert.Equal(t, circuitbreaker.CircuitOpenError, cb.Do(func() error { panic("unreachable") }))
+}
+
 func TestCircuitBreakerPropertyDisabled(t *testing.T) {
 	cfg := vaquita.NewEmptyMapConfig()
 	cfg.SetProperty("enabled", "false")
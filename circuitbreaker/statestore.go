@@ -0,0 +1,189 @@
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arjantop/cuirass/util"
+)
+
+// State is a state of a circuit breaker that is shared with other processes.
+type State struct {
+	// Open is true if the circuit was open at the time of publishing.
+	Open bool `json:"open"`
+	// OpenTime is the time the circuit was opened.
+	OpenTime time.Time `json:"openTime"`
+	// NumRequests is the number of requests in the statistical window.
+	NumRequests int64 `json:"numRequests"`
+	// NumErrors is the number of failed requests in the statistical window.
+	NumErrors int64 `json:"numErrors"`
+	// Time is the time the state was published.
+	Time time.Time `json:"time"`
+}
+
+// StateStore is a store used by circuit breakers of multiple processes to
+// share their open/closed decisions and health counts.
+// Implementations must be safe to be accessed by multiple goroutines.
+type StateStore interface {
+	// Publish stores the state of the circuit breaker with the given name
+	// for the instance.
+	Publish(name, instance string, s State) error
+	// States returns the last published states of the circuit breaker with the
+	// given name for all instances.
+	States(name string) (map[string]State, error)
+}
+
+// MemoryStateStore is a StateStore that keeps the states in memory. It can be
+// used for sharing the states of circuit breakers of different executors in
+// the same process.
+type MemoryStateStore struct {
+	states map[string]map[string]State
+	lock   *sync.RWMutex
+}
+
+// NewMemoryStateStore constructs a new empty MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		states: make(map[string]map[string]State),
+		lock:   new(sync.RWMutex),
+	}
+}
+
+// Publish stores the state of the circuit breaker for the instance.
+func (s *MemoryStateStore) Publish(name, instance string, state State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states, ok := s.states[name]
+	if !ok {
+		states = make(map[string]State)
+		s.states[name] = states
+	}
+	states[instance] = state
+	return nil
+}
+
+// States returns the states of the circuit breaker for all instances.
+func (s *MemoryStateStore) States(name string) (map[string]State, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	states := make(map[string]State, len(s.states[name]))
+	for instance, state := range s.states[name] {
+		states[instance] = state
+	}
+	return states, nil
+}
+
+// DefaultFileStateTTL is the default age after which the state files of
+// instances that stopped publishing are deleted.
+const DefaultFileStateTTL = 10 * time.Minute
+
+// FileStateStore is a StateStore that keeps the states as files in a directory,
+// one file per circuit breaker and instance. The directory can be shared between
+// processes on the same host or over a shared file system.
+// State files that were not updated for longer than the TTL are deleted when
+// the states are read, so the files of instances that went away do not pile up.
+type FileStateStore struct {
+	dir   string
+	ttl   time.Duration
+	clock util.Clock
+}
+
+// NewFileStateStore constructs a new FileStateStore storing the states in dir.
+func NewFileStateStore(dir string) *FileStateStore {
+	return NewFileStateStoreWithClock(dir, util.NewClock())
+}
+
+// NewFileStateStoreWithClock constructs a new FileStateStore storing the states
+// in dir. The modification times of the files are set and compared with the TTL
+// using the clock.
+func NewFileStateStoreWithClock(dir string, clock util.Clock) *FileStateStore {
+	return &FileStateStore{
+		dir:   dir,
+		ttl:   DefaultFileStateTTL,
+		clock: clock,
+	}
+}
+
+// SetTTL sets the age after which the state files are deleted. It should be
+// longer than the statistical window of the circuit breakers because older
+// states are ignored anyway.
+// SetTTL must be called before the store is used.
+func (s *FileStateStore) SetTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
+
+// Publish writes the state of the circuit breaker for the instance to a file.
+// The file is replaced atomically so concurrent readers never see partial states.
+func (s *FileStateStore) Publish(name, instance string, state State) error {
+	dir := filepath.Join(s.dir, url.QueryEscape(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		now := s.clock.Now()
+		err = os.Chtimes(f.Name(), now, now)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, url.QueryEscape(instance)+".json"))
+}
+
+// States reads the states of the circuit breaker for all instances. Stale state
+// files are deleted.
+func (s *FileStateStore) States(name string) (map[string]State, error) {
+	dir := filepath.Join(s.dir, url.QueryEscape(name))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string]State{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	deadline := s.clock.Now().Add(-s.ttl)
+	states := make(map[string]State, len(files))
+	for _, fi := range files {
+		if fi.ModTime().Before(deadline) {
+			// The instance stopped publishing, temporary files of failed
+			// publishes are deleted too.
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		instance, err := url.QueryUnescape(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var state State
+		if err := json.Unmarshal(b, &state); err != nil {
+			// Skip the corrupted states, they will be overwritten by the next publish.
+			continue
+		}
+		states[instance] = state
+	}
+	return states, nil
+}
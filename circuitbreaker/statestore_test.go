@@ -0,0 +1,207 @@
+package circuitbreaker_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/circuitbreaker"
+	"github.com/arjantop/cuirass/util"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	s := circuitbreaker.NewMemoryStateStore()
+	states, err := s.States("cb")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(states))
+
+	now := time.Now()
+	assert.Nil(t, s.Publish("cb", "i1", circuitbreaker.State{NumRequests: 1, Time: now}))
+	assert.Nil(t, s.Publish("cb", "i2", circuitbreaker.State{Open: true, Time: now}))
+	assert.Nil(t, s.Publish("cb", "i1", circuitbreaker.State{NumRequests: 2, Time: now}))
+	states, err = s.States("cb")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]circuitbreaker.State{
+		"i1": {NumRequests: 2, Time: now},
+		"i2": {Open: true, Time: now},
+	}, states)
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cuirass")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := circuitbreaker.NewFileStateStore(dir)
+	states, err := s.States("cmd/key")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(states))
+
+	now := time.Unix(1000, 0).UTC()
+	assert.Nil(t, s.Publish("cmd/key", "host:1", circuitbreaker.State{Open: true, OpenTime: now, Time: now}))
+	assert.Nil(t, s.Publish("cmd/key", "host:2", circuitbreaker.State{NumRequests: 3, NumErrors: 1, Time: now}))
+
+	// States are visible to other stores using the same directory.
+	states, err = circuitbreaker.NewFileStateStore(dir).States("cmd/key")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(states))
+	assert.True(t, states["host:1"].Open)
+	assert.True(t, now.Equal(states["host:1"].OpenTime))
+	assert.Equal(t, 3, states["host:2"].NumRequests)
+	assert.Equal(t, 1, states["host:2"].NumErrors)
+}
+
+func TestFileStateStoreDeletesStaleStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cuirass")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := util.NewTestableClock(time.Now())
+	s := circuitbreaker.NewFileStateStoreWithClock(dir, clock)
+	s.SetTTL(time.Minute)
+	assert.Nil(t, s.Publish("cb", "old", circuitbreaker.State{Time: clock.Now()}))
+	clock.Add(2 * time.Minute)
+	assert.Nil(t, s.Publish("cb", "new", circuitbreaker.State{Time: clock.Now()}))
+	old := filepath.Join(dir, "cb", "old.json")
+
+	states, err := s.States("cb")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(states))
+	assert.Contains(t, states, "new")
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// countingStateStore is a StateStore counting the publishes of the states.
+type countingStateStore struct {
+	circuitbreaker.StateStore
+	publishes int64
+}
+
+func (s *countingStateStore) Publish(name, instance string, state circuitbreaker.State) error {
+	defer atomic.AddInt64(&s.publishes, 1)
+	return s.StateStore.Publish(name, instance, state)
+}
+
+// waitForSync advances the clock until the circuit breaker finished a
+// synchronization with the store that started after the call. Only one
+// synchronization runs at a time so the second publish after the call means
+// that the first one finished.
+func waitForSync(t *testing.T, cb *circuitbreaker.CircuitBreaker, store *countingStateStore, clock *util.TestableClock) {
+	publishes := atomic.LoadInt64(&store.publishes)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&store.publishes) < publishes+2 {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit breaker did not synchronize with the store")
+		}
+		clock.Add(time.Millisecond)
+		cb.IsOpen()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newCountingStateStore() *countingStateStore {
+	return &countingStateStore{StateStore: circuitbreaker.NewMemoryStateStore()}
+}
+
+func TestCircuitBreakerOpensOnRemoteOpenState(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	store := newCountingStateStore()
+	cb := newTestingCircuitBreaker(nil, clock)
+	cb.SetStateStore(store, "cb", "local")
+	assert.False(t, cb.IsOpen())
+	waitForSync(t, cb, store, clock)
+	assert.False(t, cb.IsOpen())
+
+	store.Publish("cb", "remote", circuitbreaker.State{Open: true, OpenTime: clock.Now(), Time: clock.Now()})
+	waitForSync(t, cb, store, clock)
+	assert.True(t, cb.IsOpen())
+	// Local state is published to the store on next sync.
+	waitForSync(t, cb, store, clock)
+	states, _ := store.States("cb")
+	assert.True(t, states["local"].Open)
+}
+
+func TestCircuitBreakerIgnoresStaleRemoteStates(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	store := newCountingStateStore()
+	store.Publish("cb", "remote", circuitbreaker.State{Open: true, OpenTime: clock.Now(), Time: clock.Now()})
+	clock.Add(time.Minute)
+	cb := newTestingCircuitBreaker(nil, clock)
+	cb.SetStateStore(store, "cb", "local")
+	waitForSync(t, cb, store, clock)
+	assert.False(t, cb.IsOpen())
+}
+
+func TestCircuitBreakerAggregatesRemoteHealth(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	store := newCountingStateStore()
+	store.Publish("cb", "remote", circuitbreaker.State{NumRequests: 10, NumErrors: 10, Time: clock.Now()})
+	cb := newTestingCircuitBreaker(nil, clock)
+	cb.SetStateStore(store, "cb", "local")
+	waitForSync(t, cb, store, clock)
+
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen(), "Request volume and errors of other instances trip the breaker")
+}
+
+func TestCircuitBreakerDoesNotWaitForStore(t *testing.T) {
+	store := &blockingStateStore{make(chan struct{})}
+	defer close(store.unblock)
+	cb := newTestingCircuitBreaker(nil, nil)
+	cb.SetStateStore(store, "cb", "local")
+
+	done := make(chan bool)
+	go func() { done <- cb.IsOpen() }()
+	select {
+	case open := <-done:
+		assert.False(t, open)
+	case <-time.After(time.Second):
+		t.Fatal("IsOpen waited for the store")
+	}
+}
+
+// blockingStateStore is a StateStore that blocks until unblock is closed.
+type blockingStateStore struct {
+	unblock chan struct{}
+}
+
+func (s *blockingStateStore) Publish(name, instance string, state circuitbreaker.State) error {
+	<-s.unblock
+	return nil
+}
+
+func (s *blockingStateStore) States(name string) (map[string]circuitbreaker.State, error) {
+	<-s.unblock
+	return nil, nil
+}
+
+type failingStateStore struct{}
+
+func (s failingStateStore) Publish(name, instance string, state circuitbreaker.State) error {
+	return errors.New("unavailable")
+}
+
+func (s failingStateStore) States(name string) (map[string]circuitbreaker.State, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestCircuitBreakerLocalStateWhenStoreUnavailable(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("requestThreshold", "1")
+	clock := util.NewTestableClock(time.Now())
+	cb := newTestingCircuitBreaker(cfg, clock)
+	cb.SetStateStore(failingStateStore{}, "cb", "local")
+
+	assert.Nil(t, cb.Do(func() error { return nil }))
+	cb.Do(func() error { return testErr })
+	cb.Do(func() error { return testErr })
+	clock.Add(time.Millisecond)
+	assert.True(t, cb.IsOpen())
+}
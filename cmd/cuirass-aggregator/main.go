@@ -0,0 +1,41 @@
+// Command cuirass-aggregator merges the metrics streams of multiple instances
+// and serves the cluster-wide stream at /cuirass.stream.
+//
+// Usage:
+//
+//	cuirass-aggregator -listen :8990 http://host1:8989/cuirass.stream http://host2:8989/cuirass.stream
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/arjantop/cuirass/metricsaggregator"
+)
+
+func main() {
+	listen := flag.String("listen", ":8990", "address to serve the merged stream on")
+	retry := flag.Duration("retry", metricsaggregator.DefaultRetryInterval, "delay before reconnecting to a failed stream")
+	staleAfter := flag.Duration("stale", metricsaggregator.DefaultStaleAfter, "age after which records of an instance are dropped")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] stream-url...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	aggregator := metricsaggregator.NewAggregator(flag.Args()...)
+	aggregator.SetRetryInterval(*retry)
+	aggregator.SetStaleAfter(*staleAfter)
+	aggregator.Start()
+	defer aggregator.Stop()
+
+	http.Handle("/cuirass.stream", metricsaggregator.NewStream(aggregator))
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
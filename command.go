@@ -15,12 +15,25 @@ var FallbackNotImplemented = errors.New("Fallback not implemented")
 // for the command.
 type CommandFunc func(ctx context.Context) (interface{}, error)
 
+// A ProbeFunc is a function that checks the health of the dependency protected
+// by the command.
+type ProbeFunc func(ctx context.Context) error
+
+// An ErrorClassifier maps the error of a failed command to a label from a small
+// set of labels (for example "connection_refused", "5xx" or "decode") that
+// breaks down the failures in metrics and request logs. Empty label means the
+// error is not classified.
+type ErrorClassifier func(err error) string
+
 // Command is a wrapper for a code that requires latency and fault tolerance
 // (typically service call over the network).
 type Command struct {
 	name, group   string
 	run, fallback CommandFunc
 	cacheKey      string
+	breakerKey    string
+	probe         ProbeFunc
+	classifier    ErrorClassifier
 }
 
 // Name returns the name of the command.
@@ -53,6 +66,23 @@ func (c *Command) CacheKey() string {
 	return c.cacheKey
 }
 
+// BreakerKey returns a key used for selecting the circuit breaker of the command.
+// Empty key means that the command uses the shared circuit breaker of all
+// commands with the same name.
+func (c *Command) BreakerKey() string {
+	return c.breakerKey
+}
+
+// HasProbe returns true if the command has a health probe configured.
+func (c *Command) HasProbe() bool {
+	return c.probe != nil
+}
+
+// Probe executes the health probe of the command.
+func (c *Command) Probe(ctx context.Context) error {
+	return c.probe(ctx)
+}
+
 func (c *Command) Properties(cfg vaquita.DynamicConfig) *CommandProperties {
 	return GetProperties(cfg, c.Name(), c.Group())
 }
@@ -62,6 +92,9 @@ type CommandBuilder struct {
 	name, group   string
 	run, fallback CommandFunc
 	cacheKey      string
+	breakerKey    string
+	probe         ProbeFunc
+	classifier    ErrorClassifier
 }
 
 // NewCommand constructs a new CommandBuilder with minimal required command
@@ -96,14 +129,42 @@ func (b *CommandBuilder) CacheKey(cacheKey string) *CommandBuilder {
 	return b
 }
 
+// BreakerKey sets a circuit breaker key to the command being built. Commands
+// with the same name but different keys (for example a target host or a shard)
+// keep independent circuit breakers, while their metrics are still aggregated
+// under the command name.
+func (b *CommandBuilder) BreakerKey(key string) *CommandBuilder {
+	b.breakerKey = key
+	return b
+}
+
+// Probe sets a health probe to the command being built. While the circuit of
+// the command is open the probe is executed in the background instead of using
+// user requests as trials. The probe of the first executed command is used for
+// all commands sharing the same circuit breaker.
+func (b *CommandBuilder) Probe(probe ProbeFunc) *CommandBuilder {
+	b.probe = probe
+	return b
+}
+
+// ErrorClassifier sets an error classifier to the command being built. It
+// overrides the error classifier of the executor.
+func (b *CommandBuilder) ErrorClassifier(c ErrorClassifier) *CommandBuilder {
+	b.classifier = c
+	return b
+}
+
 // Build builds a command with all configured parameters.
 func (b *CommandBuilder) Build() *Command {
 	cmd := &Command{
-		name:     b.name,
-		group:    b.group,
-		run:      b.run,
-		cacheKey: b.cacheKey,
-		fallback: b.fallback,
+		name:       b.name,
+		group:      b.group,
+		run:        b.run,
+		cacheKey:   b.cacheKey,
+		breakerKey: b.breakerKey,
+		probe:      b.probe,
+		classifier: b.classifier,
+		fallback:   b.fallback,
 	}
 	if b.fallback == nil {
 		// If no fallback is configured use a default fallback returning an error.
@@ -1,9 +1,11 @@
 package cuirass
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/arjantop/cuirass/circuitbreaker"
+	"github.com/arjantop/cuirass/metrics"
 	"github.com/arjantop/vaquita"
 )
 
@@ -13,7 +15,10 @@ type CommandProperties struct {
 	FallbackEnabled                vaquita.BoolProperty
 	RequestCacheEnabled            vaquita.BoolProperty
 	RequestLogEnabled              vaquita.BoolProperty
+	CircuitBreakerMaxKeys          vaquita.IntProperty
 	CircuitBreaker                 *circuitbreaker.CircuitBreakerProperties
+	GroupCircuitBreaker            *circuitbreaker.CircuitBreakerProperties
+	Metrics                        *metrics.CommandMetricsProperties
 }
 
 const (
@@ -29,25 +34,93 @@ const (
 	CircuitBreakerErrorThresholdPercentageDefault = 50
 	CircuitBreakerForceOpenDefault                = false
 	CircuitBreakerForceClosedDefault              = false
+	CircuitBreakerMaxKeysDefault                  = 100
+	CircuitBreakerLatencyThresholdDefault         = 0
+	CircuitBreakerLatencyPercentileDefault        = 99
+	GroupCircuitBreakerEnabledDefault             = false
+
+	MetricsRollingStatisticalWindowDefault        = 10000 * time.Millisecond
+	MetricsRollingStatisticalWindowBucketsDefault = 10
+	SLOTargetDefault                              = 0
+	SLOLatencyObjectiveDefault                    = 0
 )
 
 func newCommandProperties(cfg vaquita.DynamicConfig, commandName, commandGroup string) *CommandProperties {
 	pf := vaquita.NewPropertyFactory(cfg)
 	propertyPrefix := pf.GetStringProperty("cuirass.config.prefix", "cuirass").Get()
+	metricsProperties := &metrics.CommandMetricsProperties{
+		RollingStatisticalWindow:        newDurationProperty(pf, propertyPrefix+".command", commandName, "metrics.rollingStats.timeInMilliseconds", MetricsRollingStatisticalWindowDefault),
+		RollingStatisticalWindowBuckets: newIntProperty(pf, propertyPrefix+".command", commandName, "metrics.rollingStats.numBuckets", MetricsRollingStatisticalWindowBucketsDefault),
+		SLOTarget:                       newFloatProperty(pf, propertyPrefix+".command", commandName, "slo.target", SLOTargetDefault),
+		SLOLatencyObjective:             newDurationProperty(pf, propertyPrefix+".command", commandName, "slo.latencyObjectiveInMilliseconds", SLOLatencyObjectiveDefault),
+	}
+	groupMetricsProperties := &metrics.CommandMetricsProperties{
+		RollingStatisticalWindow:        newDurationProperty(pf, propertyPrefix+".group", commandGroup, "metrics.rollingStats.timeInMilliseconds", MetricsRollingStatisticalWindowDefault),
+		RollingStatisticalWindowBuckets: newIntProperty(pf, propertyPrefix+".group", commandGroup, "metrics.rollingStats.numBuckets", MetricsRollingStatisticalWindowBucketsDefault),
+	}
 	return &CommandProperties{
 		ExecutionTimeout:               newDurationProperty(pf, propertyPrefix+".command", commandName, "execution.isolation.thread.timeoutInMilliseconds", ExecutionTimeoutDefault),
 		ExecutionMaxConcurrentRequests: newIntProperty(pf, propertyPrefix+".command", commandGroup, "execution.isolation.semaphore.maxConcurrentRequests", ExecutionMaxConcurrentRequestsDefault),
 		FallbackEnabled:                newBoolProperty(pf, propertyPrefix+".command", commandName, "fallback.enabled", FallbackEnabledDefault),
 		RequestCacheEnabled:            newBoolProperty(pf, propertyPrefix+".command", commandName, "requestCache.enabled", RequestCacheEnabledDefault),
 		RequestLogEnabled:              newBoolProperty(pf, propertyPrefix+".command", commandName, "requestLog.enabled", RequestLogEnabledDefault),
-		CircuitBreaker: &circuitbreaker.CircuitBreakerProperties{
-			Enabled:                  newBoolProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.enabled", CircuitBreakerEnabledDefault),
-			RequestVolumeThreshold:   newIntProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.requestVolumeThreshold", CircuitBreakerRequestVolumeThresholdDefault),
-			SleepWindow:              newDurationProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.sleepWindowInMilliseconds", CircuitBreakerSleepWindowDefault),
-			ErrorThresholdPercentage: newIntProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.errorThresholdPercentage", CircuitBreakerErrorThresholdPercentageDefault),
-			ForceOpen:                newBoolProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.forceOpen", CircuitBreakerForceOpenDefault),
-			ForceClosed:              newBoolProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.forceClosed", CircuitBreakerForceClosedDefault),
-		},
+		CircuitBreakerMaxKeys:          newIntProperty(pf, propertyPrefix+".command", commandName, "circuitbreaker.maxKeys", CircuitBreakerMaxKeysDefault),
+		CircuitBreaker:                 newCircuitBreakerProperties(pf, propertyPrefix+".command", commandName, CircuitBreakerEnabledDefault, metricsProperties),
+		GroupCircuitBreaker:            newCircuitBreakerProperties(pf, propertyPrefix+".group", commandGroup, GroupCircuitBreakerEnabledDefault, groupMetricsProperties),
+		Metrics:                        metricsProperties,
+	}
+}
+
+// Values returns the current values of the properties keyed by their names.
+// Durations are in milliseconds.
+func (p *CommandProperties) Values() map[string]interface{} {
+	return map[string]interface{}{
+		"executionTimeoutInMilliseconds":                   toMilliseconds(p.ExecutionTimeout.Get()),
+		"executionIsolationSemaphoreMaxConcurrentRequests": p.ExecutionMaxConcurrentRequests.Get(),
+		"fallbackEnabled":                                  p.FallbackEnabled.Get(),
+		"requestCacheEnabled":                              p.RequestCacheEnabled.Get(),
+		"requestLogEnabled":                                p.RequestLogEnabled.Get(),
+		"circuitBreakerMaxKeys":                            p.CircuitBreakerMaxKeys.Get(),
+		"circuitBreakerEnabled":                            p.CircuitBreaker.Enabled.Get(),
+		"circuitBreakerRequestVolumeThreshold":             p.CircuitBreaker.RequestVolumeThreshold.Get(),
+		"circuitBreakerSleepWindowInMilliseconds":          toMilliseconds(p.CircuitBreaker.SleepWindow.Get()),
+		"circuitBreakerErrorThresholdPercentage":           p.CircuitBreaker.ErrorThresholdPercentage.Get(),
+		"circuitBreakerForceOpen":                          p.CircuitBreaker.ForceOpen.Get(),
+		"circuitBreakerForceClosed":                        p.CircuitBreaker.ForceClosed.Get(),
+		"circuitBreakerLatencyThresholdInMilliseconds":     toMilliseconds(p.CircuitBreaker.LatencyThreshold.Get()),
+		"circuitBreakerLatencyPercentile":                  p.CircuitBreaker.LatencyPercentile.Get(),
+		"groupCircuitBreakerEnabled":                       p.GroupCircuitBreaker.Enabled.Get(),
+		"metricsRollingStatisticalWindowInMilliseconds":    toMilliseconds(p.Metrics.RollingStatisticalWindow.Get()),
+		"metricsRollingStatisticalWindowBuckets":           p.Metrics.RollingStatisticalWindowBuckets.Get(),
+		"sloTarget":                                        p.Metrics.SLOTarget.Get(),
+		"sloLatencyObjectiveInMilliseconds":                toMilliseconds(p.Metrics.SLOLatencyObjective.Get()),
+	}
+}
+
+func toMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// newCircuitBreakerProperties constructs circuit breaker properties for a command
+// or a group with the given name. The circuit breaker uses the same statistical
+// window as metrics.
+func newCircuitBreakerProperties(
+	pf *vaquita.PropertyFactory,
+	prefix, name string,
+	enabledDefault bool,
+	metricsProperties *metrics.CommandMetricsProperties) *circuitbreaker.CircuitBreakerProperties {
+
+	return &circuitbreaker.CircuitBreakerProperties{
+		Enabled:                         newBoolProperty(pf, prefix, name, "circuitbreaker.enabled", enabledDefault),
+		RequestVolumeThreshold:          newIntProperty(pf, prefix, name, "circuitbreaker.requestVolumeThreshold", CircuitBreakerRequestVolumeThresholdDefault),
+		SleepWindow:                     newDurationProperty(pf, prefix, name, "circuitbreaker.sleepWindowInMilliseconds", CircuitBreakerSleepWindowDefault),
+		ErrorThresholdPercentage:        newIntProperty(pf, prefix, name, "circuitbreaker.errorThresholdPercentage", CircuitBreakerErrorThresholdPercentageDefault),
+		ForceOpen:                       newBoolProperty(pf, prefix, name, "circuitbreaker.forceOpen", CircuitBreakerForceOpenDefault),
+		ForceClosed:                     newBoolProperty(pf, prefix, name, "circuitbreaker.forceClosed", CircuitBreakerForceClosedDefault),
+		LatencyThreshold:                newDurationProperty(pf, prefix, name, "circuitbreaker.latencyThresholdInMilliseconds", CircuitBreakerLatencyThresholdDefault),
+		LatencyPercentile:               newIntProperty(pf, prefix, name, "circuitbreaker.latencyPercentile", CircuitBreakerLatencyPercentileDefault),
+		RollingStatisticalWindow:        metricsProperties.RollingStatisticalWindow,
+		RollingStatisticalWindowBuckets: metricsProperties.RollingStatisticalWindowBuckets,
 	}
 }
 
@@ -69,3 +142,29 @@ func newDurationProperty(f *vaquita.PropertyFactory, prefix, commandName, proper
 		time.Millisecond,
 		f.GetDurationProperty(prefix+".default."+propertyName, defaultValue, time.Millisecond))
 }
+
+// chainedFloatProperty is a floating point property with a fallback property.
+// Values that can not be parsed are ignored.
+type chainedFloatProperty struct {
+	value        vaquita.StringProperty
+	fallback     vaquita.StringProperty
+	defaultValue float64
+}
+
+func (p *chainedFloatProperty) Get() float64 {
+	if v, err := strconv.ParseFloat(p.value.Get(), 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseFloat(p.fallback.Get(), 64); err == nil {
+		return v
+	}
+	return p.defaultValue
+}
+
+func newFloatProperty(f *vaquita.PropertyFactory, prefix, commandName, propertyName string, defaultValue float64) metrics.FloatProperty {
+	return &chainedFloatProperty{
+		value:        f.GetStringProperty(prefix+"."+commandName+"."+propertyName, ""),
+		fallback:     f.GetStringProperty(prefix+".default."+propertyName, ""),
+		defaultValue: defaultValue,
+	}
+}
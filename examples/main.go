@@ -14,6 +14,8 @@ import (
 	"github.com/arjantop/cuirass"
 	"github.com/arjantop/cuirass/examples/commands"
 	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/metricsjson"
+	"github.com/arjantop/cuirass/metricspublisher"
 	"github.com/arjantop/cuirass/metricsstream"
 	"github.com/arjantop/cuirass/requestcache"
 	"github.com/arjantop/cuirass/requestlog"
@@ -26,8 +28,11 @@ func main() {
 	executor := cuirass.NewExecutor(vaquita.NewMapConfig(map[string]string{
 		"cuirass.command.CreditCardCommand.execution.isolation.thread.timeoutInMilliseconds":     "3000",
 		"cuirass.command.GetUserAccountCommand.execution.isolation.thread.timeoutInMilliseconds": "50",
+		"metrics.publisher.flushIntervalInMilliseconds":                                          "10000",
 	}))
-	monitorMetrics(executor)
+	executor.Metrics().AddPublisher(consolePublisher{})
+	// Metrics are also available at /debug/vars.
+	executor.Metrics().AddPublisher(metricspublisher.NewExpvarPublisher("cuirass"))
 	http.HandleFunc("/payment", func(w http.ResponseWriter, r *http.Request) {
 		ctx := requestlog.WithRequestLog(requestcache.WithRequestCache(context.Background()))
 
@@ -36,25 +41,20 @@ func main() {
 		fmt.Fprintf(w, "Request => %s\n", requestlog.FromContext(ctx).String())
 	})
 	http.Handle("/cuirass.stream", metricsstream.NewMetricsStream(executor))
+	http.Handle("/cuirass.json", metricsjson.NewHandler(executor))
 	log.Fatal(http.ListenAndServe(":8989", nil))
 }
 
-func monitorMetrics(exec *cuirass.CommandExecutor) {
-	timer := time.NewTimer(10 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-timer.C:
-				var b bytes.Buffer
-				for _, m := range exec.Metrics().All() {
-					b.WriteString("# " + m.CommandName() + ": " + commandMetricsAsString(m))
-					b.WriteString("\n")
-				}
-				fmt.Println(b.String())
-				timer.Reset(10 * time.Second)
-			}
-		}
-	}()
+// consolePublisher prints the metrics of all commands to the standard output.
+type consolePublisher struct{}
+
+func (p consolePublisher) Publish(all []*metrics.CommandMetrics) {
+	var b bytes.Buffer
+	for _, m := range all {
+		b.WriteString("# " + m.CommandName() + ": " + commandMetricsAsString(m))
+		b.WriteString("\n")
+	}
+	fmt.Println(b.String())
 }
 
 func commandMetricsAsString(m *metrics.CommandMetrics) string {
@@ -2,6 +2,7 @@ package cuirass
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,6 +18,9 @@ import (
 var (
 	UnknownPanic      = errors.New("unknown panic")
 	SemaphoreRejected = errors.New("semaphore rejected")
+	// GroupCircuitOpenError is returned when the circuit breaker of the command
+	// group is open and the request was not executed.
+	GroupCircuitOpenError = errors.New("group circuit open")
 )
 
 // Executor is a main service that knows how to execute commands and handle
@@ -31,8 +35,13 @@ type CommandExecutor struct {
 	clock           util.Clock
 	cfg             vaquita.DynamicConfig
 	circuitBreakers cbMap
+	groupBreakers   cbMap
 	semaphores      *SemaphoreFactory
 	metrics         *metrics.ExecutionMetrics
+	stateStore      circuitbreaker.StateStore
+	instance        string
+	tracer          Tracer
+	classifier      ErrorClassifier
 }
 
 // NewExecutor constructs a new empty executor.
@@ -41,21 +50,89 @@ func NewExecutor(cfg vaquita.DynamicConfig) *CommandExecutor {
 }
 
 func NewExecutorWithClock(cfg vaquita.DynamicConfig, clock util.Clock) *CommandExecutor {
-	return &CommandExecutor{
+	e := &CommandExecutor{
 		clock:           clock,
 		cfg:             cfg,
 		circuitBreakers: newCbMap(),
+		groupBreakers:   newCbMap(),
 		semaphores:      NewSemaphoreFactory(),
 		metrics:         metrics.NewExecutionMetrics(metrics.NewMetricsProperties(cfg), clock),
 	}
+	e.metrics.SetCommandState(e)
+	e.metrics.OnEvict(e.evict)
+	return e
+}
+
+// SetStateStore sets a store used for sharing the state of circuit breakers with
+// executors in other processes. Instance is a name that uniquely identifies
+// this executor in the store.
+// SetStateStore must be called before any command is executed.
+func (e *CommandExecutor) SetStateStore(store circuitbreaker.StateStore, instance string) {
+	e.stateStore = store
+	e.instance = instance
+}
+
+// SetTracer sets a tracer that traces all command executions.
+// SetTracer must be called before any command is executed.
+func (e *CommandExecutor) SetTracer(t Tracer) {
+	e.tracer = t
+}
+
+// SetErrorClassifier sets an error classifier used for commands without their
+// own error classifier.
+// SetErrorClassifier must be called before any command is executed.
+func (e *CommandExecutor) SetErrorClassifier(c ErrorClassifier) {
+	e.classifier = c
 }
 
 func (e *CommandExecutor) Metrics() *metrics.ExecutionMetrics {
 	return e.metrics
 }
 
+// CommandProperties returns the properties of the command with the given name
+// and group. Unlike the executions it does not add the properties to the cache
+// of properties, so it can be used to read properties of any command.
+func (e *CommandExecutor) CommandProperties(name, group string) *CommandProperties {
+	return lookupProperties(e.cfg, name, group)
+}
+
+// CommandPropertyValues returns the current values of the properties of the
+// command with the given name and group.
+func (e *CommandExecutor) CommandPropertyValues(name, group string) map[string]interface{} {
+	return e.CommandProperties(name, group).Values()
+}
+
+// Semaphore returns the semaphore limiting the concurrent executions of the
+// commands in the group if any command of the group was executed.
+func (e *CommandExecutor) Semaphore(group string) (*util.Semaphore, bool) {
+	return e.semaphores.Find(group)
+}
+
+// IsCircuitBreakerOpen returns true if the shared (unkeyed) circuit breaker of
+// the command is open.
 func (e *CommandExecutor) IsCircuitBreakerOpen(cmdName string) bool {
-	if cb, ok := e.circuitBreakers.get(cmdName); ok {
+	return e.IsCircuitBreakerOpenForKey(cmdName, "")
+}
+
+// IsCircuitBreakerOpenForKey returns true if the circuit breaker of the command
+// for the given breaker key is open.
+func (e *CommandExecutor) IsCircuitBreakerOpenForKey(cmdName, key string) bool {
+	if cb, ok := e.circuitBreakers.get(cmdName, key); ok {
+		return cb.IsOpen()
+	}
+	return false
+}
+
+// CircuitBreakerKeys returns the sorted breaker keys of the keyed circuit
+// breakers of the command.
+func (e *CommandExecutor) CircuitBreakerKeys(cmdName string) []string {
+	return e.circuitBreakers.keys(cmdName)
+}
+
+// IsGroupCircuitBreakerOpen returns true if the circuit breaker of the group
+// is open.
+func (e *CommandExecutor) IsGroupCircuitBreakerOpen(group string) bool {
+	if cb, ok := e.groupBreakers.get(group, ""); ok {
 		return cb.IsOpen()
 	}
 	return false
@@ -65,56 +142,102 @@ func (e *CommandExecutor) IsCircuitBreakerOpen(cmdName string) bool {
 // If command fails with an error or panics Fallback function with fallback logic
 // is executed. Every command execution is guarded by an internal circuit-breaker.
 // Panics are recovered and returned as errors.
+// Commands over the limit of tracked commands share the circuit breakers, the
+// semaphore and the properties of the metrics.OverflowCommandName.
 func (e *CommandExecutor) Exec(ctx context.Context, cmd *Command) (result interface{}, err error) {
 	var responseFromCache bool
+	var cb *circuitbreaker.CircuitBreaker
+	name, group := cmd.Name(), cmd.Group()
+	if !e.metrics.Track(name) {
+		name, group = metrics.OverflowCommandName, metrics.OverflowCommandName
+	}
+	props := GetProperties(e.cfg, name, group)
 	stats := newExecutionStats(time.Now())
+	ctx, span := e.startSpan(ctx, cmd, ExecSpan)
+	defer func() {
+		span.End(SpanInfo{
+			Events:      stats.events,
+			Err:         err,
+			CircuitOpen: cb != nil && cb.IsOpen(),
+		})
+	}()
 	defer func() {
 		if r := recover(); r != nil {
-			if !cmd.Properties(e.cfg).FallbackEnabled.Get() {
+			if !props.FallbackEnabled.Get() {
 				stats.addEvent(requestlog.Failure)
-				e.logRequest(ctx, stats.toExecutionInfo(cmd.Name()), cmd.Properties(e.cfg))
+				e.classifyFailure(cmd, &stats, r)
+				e.logRequest(ctx, name, stats.toExecutionInfo(cmd.Name()), stats.latency(), props)
 				return
 			} else {
-				result, err = e.execFallback(ctx, cmd, stats, r)
+				result, err = e.execFallback(ctx, cmd, name, props, &stats, r)
 			}
 		} else if !responseFromCache {
 			// The request was successfully completed.
 			stats.addEvent(requestlog.Success)
-			e.logRequest(ctx, stats.toExecutionInfo(cmd.Name()), cmd.Properties(e.cfg))
+			e.logRequest(ctx, name, stats.toExecutionInfo(cmd.Name()), stats.latency(), props)
 		}
-		if cache := e.getRequestCache(ctx, cmd); cache != nil && !responseFromCache {
-			cache.Add(cmd.Name(), cmd.CacheKey(), stats.toExecutionInfo(cmd.Name()), result, err)
+		if cache := e.getRequestCache(ctx, cmd, props); cache != nil && !responseFromCache {
+			if cache.Add(cmd.Name(), cmd.CacheKey(), stats.toExecutionInfo(cmd.Name()), result, err) {
+				e.metrics.UpdateCache(name, metrics.CacheStore)
+			}
 		}
 	}()
 
-	if cache := e.getRequestCache(ctx, cmd); cache != nil {
+	if cache := e.getRequestCache(ctx, cmd, props); cache != nil {
 		if ec := cache.Get(cmd.Name(), cmd.CacheKey()); ec != nil {
+			e.metrics.UpdateCache(name, metrics.CacheHit)
 			// Return the cached return values straight from cache.
 			result, err = ec.Response()
 			// Mark that the response came from cache and we already did the logging.
 			responseFromCache = true
-			e.logRequest(ctx, *ec.ExecutionInfo(), cmd.Properties(e.cfg))
+			info := ec.ExecutionInfo()
+			stats.events = info.Events()
+			_, cacheSpan := e.startSpan(ctx, cmd, CacheSpan)
+			cacheSpan.End(SpanInfo{Events: info.Events(), Err: err})
+			e.logRequest(ctx, name, *info, stats.latency(), props)
 			return
 		}
+		e.metrics.UpdateCache(name, metrics.CacheMiss)
 	}
 
-	if timeout := cmd.Properties(e.cfg).ExecutionTimeout.Get(); timeout != 0 {
+	if timeout := props.ExecutionTimeout.Get(); timeout != 0 {
 		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, cmd.Properties(e.cfg).ExecutionTimeout.Get())
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
-	cb := e.getCircuitBreakerForCommand(cmd)
-	// Execute the command in the context of its circuit-breaker.
-	err = cb.Do(func() error {
-		s := e.semaphores.Get(cmd.Group(), cmd.Properties(e.cfg).ExecutionMaxConcurrentRequests.Get())
-		if ok := s.TryAcquire(); ok {
-			defer s.Release()
-			rr, rerr := cmd.Run(ctx)
-			result = rr
-			return rerr
+	gcb := e.getGroupCircuitBreaker(group, props)
+	cb = e.getCircuitBreakerForCommand(cmd, name, group, props)
+	// Execute the command in the context of its group and command circuit-breakers.
+	var groupAllowed, executed bool
+	err = gcb.Do(func() error {
+		groupAllowed = true
+		err := cb.Do(func() error {
+			s := e.semaphores.Get(group, props.ExecutionMaxConcurrentRequests.Get())
+			if ok := s.TryAcquire(); ok {
+				defer s.Release()
+				executed = true
+				e.metrics.ExecutionStarted(name, group)
+				defer e.metrics.ExecutionFinished(name, group)
+				runStart := time.Now()
+				stats.permitWait = runStart.Sub(stats.startTime)
+				defer func() { stats.runTime = time.Since(runStart) }()
+				rr, rerr := e.traceFunc(ctx, cmd, RunSpan, cmd.Run)
+				result = rr
+				return rerr
+			}
+			return SemaphoreRejected
+		})
+		if !executed {
+			// The command was rejected by its circuit breaker or the semaphore,
+			// only the results of executed commands affect the group health.
+			return circuitbreaker.Rejected(err)
 		}
-		return SemaphoreRejected
+		return err
 	})
+	if err == circuitbreaker.CircuitOpenError && !groupAllowed {
+		// The request was rejected by the group circuit breaker.
+		err = GroupCircuitOpenError
+	}
 	if err != nil {
 		// Panic with error and handle it the same as panic.
 		panic(err)
@@ -122,9 +245,9 @@ func (e *CommandExecutor) Exec(ctx context.Context, cmd *Command) (result interf
 	return
 }
 
-func (e *CommandExecutor) getRequestCache(ctx context.Context, cmd *Command) *requestcache.RequestCache {
+func (e *CommandExecutor) getRequestCache(ctx context.Context, cmd *Command, props *CommandProperties) *requestcache.RequestCache {
 	cache := requestcache.FromContext(ctx)
-	if cache != nil && cmd.IsCacheable() && cmd.Properties(e.cfg).RequestCacheEnabled.Get() {
+	if cache != nil && cmd.IsCacheable() && props.RequestCacheEnabled.Get() {
 		return cache
 	}
 	return nil
@@ -135,6 +258,12 @@ func (e *CommandExecutor) getRequestCache(ctx context.Context, cmd *Command) *re
 type executionStats struct {
 	startTime time.Time
 	events    []requestlog.ExecutionEvent
+	// permitWait is the time from the start of the execution to the start of
+	// the Run function and runTime is the duration of the Run function.
+	permitWait time.Duration
+	runTime    time.Duration
+	// errorLabel is the label of the error of a failed execution.
+	errorLabel string
 }
 
 // newExecutionStats constructs a new executionStats with execution start time
@@ -153,12 +282,34 @@ func (e *executionStats) addEvent(event requestlog.ExecutionEvent) {
 
 // toExecutionInfo constructs an ExecutionInfo from the gathered data.
 func (e *executionStats) toExecutionInfo(commandName string) requestlog.ExecutionInfo {
-	return requestlog.NewExecutionInfo(commandName, time.Since(e.startTime), e.events)
+	return requestlog.NewExecutionInfo(commandName, time.Since(e.startTime), e.events).WithErrorLabel(e.errorLabel)
 }
 
-// logRequest logs a request if the context contains a RequestLogger.
-func (e *CommandExecutor) logRequest(ctx context.Context, info requestlog.ExecutionInfo, props *CommandProperties) {
-	e.metrics.Update(info.CommandName(), info.ExecutionTime(), info.Events()...)
+// latency returns the latencies of the execution up to now.
+func (e *executionStats) latency() metrics.Latency {
+	return metrics.Latency{
+		Execute:    e.runTime,
+		Total:      time.Since(e.startTime),
+		PermitWait: e.permitWait,
+	}
+}
+
+// logRequest records the execution in the metrics of the command tracked under
+// the name and logs a request if the context contains a RequestLogger. The
+// request log keeps the name of the executed command even if its metrics are
+// recorded under the metrics.OverflowCommandName.
+func (e *CommandExecutor) logRequest(
+	ctx context.Context,
+	name string,
+	info requestlog.ExecutionInfo,
+	latency metrics.Latency,
+	props *CommandProperties) {
+
+	events := info.Events()
+	if label := info.ErrorLabel(); label != "" && !hasEvent(events, requestlog.ResponseFromCache) {
+		e.metrics.UpdateError(name, label)
+	}
+	e.metrics.UpdateLatency(name, latency, events...)
 	if logger := requestlog.FromContext(ctx); props.RequestLogEnabled.Get() && logger != nil {
 		logger.AddExecutionInfo(info)
 	}
@@ -169,7 +320,9 @@ func (e *CommandExecutor) logRequest(ctx context.Context, info requestlog.Execut
 func (e *CommandExecutor) execFallback(
 	ctx context.Context,
 	cmd *Command,
-	stats executionStats,
+	name string,
+	props *CommandProperties,
+	stats *executionStats,
 	r interface{}) (result interface{}, err error) {
 
 	defer func() {
@@ -180,12 +333,15 @@ func (e *CommandExecutor) execFallback(
 			}
 			err = panicToError(r)
 		}
-		e.logRequest(ctx, stats.toExecutionInfo(cmd.Name()), cmd.Properties(e.cfg))
+		e.logRequest(ctx, name, stats.toExecutionInfo(cmd.Name()), stats.latency(), props)
 	}()
 
-	addEventForRequest(&stats, r)
+	addEventForRequest(stats, r)
+	if stats.events[len(stats.events)-1] == requestlog.Failure {
+		e.classifyFailure(cmd, stats, r)
+	}
 
-	result, err = cmd.Fallback(ctx)
+	result, err = e.traceFunc(ctx, cmd, FallbackSpan, cmd.Fallback)
 	if err != nil {
 		panic(r)
 	}
@@ -201,6 +357,8 @@ func addEventForRequest(stats *executionStats, r interface{}) {
 			stats.addEvent(requestlog.Timeout)
 		} else if x == circuitbreaker.CircuitOpenError {
 			stats.addEvent(requestlog.ShortCircuited)
+		} else if x == GroupCircuitOpenError {
+			stats.addEvent(requestlog.GroupShortCircuited)
 		} else if x == SemaphoreRejected {
 			stats.addEvent(requestlog.SemaphoreRejected)
 		} else {
@@ -211,6 +369,32 @@ func addEventForRequest(stats *executionStats, r interface{}) {
 	}
 }
 
+// classifyFailure sets the error label of a failed execution if the command or
+// the executor has an error classifier. Errors that are not classified get the
+// metrics.OtherErrorLabel.
+func (e *CommandExecutor) classifyFailure(cmd *Command, stats *executionStats, r interface{}) {
+	classifier := cmd.classifier
+	if classifier == nil {
+		classifier = e.classifier
+	}
+	if classifier == nil {
+		return
+	}
+	stats.errorLabel = classifier(panicToError(r))
+	if stats.errorLabel == "" {
+		stats.errorLabel = metrics.OtherErrorLabel
+	}
+}
+
+func hasEvent(events []requestlog.ExecutionEvent, e requestlog.ExecutionEvent) bool {
+	for _, ev := range events {
+		if ev == e {
+			return true
+		}
+	}
+	return false
+}
+
 // panicToError converts a panic value to a matching error value or a generic
 // UnknownPanic for unhandled types.
 func panicToError(r interface{}) (err error) {
@@ -227,48 +411,184 @@ func panicToError(r interface{}) (err error) {
 
 // getcircuitbreakerforcommand returns a circuit breaker for a command or constructs
 // a new one and returns it.
-func (e *CommandExecutor) getCircuitBreakerForCommand(cmd *Command) *circuitbreaker.CircuitBreaker {
-	if cb, ok := e.circuitBreakers.get(cmd.Name()); ok {
+// Commands with a breaker key get their own circuit breaker per key. When the
+// number of keys for a command reaches the configured maximum, commands with
+// new keys share the unkeyed circuit breaker of the command.
+// The name and the group are the ones the command is tracked under. Commands
+// tracked under the overflow name share a single unkeyed breaker without a probe.
+func (e *CommandExecutor) getCircuitBreakerForCommand(cmd *Command, name, group string, props *CommandProperties) *circuitbreaker.CircuitBreaker {
+	breakerKey := cmd.BreakerKey()
+	overflow := name == metrics.OverflowCommandName
+	if overflow {
+		breakerKey = ""
+	}
+	maxKeys := props.CircuitBreakerMaxKeys.Get()
+	if cb, ok := e.circuitBreakers.find(name, breakerKey, maxKeys); ok {
 		return cb
-	} else {
+	}
+	// The first execution of the command is a good time to set the metrics
+	// properties too.
+	e.metrics.Register(name, group, props.Metrics)
+	return e.circuitBreakers.getOrSet(name, breakerKey, maxKeys, func(key string) *circuitbreaker.CircuitBreaker {
 		cb := circuitbreaker.New(
-			cmd.Properties(e.cfg).CircuitBreaker,
+			props.CircuitBreaker,
 			e.metrics.Properties().HealthSnapshotInterval,
 			e.clock)
-		e.circuitBreakers.set(cmd.Name(), cb)
+		cb.SetLatencySource(e.metrics.ForCommand(name))
+		if cmd.HasProbe() && !overflow {
+			cb.SetProbe(func() error {
+				ctx := context.Background()
+				if timeout := props.ExecutionTimeout.Get(); timeout != 0 {
+					var cancel func()
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				return cmd.Probe(ctx)
+			})
+		}
+		if e.stateStore != nil {
+			storeName := name
+			if key != "" {
+				storeName += "/" + key
+			}
+			cb.SetStateStore(e.stateStore, storeName, e.instance)
+		}
+		return cb
+	})
+}
+
+// getGroupCircuitBreaker returns a circuit breaker for the group or constructs
+// a new one and returns it.
+// The group circuit breaker is disabled by default.
+func (e *CommandExecutor) getGroupCircuitBreaker(group string, props *CommandProperties) *circuitbreaker.CircuitBreaker {
+	if cb, ok := e.groupBreakers.get(group, ""); ok {
 		return cb
 	}
+	return e.groupBreakers.getOrSet(group, "", 0, func(key string) *circuitbreaker.CircuitBreaker {
+		return circuitbreaker.New(
+			props.GroupCircuitBreaker,
+			e.metrics.Properties().HealthSnapshotInterval,
+			e.clock)
+	})
+}
+
+// evict discards the circuit breakers and the properties of an idle command.
+// The group circuit breaker and the semaphore are discarded too if no other
+// tracked command is in the same group.
+func (e *CommandExecutor) evict(name, group string) {
+	e.circuitBreakers.remove(name)
+	removeProperties(e.cfg, name, group)
+	for _, cm := range e.metrics.All() {
+		if cm.CommandGroup() == group {
+			return
+		}
+	}
+	e.groupBreakers.remove(group)
+	e.semaphores.Remove(group)
+}
+
+// cbKey identifies a circuit breaker by command name and breaker key.
+type cbKey struct {
+	name string
+	key  string
 }
 
 // cmMap is a simple map wrapper for safe concurrent access.
 // Because most of the operations are just reading it is simply guarded by
 // one RWMutex lock.
 type cbMap struct {
-	values map[string]*circuitbreaker.CircuitBreaker
-	lock   *sync.RWMutex
+	values map[cbKey]*circuitbreaker.CircuitBreaker
+	// numKeys holds the number of keyed circuit breakers for each command.
+	numKeys map[string]int
+	lock    *sync.RWMutex
 }
 
 // newCbMap constructs a new empty cmMap.
 func newCbMap() cbMap {
 	return cbMap{
-		values: make(map[string]*circuitbreaker.CircuitBreaker),
-		lock:   new(sync.RWMutex),
+		values:  make(map[cbKey]*circuitbreaker.CircuitBreaker),
+		numKeys: make(map[string]int),
+		lock:    new(sync.RWMutex),
 	}
 }
 
-// get returns a circuit breaker for a command with a given name.
+// get returns a circuit breaker for a command with a given name and key.
 // Method is safe to access by multiple readers.
-func (m *cbMap) get(name string) (*circuitbreaker.CircuitBreaker, bool) {
+func (m *cbMap) get(name, key string) (*circuitbreaker.CircuitBreaker, bool) {
 	m.lock.RLock()
-	cb, ok := m.values[name]
+	cb, ok := m.values[cbKey{name, key}]
 	m.lock.RUnlock()
 	return cb, ok
 }
 
-// set adds a circuit breaker to the map for a given command name.
-// Only one writer and no readers can access the map when executing set.
-func (m *cbMap) set(name string, cb *circuitbreaker.CircuitBreaker) {
+// find returns a circuit breaker for a command with a given name and key. If
+// there is none for the key and the command already has maxKeys keyed circuit
+// breakers the unkeyed circuit breaker of the command is returned, so the keys
+// over the limit do not need getOrSet once the unkeyed one exists.
+// Method is safe to access by multiple readers.
+func (m *cbMap) find(name, key string, maxKeys int) (*circuitbreaker.CircuitBreaker, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if cb, ok := m.values[cbKey{name, key}]; ok {
+		return cb, true
+	}
+	if key != "" && m.numKeys[name] >= maxKeys {
+		cb, ok := m.values[cbKey{name, ""}]
+		return cb, ok
+	}
+	return nil, false
+}
+
+// getOrSet returns a circuit breaker for a command with a given name and key
+// or adds a new one constructed with newBreaker for the selected key.
+// If the command already has maxKeys keyed circuit breakers the unkeyed circuit
+// breaker for the command is returned instead.
+// Only one writer and no readers can access the map when executing getOrSet.
+func (m *cbMap) getOrSet(name, key string, maxKeys int, newBreaker func(key string) *circuitbreaker.CircuitBreaker) *circuitbreaker.CircuitBreaker {
 	m.lock.Lock()
-	m.values[name] = cb
-	m.lock.Unlock()
+	defer m.lock.Unlock()
+	if cb, ok := m.values[cbKey{name, key}]; ok {
+		return cb
+	}
+	if key != "" && m.numKeys[name] >= maxKeys {
+		// Too many keys for the command, fall back to the unkeyed breaker.
+		key = ""
+		if cb, ok := m.values[cbKey{name, key}]; ok {
+			return cb
+		}
+	}
+	cb := newBreaker(key)
+	m.values[cbKey{name, key}] = cb
+	if key != "" {
+		m.numKeys[name] += 1
+	}
+	return cb
+}
+
+// keys returns the sorted keys of the keyed circuit breakers of the command.
+func (m *cbMap) keys(name string) []string {
+	m.lock.RLock()
+	keys := make([]string, 0, m.numKeys[name])
+	for k := range m.values {
+		if k.name == name && k.key != "" {
+			keys = append(keys, k.key)
+		}
+	}
+	m.lock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// remove removes and stops all circuit breakers of the command with the given
+// name.
+func (m *cbMap) remove(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for k, cb := range m.values {
+		if k.name == name {
+			cb.Stop()
+			delete(m.values, k)
+		}
+	}
+	delete(m.numKeys, name)
 }
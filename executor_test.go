@@ -2,6 +2,7 @@ package cuirass_test
 
 import (
 	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -209,6 +210,226 @@ func TestExecFailuresTripCircuitBreaker(t *testing.T) {
 		request.Events())
 }
 
+func TestExecCircuitBreakerOpensOnCommandLatency(t *testing.T) {
+	ctx := context.Background()
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.SlowCommand.circuitbreaker.requestVolumeThreshold", "2")
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	cmd := cuirass.NewCommand("SlowCommand", func(ctx context.Context) (interface{}, error) {
+		// Metrics use the real time and the circuit breaker the clock.
+		time.Sleep(5 * time.Millisecond)
+		clock.Add(5 * time.Millisecond)
+		return "ok", nil
+	}).Build()
+	for i := 0; i < 3; i++ {
+		_, err := ex.Exec(ctx, cmd)
+		assert.Nil(t, err)
+	}
+	assert.False(t, ex.IsCircuitBreakerOpen("SlowCommand"), "Latency threshold is not set")
+
+	// Latencies recorded before the threshold was set are used.
+	cfg.SetProperty("cuirass.command.SlowCommand.circuitbreaker.latencyThresholdInMilliseconds", "2")
+	_, err := ex.Exec(ctx, cmd)
+	assert.Nil(t, err)
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+	assert.True(t, ex.IsCircuitBreakerOpen("SlowCommand"))
+}
+
+func NewKeyedCommand(s, key string) *cuirass.Command {
+	return cuirass.NewCommand("KeyedCommand", func(ctx context.Context) (interface{}, error) {
+		if s == "error" {
+			return nil, errors.New("foo")
+		}
+		return s, nil
+	}).BreakerKey(key).Build()
+}
+
+func TestExecKeyedCircuitBreakersAreIndependent(t *testing.T) {
+	ctx := context.Background()
+	cfg := vaquita.NewEmptyMapConfig()
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	for i := 0; i < 20; i++ {
+		ex.Exec(ctx, NewKeyedCommand("error", "host1"))
+	}
+	ex.Exec(ctx, NewKeyedCommand("foo", "host2"))
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+
+	_, err := ex.Exec(ctx, NewKeyedCommand("foo", "host1"))
+	assert.Equal(t, circuitbreaker.CircuitOpenError, err)
+	assert.True(t, ex.IsCircuitBreakerOpenForKey("KeyedCommand", "host1"))
+
+	r, err := ex.Exec(ctx, NewKeyedCommand("foo", "host2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", r)
+	assert.False(t, ex.IsCircuitBreakerOpenForKey("KeyedCommand", "host2"))
+
+	// Metrics of all keys are aggregated under the command name.
+	m := ex.Metrics().ForCommand("KeyedCommand")
+	assert.Equal(t, 23, m.TotalRequests())
+}
+
+func TestExecKeyedCircuitBreakersMaxKeys(t *testing.T) {
+	ctx := context.Background()
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.KeyedCommand.circuitbreaker.maxKeys", "1")
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	ex.Exec(ctx, NewKeyedCommand("foo", "host1"))
+	// Keys over the limit share the unkeyed circuit breaker.
+	for i := 0; i < 20; i++ {
+		ex.Exec(ctx, NewKeyedCommand("error", "host2"))
+	}
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+
+	_, err := ex.Exec(ctx, NewKeyedCommand("foo", "host3"))
+	assert.Equal(t, circuitbreaker.CircuitOpenError, err)
+	assert.True(t, ex.IsCircuitBreakerOpen("KeyedCommand"))
+	assert.False(t, ex.IsCircuitBreakerOpenForKey("KeyedCommand", "host1"))
+}
+
+func TestExecCircuitBreakerStateShared(t *testing.T) {
+	ctx := context.Background()
+	store := circuitbreaker.NewMemoryStateStore()
+	clock := util.NewTestableClock(time.Now())
+	ex1 := cuirass.NewExecutorWithClock(vaquita.NewEmptyMapConfig(), clock)
+	ex1.SetStateStore(store, "ex1")
+	ex2 := cuirass.NewExecutorWithClock(vaquita.NewEmptyMapConfig(), clock)
+	ex2.SetStateStore(store, "ex2")
+
+	for i := 0; i < 20; i++ {
+		ex1.Exec(ctx, NewFooCommand("error", "none"))
+	}
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+	assert.True(t, ex1.IsCircuitBreakerOpen("FooCommand"))
+
+	// The second executor never failed but it learns about the open circuit
+	// from the store. The states are synchronized in the background.
+	assert.Eventually(t, func() bool {
+		clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+		ex1.IsCircuitBreakerOpen("FooCommand")
+		_, err := ex2.Exec(ctx, NewFooCommand("foo", "none"))
+		return err == circuitbreaker.CircuitOpenError
+	}, time.Second, 10*time.Millisecond)
+}
+
+func NewGroupCommand(name, s string) *cuirass.Command {
+	return cuirass.NewCommand(name, func(ctx context.Context) (interface{}, error) {
+		if s == "error" {
+			return nil, errors.New("foo")
+		}
+		return s, nil
+	}).Group("Backend").Build()
+}
+
+func TestExecGroupCircuitBreaker(t *testing.T) {
+	ctx := requestlog.WithRequestLog(context.Background())
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.group.Backend.circuitbreaker.enabled", "true")
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	// Neither of the commands has enough requests to trip its own breaker.
+	for i := 0; i < 10; i++ {
+		ex.Exec(ctx, NewGroupCommand("Cmd1", "error"))
+		ex.Exec(ctx, NewGroupCommand("Cmd2", "error"))
+	}
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+
+	_, err := ex.Exec(ctx, NewGroupCommand("Cmd3", "foo"))
+	assert.Equal(t, cuirass.GroupCircuitOpenError, err)
+	assert.True(t, ex.IsGroupCircuitBreakerOpen("Backend"))
+	assert.False(t, ex.IsCircuitBreakerOpen("Cmd1"))
+
+	request := requestlog.FromContext(ctx).LastRequest()
+	assert.Equal(t, "Cmd3", request.CommandName())
+	assert.Equal(t,
+		[]requestlog.ExecutionEvent{requestlog.GroupShortCircuited},
+		request.Events())
+}
+
+func TestExecGroupCircuitBreakerIgnoresRejectedCommands(t *testing.T) {
+	ctx := context.Background()
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.group.Backend.circuitbreaker.enabled", "true")
+	cfg.SetProperty("cuirass.command.default.execution.isolation.semaphore.maxConcurrentRequests", "0")
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	for i := 0; i < 20; i++ {
+		_, err := ex.Exec(ctx, NewGroupCommand("Cmd1", "foo"))
+		assert.Equal(t, cuirass.SemaphoreRejected, err)
+	}
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+
+	// Rejections by the semaphore and the command circuit breaker are not
+	// failures of the group.
+	assert.True(t, ex.IsCircuitBreakerOpen("Cmd1"))
+	assert.False(t, ex.IsGroupCircuitBreakerOpen("Backend"))
+}
+
+func TestExecGroupCircuitBreakerDisabledByDefault(t *testing.T) {
+	ctx := context.Background()
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(vaquita.NewEmptyMapConfig(), clock)
+	for i := 0; i < 10; i++ {
+		ex.Exec(ctx, NewGroupCommand("Cmd1", "error"))
+		ex.Exec(ctx, NewGroupCommand("Cmd2", "error"))
+	}
+	clock.Add(metrics.HealthSnapshotIntervalDefault + 1)
+
+	r, err := ex.Exec(ctx, NewGroupCommand("Cmd3", "foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", r)
+	assert.False(t, ex.IsGroupCircuitBreakerOpen("Backend"))
+}
+
+func TestExecProbeClosesCircuit(t *testing.T) {
+	ctx := requestlog.WithRequestLog(context.Background())
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.healthSnapshot.intervalInMilliseconds", "0")
+	cfg.SetProperty("cuirass.command.ProbedCommand.circuitbreaker.requestVolumeThreshold", "1")
+	cfg.SetProperty("cuirass.command.ProbedCommand.circuitbreaker.sleepWindowInMilliseconds", "5")
+	ex := cuirass.NewExecutor(cfg)
+	var healthy int32
+	cmd := cuirass.NewCommand("ProbedCommand", func(ctx context.Context) (interface{}, error) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return nil, errors.New("foo")
+		}
+		return "foo", nil
+	}).Fallback(func(ctx context.Context) (interface{}, error) {
+		return "fallback", nil
+	}).Probe(func(ctx context.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}).Build()
+
+	for i := 0; i < 3; i++ {
+		ex.Exec(ctx, cmd)
+	}
+	time.Sleep(time.Millisecond)
+	assert.True(t, ex.IsCircuitBreakerOpen("ProbedCommand"))
+	time.Sleep(10 * time.Millisecond)
+	r, err := ex.Exec(ctx, cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, "fallback", r)
+	assert.Equal(t,
+		[]requestlog.ExecutionEvent{requestlog.ShortCircuited, requestlog.FallbackSuccess},
+		requestlog.FromContext(ctx).LastRequest().Events())
+
+	// The first request after a successful probe is a trial that closes the
+	// circuit.
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 100 && ex.IsCircuitBreakerOpen("ProbedCommand"); i++ {
+		time.Sleep(time.Millisecond)
+		r, err = ex.Exec(ctx, cmd)
+	}
+	assert.False(t, ex.IsCircuitBreakerOpen("ProbedCommand"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", r)
+}
+
 func TestExecRequestLogging(t *testing.T) {
 	ctx := requestlog.WithRequestLog(context.Background())
 	cmd := NewFooCommand("foo", "")
@@ -300,6 +521,43 @@ func TestExecSemaphoreRejected(t *testing.T) {
 	assert.Equal(t, "foo", r)
 }
 
+func TestExecConcurrentExecutionCount(t *testing.T) {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+
+	c1 := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		ex.Exec(context.Background(), NewTimeoutCommand(c1, "FooCommand"))
+		close(done)
+	}()
+	time.Sleep(time.Millisecond)
+
+	m := ex.Metrics().ForCommand("TimeoutCommand")
+	assert.Equal(t, 1, m.CurrentConcurrentExecutionCount())
+	assert.Equal(t, 1, ex.Metrics().ForGroup("FooCommand").CurrentConcurrentExecutionCount())
+
+	c1 <- time.Now()
+	<-done
+	assert.Equal(t, 0, m.CurrentConcurrentExecutionCount())
+	assert.Equal(t, 1, m.RollingMaxConcurrentExecutionCount())
+}
+
+func TestExecExecuteAndTotalLatency(t *testing.T) {
+	ex := newTestingExecutor(nil)
+	cmd := cuirass.NewCommand("SlowFallback", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("foo")
+	}).Fallback(func(ctx context.Context) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return "fallback", nil
+	}).Build()
+	ex.Exec(context.Background(), cmd)
+
+	m := ex.Metrics().ForCommand("SlowFallback")
+	assert.True(t, m.ExecutionTimeMean() < 20*time.Millisecond)
+	assert.True(t, m.TotalExecutionTimeMean() >= 20*time.Millisecond)
+	assert.True(t, m.PermitWaitTimeMean() < m.TotalExecutionTimeMean())
+}
+
 func NewCachableCommand(s, f, key string) *cuirass.Command {
 	return cuirass.NewCommand("Cachable", func(ctx context.Context) (interface{}, error) {
 		if s == "error" {
@@ -488,3 +746,132 @@ func BenchmarkExecutorCommandExecution(b *testing.B) {
 		ex.Exec(ctx, cmd)
 	}
 }
+
+// Parallel executions share the circuit breaker, semaphore and metrics of one
+// command.
+func BenchmarkExecutorParallelCommandExecution(b *testing.B) {
+	ctx := context.Background()
+	cmd := NewFooCommand("foo", "")
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.default.execution.isolation.semaphore.maxConcurrentRequests", "1000")
+	ex := cuirass.NewExecutor(cfg)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ex.Exec(ctx, cmd)
+		}
+	})
+}
+
+func TestCommandPropertiesDoesNotCacheProperties(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	ex := newTestingExecutor(cfg)
+	p1 := ex.CommandProperties("FooCommand", "FooCommand")
+	p2 := ex.CommandProperties("FooCommand", "FooCommand")
+	assert.False(t, p1 == p2, "Properties of commands that were not executed are not cached")
+
+	ex.Exec(context.Background(), NewFooCommand("foo", ""))
+	assert.True(t, ex.CommandProperties("FooCommand", "FooCommand") == cuirass.GetProperties(cfg, "FooCommand", "FooCommand"))
+}
+
+func TestExecCommandsOverLimitShareOverflowState(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.maxCommands", "1")
+	ex := newTestingExecutor(cfg)
+	ctx := context.Background()
+
+	r, err := ex.Exec(ctx, NewFooCommand("foo", ""))
+	assert.Equal(t, "foo", r)
+	assert.Nil(t, err)
+	r, err = ex.Exec(ctx, cuirass.NewCommand("BarCommand", func(ctx context.Context) (interface{}, error) {
+		return "bar", nil
+	}).Build())
+	assert.Equal(t, "bar", r)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(1), ex.Metrics().DroppedExecutionCount())
+	assert.Equal(t, int64(1), ex.Metrics().DroppedCommandCount())
+	m := ex.Metrics().ForCommand(metrics.OverflowCommandName)
+	assert.Equal(t, 1, m.RollingSum(requestlog.Success))
+	assert.Equal(t, 1, ex.Metrics().ForCommand("FooCommand").RollingSum(requestlog.Success))
+	_, ok := ex.Semaphore(metrics.OverflowCommandName)
+	assert.True(t, ok)
+	_, ok = ex.Semaphore("BarCommand")
+	assert.False(t, ok)
+}
+
+func TestExecDroppedCommandHasNoMetrics(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.maxCommands", "1")
+	cfg.SetProperty("metrics.commandIdleTimeoutInMilliseconds", "60000")
+	clock := util.NewTestableClock(time.Now())
+	ex := cuirass.NewExecutorWithClock(cfg, clock)
+	ctx := context.Background()
+
+	ex.Exec(ctx, NewFooCommand("foo", ""))
+	ex.Exec(ctx, cuirass.NewCommand("BarCommand", func(ctx context.Context) (interface{}, error) {
+		// The slot of the idle command is freed while the dropped command runs.
+		clock.Add(2 * time.Minute)
+		ex.Metrics().EvictIdle()
+		return nil, errors.New("bar")
+	}).Build())
+
+	names := make([]string, 0)
+	for _, m := range ex.Metrics().All() {
+		names = append(names, m.CommandName())
+	}
+	assert.Equal(t, []string{metrics.OverflowCommandName}, names)
+	m := ex.Metrics().ForCommand(metrics.OverflowCommandName)
+	assert.Equal(t, 1, m.RollingSum(requestlog.Failure))
+}
+
+func TestExecClassifiesFailures(t *testing.T) {
+	ex := newTestingExecutor(nil)
+	ex.SetErrorClassifier(func(err error) string {
+		return "executor"
+	})
+	ctx := requestlog.WithRequestLog(context.Background())
+	ex.Exec(ctx, NewFooCommand("error", ""))
+	ex.Exec(ctx, cuirass.NewCommand("BarCommand", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("bar")
+	}).ErrorClassifier(func(err error) string {
+		return ""
+	}).Build())
+
+	assert.Equal(t, 1, ex.Metrics().ForCommand("FooCommand").RollingErrorCount("executor"))
+	assert.Equal(t, 1, ex.Metrics().ForCommand("BarCommand").RollingErrorCount(metrics.OtherErrorLabel))
+	assert.Equal(t, metrics.OtherErrorLabel, requestlog.FromContext(ctx).LastRequest().ErrorLabel())
+}
+
+func TestExecRecordsCacheMetrics(t *testing.T) {
+	ctx := requestcache.WithRequestCache(context.Background())
+	ex := newTestingExecutor(nil)
+
+	ex.Exec(ctx, NewCachableCommand("foo", "", "a"))
+	ex.Exec(ctx, NewCachableCommand("foo", "", "a"))
+	ex.Exec(ctx, NewCachableCommand("foo", "", "a"))
+	ex.Exec(ctx, NewCachableCommand("foo", "", "b"))
+
+	m := ex.Metrics().ForCommand("Cachable")
+	assert.Equal(t, 4, m.CacheLookups())
+	assert.Equal(t, 2, m.RollingCacheSum(metrics.CacheHit))
+	assert.Equal(t, 2, m.RollingCacheSum(metrics.CacheMiss))
+	assert.Equal(t, 2, m.RollingCacheSum(metrics.CacheStore))
+	assert.Equal(t, int64(2), m.CumulativeCacheSum(metrics.CacheStore))
+	assert.Equal(t, 0.5, m.CacheHitRatio())
+	assert.Equal(t, requestcache.Stats{Lookups: 4, Hits: 2, Misses: 2, Entries: 2},
+		requestcache.FromContext(ctx).Stats("Cachable"))
+
+	s := ex.Metrics().Snapshot()[0]
+	assert.Equal(t, metrics.CacheSnapshot{Lookups: 4, Hits: 2, Misses: 2, Stores: 2, HitRatio: 0.5}, s.Cache)
+}
+
+func TestExecMetricsKeepCommandGroup(t *testing.T) {
+	ex := newTestingExecutor(nil)
+	ex.Exec(context.Background(), cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Group("Group").Build())
+
+	m := ex.Metrics().ForCommand("Cmd")
+	assert.Equal(t, "Group", m.CommandGroup())
+	assert.Equal(t, "Group", ex.Metrics().Snapshot()[0].Group)
+}
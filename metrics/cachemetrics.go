@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/util"
+)
+
+// CacheEvent is an event of the request cache of a command.
+type CacheEvent byte
+
+const (
+	// CacheHit event happens when a response of the command is found in the
+	// request cache.
+	CacheHit CacheEvent = iota
+	// CacheMiss event happens when a response of the command is not found in
+	// the request cache.
+	CacheMiss
+	// CacheStore event happens when a new response of the command is stored
+	// in the request cache.
+	CacheStore
+)
+
+// CacheEvents holds all the cache events in the order of their definition.
+var CacheEvents = []CacheEvent{CacheHit, CacheMiss, CacheStore}
+
+func (e CacheEvent) String() string {
+	switch e {
+	case CacheHit:
+		return "hit"
+	case CacheMiss:
+		return "miss"
+	case CacheStore:
+		return "store"
+	default:
+		return "unknown"
+	}
+}
+
+// cacheCounters count the cache events of a command.
+type cacheCounters struct {
+	rolling    []*num.RollingNumber
+	cumulative []num.Adder
+}
+
+func newCacheCounters(clock util.Clock) *cacheCounters {
+	c := &cacheCounters{
+		rolling:    make([]*num.RollingNumber, len(CacheEvents)),
+		cumulative: make([]num.Adder, len(CacheEvents)),
+	}
+	for i := range c.rolling {
+		c.rolling[i] = num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock)
+	}
+	return c
+}
+
+func (c *cacheCounters) setWindow(windowSize time.Duration, windowBuckets int) {
+	for _, n := range c.rolling {
+		n.SetWindow(windowSize, windowBuckets)
+	}
+}
+
+// RollingCacheSum returns the number of cache events in the statistical window.
+func (m *CommandMetrics) RollingCacheSum(e CacheEvent) int {
+	return int(m.cacheCounters.rolling[e].Sum())
+}
+
+// CumulativeCacheSum returns the number of cache events since the metrics were
+// created.
+func (m *CommandMetrics) CumulativeCacheSum(e CacheEvent) int64 {
+	return m.cacheCounters.cumulative[e].Sum()
+}
+
+// CacheLookups returns the number of request cache lookups in the statistical
+// window.
+func (m *CommandMetrics) CacheLookups() int {
+	return m.RollingCacheSum(CacheHit) + m.RollingCacheSum(CacheMiss)
+}
+
+// CacheHitRatio returns the fraction of request cache lookups in the statistical
+// window that were hits. It is zero if there were no lookups.
+func (m *CommandMetrics) CacheHitRatio() float64 {
+	hits, misses := m.RollingCacheSum(CacheHit), m.RollingCacheSum(CacheMiss)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// UpdateCache records a request cache event of the command.
+func (m *ExecutionMetrics) UpdateCache(name string, e CacheEvent) {
+	metrics := m.fetchMetrics(name)
+	metrics.touch()
+	metrics.cacheCounters.rolling[e].Increment()
+	metrics.cacheCounters.cumulative[e].Increment()
+}
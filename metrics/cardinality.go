@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// OverflowCommandName is the name under which the executions of commands over
+// the limit of tracked commands are recorded.
+const OverflowCommandName = "cuirass.overflow"
+
+// EvictionListener is called for every command evicted because it was idle.
+type EvictionListener func(name, group string)
+
+// OnEvict sets a listener called for every evicted command. The listener is
+// used to discard the command state kept outside of the metrics.
+func (m *ExecutionMetrics) OnEvict(l EvictionListener) {
+	atomic.StorePointer(&m.onEvict, unsafe.Pointer(&l))
+}
+
+func (m *ExecutionMetrics) getEvictionListener() EvictionListener {
+	if l := (*EvictionListener)(atomic.LoadPointer(&m.onEvict)); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// Track marks the command as used and returns true if the command is tracked.
+// If the limit of tracked commands is reached the command is not tracked and
+// its executions must be recorded under the OverflowCommandName.
+func (m *ExecutionMetrics) Track(name string) bool {
+	m.maybeEvictIdle()
+	metrics := m.fetchMetrics(name)
+	for metrics != m.overflow && !metrics.touch() {
+		// The command was evicted concurrently, track it again.
+		metrics = m.fetchMetrics(name)
+	}
+	if metrics == m.overflow && name != OverflowCommandName {
+		m.dropped.Increment()
+		if _, ok := m.droppedNames.Load(name); !ok {
+			if _, loaded := m.droppedNames.LoadOrStore(name, struct{}{}); !loaded {
+				atomic.AddInt64(&m.droppedCommands, 1)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// DroppedExecutionCount returns the number of executions that were recorded
+// under the OverflowCommandName because the limit of tracked commands was
+// reached. Every execution is counted, not the distinct commands.
+func (m *ExecutionMetrics) DroppedExecutionCount() int64 {
+	return m.dropped.Sum()
+}
+
+// DroppedCommandCount returns the number of distinct commands whose executions
+// were recorded under the OverflowCommandName. A command is counted once even
+// if it is tracked later.
+func (m *ExecutionMetrics) DroppedCommandCount() int64 {
+	return atomic.LoadInt64(&m.droppedCommands)
+}
+
+// reserveCommand reserves a slot for another tracked command and returns
+// false if the limit of tracked commands was reached.
+func (m *ExecutionMetrics) reserveCommand() bool {
+	max := int64(0)
+	if m.props.MaxCommands != nil {
+		max = int64(m.props.MaxCommands.Get())
+	}
+	for {
+		n := atomic.LoadInt64(&m.commandCount)
+		if max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.commandCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (m *ExecutionMetrics) idleTimeout() time.Duration {
+	if m.props.CommandIdleTimeout == nil {
+		return 0
+	}
+	return m.props.CommandIdleTimeout.Get()
+}
+
+// maybeEvictIdle evicts the idle commands at most once per idle timeout.
+func (m *ExecutionMetrics) maybeEvictIdle() {
+	timeout := m.idleTimeout()
+	if timeout <= 0 {
+		return
+	}
+	now := m.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&m.lastEviction)
+	if now-last < int64(timeout) || !atomic.CompareAndSwapInt64(&m.lastEviction, last, now) {
+		return
+	}
+	m.EvictIdle()
+}
+
+// EvictIdle discards the metrics of commands that were not executed within the
+// idle timeout and have no executions in flight. Metrics of groups without
+// commands are discarded too. It returns the number of evicted commands.
+func (m *ExecutionMetrics) EvictIdle() int {
+	timeout := m.idleTimeout()
+	if timeout <= 0 {
+		return 0
+	}
+	deadline := m.clock.Now().Add(-timeout).UnixNano()
+	evicted := make([]*CommandMetrics, 0)
+	m.commandMetrics.Range(func(key, value interface{}) bool {
+		cm := value.(*CommandMetrics)
+		lastUsed := atomic.LoadInt64(&cm.lastUsed)
+		if lastUsed >= deadline || cm.CurrentConcurrentExecutionCount() != 0 {
+			return true
+		}
+		// Marking the command as evicted fails if it was used since lastUsed
+		// was read, so a command is never evicted right after it was tracked.
+		if !atomic.CompareAndSwapInt64(&cm.lastUsed, lastUsed, evictedTime) {
+			return true
+		}
+		if m.commandMetrics.CompareAndDelete(key, cm) {
+			atomic.AddInt64(&m.commandCount, -1)
+			evicted = append(evicted, cm)
+		}
+		return true
+	})
+	if len(evicted) == 0 {
+		return 0
+	}
+	groups := make(map[string]bool)
+	for _, cm := range m.All() {
+		groups[cm.CommandGroup()] = true
+	}
+	l := m.getEvictionListener()
+	publishers := m.getPublishers()
+	for _, cm := range evicted {
+		for _, p := range publishers {
+			if r, ok := p.(CommandRemover); ok {
+				r.RemoveCommand(cm.CommandName())
+			}
+		}
+		group := cm.CommandGroup()
+		if g, ok := m.groupMetrics.Load(group); ok && !groups[group] && g.(*GroupMetrics).CurrentConcurrentExecutionCount() == 0 {
+			m.groupMetrics.Delete(group)
+		}
+		if l != nil {
+			l(cm.CommandName(), group)
+		}
+	}
+	return len(evicted)
+}
+
+// evictedTime is the lastUsed time of evicted commands.
+const evictedTime = math.MinInt64
+
+// touch marks the command as used now. It returns false if the command was
+// evicted.
+func (m *CommandMetrics) touch() bool {
+	now := m.clock.Now().UnixNano()
+	for {
+		lastUsed := atomic.LoadInt64(&m.lastUsed)
+		if lastUsed == evictedTime {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.lastUsed, lastUsed, now) {
+			return true
+		}
+	}
+}
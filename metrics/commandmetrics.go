@@ -2,7 +2,9 @@ package metrics
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/arjantop/cuirass/num"
 	"github.com/arjantop/cuirass/requestlog"
@@ -13,11 +15,26 @@ import (
 const (
 	RollingPercentileBucketSizeDefault = 100
 	HealthSnapshotIntervalDefault      = 500 * time.Millisecond
+	PublisherFlushIntervalDefault      = 0
+	MaxCommandsDefault                 = 0
+	CommandIdleTimeoutDefault          = 0
 )
 
 type MetricsProperties struct {
+	// RollingPercentileBucketSize is no longer used, execution times are recorded
+	// in histograms with a bounded size.
 	RollingPercentileBucketSize vaquita.IntProperty
 	HealthSnapshotInterval      vaquita.DurationProperty
+	// PublisherFlushInterval is the interval at which the metrics of all commands
+	// are pushed to publishers. If zero, the metrics of a command are pushed in
+	// the background after every update.
+	PublisherFlushInterval vaquita.DurationProperty
+	// MaxCommands is the maximum number of tracked commands. Executions of other
+	// commands are tracked under the OverflowCommandName. Zero means unlimited.
+	MaxCommands vaquita.IntProperty
+	// CommandIdleTimeout is the time after which the state of a command that
+	// was not executed is discarded. Zero means the state is never discarded.
+	CommandIdleTimeout vaquita.DurationProperty
 }
 
 func NewMetricsProperties(cfg vaquita.DynamicConfig) *MetricsProperties {
@@ -25,85 +42,255 @@ func NewMetricsProperties(cfg vaquita.DynamicConfig) *MetricsProperties {
 	return &MetricsProperties{
 		RollingPercentileBucketSize: f.GetIntProperty("metrics.rollingPercentile.bucketSize", RollingPercentileBucketSizeDefault),
 		HealthSnapshotInterval:      f.GetDurationProperty("metrics.healthSnapshot.intervalInMilliseconds", HealthSnapshotIntervalDefault, time.Millisecond),
+		PublisherFlushInterval:      f.GetDurationProperty("metrics.publisher.flushIntervalInMilliseconds", PublisherFlushIntervalDefault, time.Millisecond),
+		MaxCommands:                 f.GetIntProperty("metrics.maxCommands", MaxCommandsDefault),
+		CommandIdleTimeout:          f.GetDurationProperty("metrics.commandIdleTimeoutInMilliseconds", CommandIdleTimeoutDefault, time.Millisecond),
 	}
 }
 
+// CommandMetricsProperties holds the metrics properties of a single command.
+type CommandMetricsProperties struct {
+	RollingStatisticalWindow        vaquita.DurationProperty
+	RollingStatisticalWindowBuckets vaquita.IntProperty
+	// SLOTarget is the percentage of requests that must succeed within the
+	// SLOLatencyObjective. Target outside of (0, 100) disables the SLO and zero
+	// latency objective disables its latency part.
+	SLOTarget           FloatProperty
+	SLOLatencyObjective vaquita.DurationProperty
+}
+
+// window returns the size and the number of buckets of the statistical window.
+// If no properties are set the default window is used.
+func (p *CommandMetricsProperties) window() (time.Duration, int) {
+	if p == nil {
+		return num.DefaultWindowSize, num.DefaultWindowBuckets
+	}
+	return p.RollingStatisticalWindow.Get(), p.RollingStatisticalWindowBuckets.Get()
+}
+
+// Latency holds the measured durations of a single command execution.
+type Latency struct {
+	// Execute is the duration of the Run function of the command.
+	Execute time.Duration
+	// Total is the end-to-end duration of the execution including the fallback
+	// and the request cache lookup.
+	Total time.Duration
+	// PermitWait is the time spent before the Run function was started checking
+	// the circuit breakers and acquiring the execution permit.
+	PermitWait time.Duration
+}
+
 type CommandMetrics struct {
-	name          string
-	eventCounters map[requestlog.ExecutionEvent]*num.RollingNumber
-	executionTime *num.RollingPercentile
+	name         string
+	registration unsafe.Pointer // *commandRegistration
+	// rolling holds the counts and execution times in the rolling statistical
+	// window and windows in the coarse statistical windows. Coarse windows are
+	// nil until they are first read or used by a burn rate alert.
+	rolling *WindowMetrics
+	windows []unsafe.Pointer // *WindowMetrics
+	// activeWindows holds the allocated coarse windows updated on executions.
+	activeWindows unsafe.Pointer // *[]*WindowMetrics
+	totalTime     *num.RollingHistogram
+	permitWait    *num.RollingHistogram
+	// Cumulative counters and execution times since the metrics were created.
+	cumulativeCounters      []num.Adder
+	cumulativeSlow          num.Adder
+	cumulativeExecutionTime *num.Histogram
+	// budget counts the requests in the error budget window of the SLO. It is
+	// nil until the command has an SLO.
+	budget unsafe.Pointer // *errorBudget
+	// firingAlerts has a bit set for every burn rate alert that is firing.
+	firingAlerts uint64
+	// lastUsed is the time of the last execution in nanoseconds.
+	lastUsed int64
+	// errorLabels counts the failures by the labels of their errors.
+	errorLabels   *errorLabels
+	cacheCounters *cacheCounters
+	// concurrent is the number of executions currently in flight and
+	// maxConcurrent tracks its maximum in the statistical window.
+	concurrent    int64
+	maxConcurrent *num.RollingNumber
 	clock         util.Clock
-	lock          *sync.RWMutex
+}
+
+// commandRegistration holds the group and the metrics properties of a command.
+type commandRegistration struct {
+	group string
+	props *CommandMetricsProperties
 }
 
 func newCommandMetrics(props *MetricsProperties, clock util.Clock, name string) *CommandMetrics {
-	return &CommandMetrics{
-		name:          name,
-		eventCounters: make(map[requestlog.ExecutionEvent]*num.RollingNumber),
-		executionTime: num.NewRollingPercentile(num.DefaultWindowSize, num.DefaultWindowBuckets, props.RollingPercentileBucketSize.Get(), clock),
-		clock:         clock,
-		lock:          new(sync.RWMutex),
+	m := &CommandMetrics{
+		name:                    name,
+		registration:            unsafe.Pointer(&commandRegistration{group: name}),
+		rolling:                 newWindowMetrics(num.DefaultWindowSize, num.DefaultWindowBuckets, clock),
+		windows:                 make([]unsafe.Pointer, len(Windows)),
+		totalTime:               num.NewRollingHistogram(num.DefaultWindowSize, num.DefaultWindowBuckets, num.DefaultSignificantDigits, clock),
+		permitWait:              num.NewRollingHistogram(num.DefaultWindowSize, num.DefaultWindowBuckets, num.DefaultSignificantDigits, clock),
+		cumulativeCounters:      make([]num.Adder, len(requestlog.ExecutionEvents)),
+		cumulativeExecutionTime: num.NewHistogram(num.DefaultSignificantDigits),
+		lastUsed:                clock.Now().UnixNano(),
+		errorLabels:             newErrorLabels(),
+		cacheCounters:           newCacheCounters(clock),
+		maxConcurrent:           num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock),
+		clock:                   clock,
 	}
+	return m
+}
+
+func (m *CommandMetrics) getRegistration() *commandRegistration {
+	return (*commandRegistration)(atomic.LoadPointer(&m.registration))
 }
 
-func newRollingNumber(clock util.Clock) *num.RollingNumber {
-	return num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock)
+// setProperties sets the command group and properties and resizes the statistical
+// windows if needed.
+func (m *CommandMetrics) setProperties(group string, props *CommandMetricsProperties) {
+	atomic.StorePointer(&m.registration, unsafe.Pointer(&commandRegistration{group, props}))
+	m.updateWindow()
+}
+
+// updateWindow rebuilds the rolling counters if the statistical window
+// properties changed. It is called when the metrics are read instead of on
+// every execution to keep the property lookups off the request path.
+func (m *CommandMetrics) updateWindow() {
+	windowSize, windowBuckets := m.getRegistration().props.window()
+	for _, c := range m.rolling.eventCounters {
+		c.SetWindow(windowSize, windowBuckets)
+	}
+	m.rolling.executionTime.SetWindow(windowSize, windowBuckets)
+	m.rolling.slowCounter.SetWindow(windowSize, windowBuckets)
+	m.totalTime.SetWindow(windowSize, windowBuckets)
+	m.permitWait.SetWindow(windowSize, windowBuckets)
+	m.maxConcurrent.SetWindow(windowSize, windowBuckets)
+	m.errorLabels.setWindow(windowSize, windowBuckets)
+	m.cacheCounters.setWindow(windowSize, windowBuckets)
 }
 
 func (m *CommandMetrics) CommandName() string {
-	m.lock.RLock()
-	n := m.name
-	m.lock.RUnlock()
-	return n
+	return m.name
+}
+
+// CommandGroup returns the group of the command. Group of the commands that
+// were not registered is the same as the command name.
+func (m *CommandMetrics) CommandGroup() string {
+	return m.getRegistration().group
+}
+
+// errorEvents are the events of requests that did not complete successfully.
+var errorEvents = []requestlog.ExecutionEvent{
+	requestlog.Failure,
+	requestlog.Timeout,
+	requestlog.ShortCircuited,
+	requestlog.GroupShortCircuited,
+	requestlog.SemaphoreRejected,
 }
 
 func (m *CommandMetrics) TotalRequests() int {
-	successCount := m.RollingSum(requestlog.Success)
-	failureCount := m.RollingSum(requestlog.Failure)
-	timeoutCount := m.RollingSum(requestlog.Timeout)
-	shortCircuitedCount := m.RollingSum(requestlog.ShortCircuited)
-	semaphoreRejected := m.RollingSum(requestlog.SemaphoreRejected)
-	return successCount + failureCount + shortCircuitedCount + timeoutCount + semaphoreRejected
+	return m.RollingSum(requestlog.Success) + m.ErrorCount()
 }
 
 func (m *CommandMetrics) ErrorCount() int {
-	failureCount := m.RollingSum(requestlog.Failure)
-	timeoutCount := m.RollingSum(requestlog.Timeout)
-	shortCircuitedCount := m.RollingSum(requestlog.ShortCircuited)
-	semaphoreRejected := m.RollingSum(requestlog.SemaphoreRejected)
-	return failureCount + shortCircuitedCount + timeoutCount + semaphoreRejected
+	return errorCount(m.RollingSum)
 }
 
 func (m *CommandMetrics) ErrorPercentage() int {
-	total := m.TotalRequests()
+	errors := m.ErrorCount()
+	return errorPercentage(m.RollingSum(requestlog.Success)+errors, errors)
+}
+
+// errorCount returns the number of errors from the event counts.
+func errorCount(count func(requestlog.ExecutionEvent) int) int {
+	errors := 0
+	for _, e := range errorEvents {
+		errors += count(e)
+	}
+	return errors
+}
+
+func errorPercentage(total, errors int) int {
 	if total == 0 {
 		return 0
 	}
-	return int(float64(m.ErrorCount()) / float64(total) * 100)
+	return int(float64(errors) / float64(total) * 100)
 }
 
-func (m *CommandMetrics) update(executionTime time.Duration, evs ...requestlog.ExecutionEvent) {
-	m.lock.Lock()
+func (m *CommandMetrics) update(latency Latency, evs ...requestlog.ExecutionEvent) {
+	m.touch()
+	m.totalTime.Add(latencyValue(latency.Total))
+	slo, ok := m.SLO()
+	var budget *errorBudget
+	if ok {
+		budget = m.errorBudget()
+	}
+	windows := m.getActiveWindows()
+	if ok && slo.LatencyObjective > 0 &&
+		latency.Total > slo.LatencyObjective && hasEvent(evs, requestlog.Success) &&
+		!hasEvent(evs, requestlog.ResponseFromCache) {
+		m.rolling.slowCounter.Increment()
+		for _, w := range windows {
+			w.slowCounter.Increment()
+		}
+		m.cumulativeSlow.Increment()
+		budget.bad.Increment()
+	}
 	if hasEvent(evs, requestlog.ResponseFromCache) {
-		m.findEventCounter(requestlog.ResponseFromCache).Increment()
+		m.increment(requestlog.ResponseFromCache, windows, budget)
 	} else {
 		for _, e := range evs {
-			m.findEventCounter(e).Increment()
+			m.increment(e, windows, budget)
 		}
-		if !hasEvent(evs, requestlog.ShortCircuited) && !hasEvent(evs, requestlog.SemaphoreRejected) {
-			m.executionTime.Add(int(executionTime))
+		if !hasEvent(evs, requestlog.ShortCircuited) &&
+			!hasEvent(evs, requestlog.GroupShortCircuited) &&
+			!hasEvent(evs, requestlog.SemaphoreRejected) {
+			m.rolling.executionTime.Add(latencyValue(latency.Execute))
+			for _, w := range windows {
+				w.executionTime.Add(latencyValue(latency.Execute))
+			}
+			m.cumulativeExecutionTime.Add(latencyValue(latency.Execute))
+			m.permitWait.Add(latencyValue(latency.PermitWait))
 		}
 	}
-	m.lock.Unlock()
 }
 
-func (m *CommandMetrics) findEventCounter(e requestlog.ExecutionEvent) *num.RollingNumber {
-	c, ok := m.eventCounters[e]
-	if !ok {
-		c = newRollingNumber(m.clock)
-		m.eventCounters[e] = c
+func (m *CommandMetrics) executionStarted() {
+	m.maxConcurrent.UpdateMax(atomic.AddInt64(&m.concurrent, 1))
+}
+
+func (m *CommandMetrics) executionFinished() {
+	atomic.AddInt64(&m.concurrent, -1)
+}
+
+// CurrentConcurrentExecutionCount returns the number of executions of the
+// command currently in flight.
+func (m *CommandMetrics) CurrentConcurrentExecutionCount() int {
+	return int(atomic.LoadInt64(&m.concurrent))
+}
+
+// RollingMaxConcurrentExecutionCount returns the maximum number of concurrent
+// executions of the command in the statistical window.
+func (m *CommandMetrics) RollingMaxConcurrentExecutionCount() int {
+	return int(m.maxConcurrent.Max())
+}
+
+// increment counts the event in the rolling window, the given coarse windows
+// and the error budget if it is not nil.
+func (m *CommandMetrics) increment(e requestlog.ExecutionEvent, windows []*WindowMetrics, budget *errorBudget) {
+	if int(e) < len(m.cumulativeCounters) {
+		m.rolling.increment(e)
+		for _, w := range windows {
+			w.increment(e)
+		}
+		m.cumulativeCounters[e].Increment()
+		if budget == nil {
+			return
+		}
+		if e == requestlog.Success {
+			budget.requests.Increment()
+		} else if hasEvent(errorEvents, e) {
+			budget.requests.Increment()
+			budget.bad.Increment()
+		}
 	}
-	return c
 }
 
 func hasEvent(events []requestlog.ExecutionEvent, e requestlog.ExecutionEvent) bool {
@@ -116,35 +303,149 @@ func hasEvent(events []requestlog.ExecutionEvent, e requestlog.ExecutionEvent) b
 }
 
 func (m *CommandMetrics) RollingSum(e requestlog.ExecutionEvent) int {
-	m.lock.Lock()
-	if c, ok := m.eventCounters[e]; ok {
-		m.lock.Unlock()
-		return int(c.Sum())
+	return m.rolling.RollingSum(e)
+}
+
+// CumulativeSum returns the number of events since the metrics were created.
+// Unlike RollingSum the value never decreases.
+func (m *CommandMetrics) CumulativeSum(e requestlog.ExecutionEvent) int64 {
+	if int(e) < len(m.cumulativeCounters) {
+		return m.cumulativeCounters[e].Sum()
 	}
-	m.lock.Unlock()
 	return 0
 }
 
+// CumulativeExecutionTimeCount returns the number of execution times recorded
+// since the metrics were created.
+func (m *CommandMetrics) CumulativeExecutionTimeCount() int64 {
+	return m.cumulativeExecutionTime.Count()
+}
+
+// CumulativeExecutionTimeSum returns the sum of execution times recorded since
+// the metrics were created.
+func (m *CommandMetrics) CumulativeExecutionTimeSum() time.Duration {
+	return time.Duration(m.cumulativeExecutionTime.Sum()) * latencyUnit
+}
+
+// CumulativeExecutionTimeMean returns the mean of execution times recorded since
+// the metrics were created.
+func (m *CommandMetrics) CumulativeExecutionTimeMean() time.Duration {
+	return toDuration(m.cumulativeExecutionTime.Mean())
+}
+
+// CumulativeExecutionTimePercentiles returns the execution times at the given
+// percentiles of all execution times recorded since the metrics were created.
+func (m *CommandMetrics) CumulativeExecutionTimePercentiles(ps ...float64) []time.Duration {
+	return toDurations(m.cumulativeExecutionTime.Percentiles(ps...))
+}
+
 func (m *CommandMetrics) ExecutionTimeMean() time.Duration {
-	return time.Duration(m.executionTime.Mean())
+	return m.rolling.ExecutionTimeMean()
 }
 
 func (m *CommandMetrics) ExecutionTimePercentile(p float64) time.Duration {
-	return time.Duration(m.executionTime.Get(p))
+	return toDuration(m.rolling.executionTime.Get(p))
+}
+
+// ExecutionTimePercentiles returns the execution times at the given percentiles.
+// It is cheaper than getting the percentiles one by one.
+func (m *CommandMetrics) ExecutionTimePercentiles(ps ...float64) []time.Duration {
+	return m.rolling.ExecutionTimePercentiles(ps...)
+}
+
+// TotalExecutionTimeMean returns the mean of end-to-end execution times
+// including fallbacks and responses from cache.
+func (m *CommandMetrics) TotalExecutionTimeMean() time.Duration {
+	return toDuration(m.totalTime.Mean())
+}
+
+// TotalExecutionTimePercentiles returns the end-to-end execution times at the
+// given percentiles.
+func (m *CommandMetrics) TotalExecutionTimePercentiles(ps ...float64) []time.Duration {
+	return toDurations(m.totalTime.Percentiles(ps...))
+}
+
+// PermitWaitTimeMean returns the mean of times spent waiting before the
+// execution of the Run function.
+func (m *CommandMetrics) PermitWaitTimeMean() time.Duration {
+	return toDuration(m.permitWait.Mean())
+}
+
+// PermitWaitTimePercentiles returns the times spent waiting before the
+// execution of the Run function at the given percentiles.
+func (m *CommandMetrics) PermitWaitTimePercentiles(ps ...float64) []time.Duration {
+	return toDurations(m.permitWait.Percentiles(ps...))
+}
+
+// latencyUnit is the unit of the latencies recorded in the histograms. Recording
+// microseconds instead of nanoseconds keeps the number of allocated histogram
+// buckets small while being precise enough for command latencies.
+const latencyUnit = time.Microsecond
+
+func latencyValue(d time.Duration) int {
+	return int(d / latencyUnit)
+}
+
+func toDuration(v int) time.Duration {
+	return time.Duration(v) * latencyUnit
+}
+
+func toDurations(values []int) []time.Duration {
+	ds := make([]time.Duration, len(values))
+	for i, v := range values {
+		ds[i] = toDuration(v)
+	}
+	return ds
 }
 
 type ExecutionMetrics struct {
-	clock          util.Clock
-	props          *MetricsProperties
-	commandMetrics map[string]*CommandMetrics
-	lock           *sync.RWMutex
+	clock util.Clock
+	props *MetricsProperties
+	// commandMetrics maps the command names to their metrics. Commands are
+	// added rarely so a sync.Map keeps the lookups on the hot path lock-free.
+	commandMetrics *sync.Map
+	// groupMetrics maps the command groups to their metrics.
+	groupMetrics *sync.Map
+	publishers   unsafe.Pointer // *[]Publisher
+	state        CommandState
+	// burnRateListeners are notified of burn rate alerts and sloLock
+	// serializes their evaluation.
+	burnRateListeners unsafe.Pointer // *[]burnRateListener
+	lastListenerID    BurnRateListenerID
+	stopSLOEvaluation chan struct{}
+	sloLock           *sync.Mutex
+	// overflow holds the metrics of all commands over the limit of tracked
+	// commands, commandCount is the number of tracked commands and dropped
+	// the number of executions recorded in the overflow metrics.
+	// droppedNames holds the distinct names of the dropped commands and
+	// droppedCommands is their number.
+	overflow        *CommandMetrics
+	commandCount    int64
+	dropped         num.Adder
+	droppedNames    *sync.Map
+	droppedCommands int64
+	// lastEviction is the time of the last eviction of idle commands in
+	// nanoseconds and onEvict is called for every evicted command.
+	lastEviction int64
+	onEvict      unsafe.Pointer // *EvictionListener
+	// updates are the updates queued for publishing and waitingForUpdates is
+	// 1 while the flushing goroutine waits for them.
+	updates           chan publishRequest
+	waitingForUpdates uint32
+	stopFlush         chan struct{}
+	lock              *sync.RWMutex
 }
 
 func NewExecutionMetrics(props *MetricsProperties, clock util.Clock) *ExecutionMetrics {
 	return &ExecutionMetrics{
 		clock:          clock,
 		props:          props,
-		commandMetrics: make(map[string]*CommandMetrics),
+		commandMetrics: new(sync.Map),
+		groupMetrics:   new(sync.Map),
+		sloLock:        new(sync.Mutex),
+		overflow:       newCommandMetrics(props, clock, OverflowCommandName),
+		droppedNames:   new(sync.Map),
+		updates:        make(chan publishRequest, publishQueueSize),
 		lock:           new(sync.RWMutex),
 	}
 }
@@ -156,33 +457,85 @@ func (m *ExecutionMetrics) Properties() *MetricsProperties {
 	return p
 }
 
+// All returns the metrics of all tracked commands. The overflow metrics are
+// included once an execution was recorded in them.
 func (m *ExecutionMetrics) All() []*CommandMetrics {
-	m.lock.RLock()
-	c := make([]*CommandMetrics, 0, len(m.commandMetrics))
-	for _, m := range m.commandMetrics {
-		c = append(c, m)
+	c := make([]*CommandMetrics, 0)
+	m.commandMetrics.Range(func(key, value interface{}) bool {
+		cm := value.(*CommandMetrics)
+		cm.updateWindow()
+		c = append(c, cm)
+		return true
+	})
+	if m.DroppedExecutionCount() > 0 {
+		c = append(c, m.overflow)
 	}
-	m.lock.RUnlock()
 	return c
 }
 
 func (m *ExecutionMetrics) ForCommand(name string) *CommandMetrics {
-	return m.fetchMetrics(name)
+	cm := m.fetchMetrics(name)
+	cm.updateWindow()
+	return cm
 }
 
+// Register sets the group and the metrics properties for the command with the
+// given name. Commands that are not registered use the default statistical window.
+// Commands over the limit of tracked commands are not registered and the
+// overflow metrics are returned instead.
+func (m *ExecutionMetrics) Register(name, group string, props *CommandMetricsProperties) *CommandMetrics {
+	metrics := m.fetchMetrics(name)
+	if metrics != m.overflow {
+		metrics.setProperties(group, props)
+	}
+	return metrics
+}
+
+// Update records the events of a command execution that took executionTime.
+// The execution time is used as both the execute and the total latency.
 func (m *ExecutionMetrics) Update(name string, executionTime time.Duration, evs ...requestlog.ExecutionEvent) {
+	m.UpdateLatency(name, Latency{Execute: executionTime, Total: executionTime}, evs...)
+}
+
+// UpdateLatency records the events and the latencies of a command execution.
+func (m *ExecutionMetrics) UpdateLatency(name string, latency Latency, evs ...requestlog.ExecutionEvent) {
 	metrics := m.fetchMetrics(name)
-	metrics.update(executionTime, evs...)
+	metrics.update(latency, evs...)
+	m.publish(metrics)
 }
 
-func (m *ExecutionMetrics) fetchMetrics(name string) *CommandMetrics {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// ExecutionStarted marks the start of an execution of the command in the given
+// group. Every call must be followed by a call to ExecutionFinished.
+func (m *ExecutionMetrics) ExecutionStarted(name, group string) {
+	m.fetchMetrics(name).executionStarted()
+	m.fetchGroupMetrics(group).executionStarted()
+}
 
-	if m, ok := m.commandMetrics[name]; ok {
-		return m
+// ExecutionFinished marks the end of an execution of the command in the given
+// group.
+func (m *ExecutionMetrics) ExecutionFinished(name, group string) {
+	m.fetchMetrics(name).executionFinished()
+	m.fetchGroupMetrics(group).executionFinished()
+}
+
+func (m *ExecutionMetrics) fetchMetrics(name string) *CommandMetrics {
+	if metrics, ok := m.commandMetrics.Load(name); ok {
+		return metrics.(*CommandMetrics)
 	}
-	metrics := newCommandMetrics(m.props, m.clock, name)
-	m.commandMetrics[name] = metrics
-	return metrics
+	if name == OverflowCommandName {
+		return m.overflow
+	}
+	if !m.reserveCommand() {
+		// The command might have been added concurrently.
+		if metrics, ok := m.commandMetrics.Load(name); ok {
+			return metrics.(*CommandMetrics)
+		}
+		return m.overflow
+	}
+	metrics, loaded := m.commandMetrics.LoadOrStore(name, newCommandMetrics(m.props, m.clock, name))
+	if loaded {
+		// Another goroutine added the command and used its own slot.
+		atomic.AddInt64(&m.commandCount, -1)
+	}
+	return metrics.(*CommandMetrics)
 }
@@ -1,6 +1,8 @@
 package metrics_test
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ func newTestingExecutionMetrics() *metrics.ExecutionMetrics {
 	f := vaquita.NewPropertyFactory(cfg)
 	return metrics.NewExecutionMetrics(&metrics.MetricsProperties{
 		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		PublisherFlushInterval:      f.GetDurationProperty("flushInterval", 0, time.Millisecond),
 	}, util.NewClock())
 }
 
@@ -25,6 +28,11 @@ func TestCommandMetricsCommandName(t *testing.T) {
 	assert.Equal(t, "cmd", m.CommandName())
 }
 
+func TestCommandMetricsDefaultGroup(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	assert.Equal(t, "cmd", em.ForCommand("cmd").CommandGroup())
+}
+
 func TestCommandMetricsRequestCount(t *testing.T) {
 	em := newTestingExecutionMetrics()
 	m := em.ForCommand("cmd1")
@@ -134,3 +142,308 @@ func TestExecutionMetricsIgoreEventsWhenResponseFromCache(t *testing.T) {
 	assert.Equal(t, 0, m.RollingSum(requestlog.FallbackSuccess))
 	assert.Equal(t, 1, m.RollingSum(requestlog.ResponseFromCache))
 }
+
+func TestExecutionMetricsRegisterWindow(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	clock := util.NewTestableClock(time.Now())
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+	}, clock)
+	m := em.Register("command", "group", &metrics.CommandMetricsProperties{
+		RollingStatisticalWindow:        f.GetDurationProperty("window", time.Second, time.Millisecond),
+		RollingStatisticalWindowBuckets: f.GetIntProperty("buckets", 10),
+	})
+	assert.Equal(t, "group", m.CommandGroup())
+	em.Update("command", time.Millisecond, requestlog.Success)
+	clock.Add(time.Second)
+	assert.Equal(t, 0, m.RollingSum(requestlog.Success))
+
+	em.Update("command", time.Millisecond, requestlog.Success)
+	cfg.SetProperty("window", "60000")
+	em.Update("command", time.Millisecond, requestlog.Success)
+	assert.Equal(t, 2, m.RollingSum(requestlog.Success), "Window is not checked on updates")
+	em.All()
+	em.Update("command", time.Millisecond, requestlog.Success)
+	assert.Equal(t, 1, m.RollingSum(requestlog.Success), "Counters are rebuilt when the window changes")
+	clock.Add(time.Second)
+	assert.Equal(t, 1, m.RollingSum(requestlog.Success))
+}
+
+func TestCommandMetricsGroupShortCircuitedIsError(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	addEventAndAssertCount(t, em, "cmd", requestlog.GroupShortCircuited, 1, 1)
+	em.Update("cmd", 10, requestlog.GroupShortCircuited)
+	assert.Equal(t, 0, em.ForCommand("cmd").ExecutionTimePercentile(100))
+}
+
+func TestExecutionMetricsExecutionTimePercentiles(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	m := em.ForCommand("command")
+	for i := 1; i <= 100; i++ {
+		em.Update("command", time.Duration(i)*time.Millisecond, requestlog.Success)
+	}
+	ps := m.ExecutionTimePercentiles(0, 50, 100)
+	assert.Equal(t, time.Millisecond, ps[0])
+	assert.InEpsilon(t, float64(50*time.Millisecond), float64(ps[1]), 0.01)
+	assert.Equal(t, 100*time.Millisecond, ps[2])
+	assert.Equal(t, m.ExecutionTimePercentile(50), ps[1])
+}
+
+// All goroutines update the metrics of the same command.
+func BenchmarkExecutionMetricsUpdate(b *testing.B) {
+	em := newTestingExecutionMetrics()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			em.Update("command", time.Millisecond, requestlog.Success)
+		}
+	})
+}
+
+func TestCommandMetricsCumulativeSum(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	clock := util.NewTestableClock(time.Now())
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+	}, clock)
+	m := em.ForCommand("command")
+	em.Update("command", 10*time.Millisecond, requestlog.Success)
+	em.Update("command", 30*time.Millisecond, requestlog.Failure, requestlog.FallbackSuccess)
+	em.Update("command", 0, requestlog.Success, requestlog.ResponseFromCache)
+	clock.Add(time.Minute)
+
+	assert.Equal(t, 0, m.RollingSum(requestlog.Success))
+	assert.Equal(t, int64(1), m.CumulativeSum(requestlog.Success))
+	assert.Equal(t, int64(1), m.CumulativeSum(requestlog.Failure))
+	assert.Equal(t, int64(1), m.CumulativeSum(requestlog.FallbackSuccess))
+	assert.Equal(t, int64(1), m.CumulativeSum(requestlog.ResponseFromCache))
+	assert.Equal(t, int64(0), m.CumulativeSum(requestlog.Timeout))
+
+	assert.Equal(t, 0, m.ExecutionTimeMean())
+	assert.Equal(t, int64(2), m.CumulativeExecutionTimeCount())
+	assert.Equal(t, 40*time.Millisecond, m.CumulativeExecutionTimeSum())
+	assert.Equal(t, 20*time.Millisecond, m.CumulativeExecutionTimeMean())
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 30 * time.Millisecond},
+		m.CumulativeExecutionTimePercentiles(0, 100))
+}
+
+func TestExecutionMetricsConcurrentExecutionCount(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	em.ExecutionStarted("cmd1", "group")
+	em.ExecutionStarted("cmd1", "group")
+	em.ExecutionStarted("cmd2", "group")
+	em.ExecutionFinished("cmd1", "group")
+
+	m := em.ForCommand("cmd1")
+	assert.Equal(t, 1, m.CurrentConcurrentExecutionCount())
+	assert.Equal(t, 2, m.RollingMaxConcurrentExecutionCount())
+	assert.Equal(t, 1, em.ForCommand("cmd2").CurrentConcurrentExecutionCount())
+
+	groups := em.AllGroups()
+	if assert.Len(t, groups, 1) {
+		assert.Equal(t, "group", groups[0].GroupName())
+		assert.Equal(t, 2, groups[0].CurrentConcurrentExecutionCount())
+		assert.Equal(t, 3, groups[0].RollingMaxConcurrentExecutionCount())
+		assert.Equal(t, 10*time.Second, groups[0].RollingWindowSize())
+	}
+}
+
+func TestExecutionMetricsUpdateLatency(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	m := em.ForCommand("command")
+	em.UpdateLatency("command", metrics.Latency{
+		Execute:    5 * time.Millisecond,
+		Total:      20 * time.Millisecond,
+		PermitWait: time.Millisecond,
+	}, requestlog.Failure, requestlog.FallbackSuccess)
+	assert.Equal(t, 5*time.Millisecond, m.ExecutionTimeMean())
+	assert.Equal(t, 20*time.Millisecond, m.TotalExecutionTimeMean())
+	assert.Equal(t, []time.Duration{time.Millisecond}, m.PermitWaitTimePercentiles(100))
+
+	em.UpdateLatency("command", metrics.Latency{Total: 2 * time.Millisecond}, requestlog.ShortCircuited)
+	assert.Equal(t, 5*time.Millisecond, m.ExecutionTimePercentile(100))
+	assert.Equal(t, []time.Duration{2 * time.Millisecond, 20 * time.Millisecond}, m.TotalExecutionTimePercentiles(0, 100))
+	assert.Equal(t, time.Millisecond, m.PermitWaitTimeMean())
+}
+
+type testingCommandState struct{}
+
+func (s testingCommandState) IsCircuitBreakerOpen(name string) bool { return name == "cmd2" }
+
+func (s testingCommandState) CircuitBreakerKeys(name string) []string {
+	if name == "cmd2" {
+		return []string{"a", "b"}
+	}
+	return nil
+}
+
+func (s testingCommandState) IsCircuitBreakerOpenForKey(name, key string) bool { return key == "b" }
+
+func (s testingCommandState) IsGroupCircuitBreakerOpen(group string) bool { return false }
+
+func (s testingCommandState) CommandPropertyValues(name, group string) map[string]interface{} {
+	return map[string]interface{}{"name": name}
+}
+
+func TestExecutionMetricsSnapshot(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	em.SetCommandState(testingCommandState{})
+	em.Register("cmd2", "group", nil)
+	em.Update("cmd2", 10*time.Millisecond, requestlog.Success)
+	em.Update("cmd2", 30*time.Millisecond, requestlog.Timeout, requestlog.FallbackSuccess)
+	em.Update("cmd1", time.Millisecond, requestlog.Success)
+
+	snapshots := em.Snapshot()
+	if assert.Len(t, snapshots, 2) {
+		assert.Equal(t, "cmd1", snapshots[0].Name)
+		s := snapshots[1]
+		assert.Equal(t, "cmd2", s.Name)
+		assert.Equal(t, "group", s.Group)
+		assert.Equal(t, 2, s.RequestCount)
+		assert.Equal(t, 1, s.ErrorCount)
+		assert.Equal(t, 50, s.ErrorPercentage)
+		assert.Equal(t, 1, s.RollingCounts["TIMEOUT"])
+		assert.Equal(t, int64(1), s.CumulativeCounts["FALLBACK_SUCCESS"])
+		assert.Equal(t, 20*time.Millisecond, s.LatencyExecute.Mean)
+		assert.Equal(t, 30*time.Millisecond, s.LatencyTotal.Percentiles["100"])
+		assert.True(t, s.CircuitBreakerOpen)
+		assert.Equal(t, map[string]bool{"a": false, "b": true}, s.KeyCircuitBreakersOpen)
+		assert.Nil(t, snapshots[0].KeyCircuitBreakersOpen)
+		assert.Equal(t, "cmd2", s.Properties["name"])
+	}
+}
+
+func TestCommandMetricsWindows(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		PublisherFlushInterval: f.GetDurationProperty("flushInterval", 0, time.Millisecond),
+	}, clock)
+	m := em.ForCommand("cmd")
+	em.Update("cmd", 5*time.Millisecond, requestlog.Success)
+	assert.Len(t, m.Windows(), len(metrics.Windows))
+	em.Update("cmd", 10*time.Millisecond, requestlog.Success)
+	em.Update("cmd", 20*time.Millisecond, requestlog.Failure, requestlog.FallbackSuccess)
+	clock.Add(30 * time.Second)
+	em.Update("cmd", 30*time.Millisecond, requestlog.Success)
+
+	rolling, ok := m.Window(0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, rolling.TotalRequests())
+
+	w, ok := m.Window(time.Minute)
+	if assert.True(t, ok) {
+		assert.Equal(t, time.Minute, w.Size())
+		assert.Equal(t, 3, w.TotalRequests())
+		assert.Equal(t, 33, w.ErrorPercentage())
+		assert.Equal(t, 0.05, w.RequestRate())
+		assert.Equal(t, []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}, w.ExecutionTimePercentiles(0, 100))
+	}
+
+	clock.Add(65 * time.Second)
+	w, _ = m.Window(time.Minute)
+	assert.Equal(t, 0, w.TotalRequests())
+	w, _ = m.Window(5 * time.Minute)
+	assert.Equal(t, 3, w.TotalRequests(), "Executions before the windows were first read are not counted")
+
+	_, ok = m.Window(2 * time.Hour)
+	assert.False(t, ok)
+}
+
+func TestExecutionMetricsMaxCommands(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		MaxCommands:                 f.GetIntProperty("maxCommands", 2),
+	}, util.NewClock())
+	assert.True(t, em.Track("a"))
+	assert.True(t, em.Track("b"))
+	assert.False(t, em.Track("c"))
+	assert.True(t, em.Track("a"))
+	assert.False(t, em.Track("c"))
+	assert.False(t, em.Track("d"))
+	assert.Equal(t, int64(3), em.DroppedExecutionCount())
+	assert.Equal(t, int64(2), em.DroppedCommandCount())
+	assert.Len(t, em.All(), 3)
+
+	em.Update("c", time.Millisecond, requestlog.Success)
+	m := em.ForCommand(metrics.OverflowCommandName)
+	assert.Equal(t, metrics.OverflowCommandName, m.CommandName())
+	assert.Equal(t, 1, m.RollingSum(requestlog.Success))
+	assert.Equal(t, m, em.ForCommand("c"))
+	assert.Equal(t, m, em.Register("c", "group", nil))
+	assert.Equal(t, metrics.OverflowCommandName, m.CommandGroup())
+}
+
+func TestExecutionMetricsMaxCommandsConcurrent(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		MaxCommands:                 f.GetIntProperty("maxCommands", 2),
+	}, util.NewClock())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			em.Track(fmt.Sprintf("cmd%d", i%10))
+		}(i)
+	}
+	wg.Wait()
+	tracked := 0
+	for _, m := range em.All() {
+		if m.CommandName() != metrics.OverflowCommandName {
+			tracked++
+		}
+	}
+	assert.Equal(t, 2, tracked, "The limit is not exceeded by concurrent commands")
+}
+
+func TestExecutionMetricsEvictIdle(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	f := vaquita.NewPropertyFactory(cfg)
+	clock := util.NewTestableClock(time.Now())
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		MaxCommands:                 f.GetIntProperty("maxCommands", 1),
+		CommandIdleTimeout:          f.GetDurationProperty("idleTimeout", time.Minute, time.Millisecond),
+	}, clock)
+	evicted := make([]string, 0)
+	em.OnEvict(func(name, group string) {
+		evicted = append(evicted, name+"/"+group)
+	})
+	em.Register("a", "group", nil)
+	assert.True(t, em.Track("a"))
+	assert.False(t, em.Track("b"))
+	em.ExecutionStarted("a", "group")
+	clock.Add(2 * time.Minute)
+	assert.Equal(t, 0, em.EvictIdle())
+
+	em.ExecutionFinished("a", "group")
+	assert.True(t, em.Track("b"))
+	assert.Equal(t, []string{"a/group"}, evicted)
+	assert.Empty(t, em.AllGroups())
+	assert.False(t, em.Track("a"))
+}
+
+func TestCommandMetricsErrorLabels(t *testing.T) {
+	defer func(max int) { metrics.MaxErrorLabels = max }(metrics.MaxErrorLabels)
+	metrics.MaxErrorLabels = 2
+	em := newTestingExecutionMetrics()
+	m := em.ForCommand("command")
+	em.UpdateError("command", "refused")
+	em.UpdateError("command", "refused")
+	em.UpdateError("command", "5xx")
+	em.UpdateError("command", "decode")
+	em.UpdateError("command", "")
+
+	assert.Equal(t, []string{"5xx", metrics.OtherErrorLabel, "refused"}, m.ErrorLabels())
+	assert.Equal(t, 2, m.RollingErrorCount("refused"))
+	assert.Equal(t, 0, m.RollingErrorCount("decode"))
+	assert.Equal(t, map[string]int{"refused": 2, "5xx": 1, metrics.OtherErrorLabel: 2}, m.RollingErrorCounts())
+	assert.Equal(t, int64(2), m.CumulativeErrorCount(metrics.OtherErrorLabel))
+}
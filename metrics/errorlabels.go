@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arjantop/cuirass/num"
+)
+
+// OtherErrorLabel is the label of failures that were not classified and of
+// failures with labels over the limit of labels per command.
+const OtherErrorLabel = "other"
+
+// MaxErrorLabels is the maximum number of distinct error labels tracked per
+// command. It keeps the number of series bounded if a classifier returns too
+// many distinct labels.
+var MaxErrorLabels = 10
+
+// errorLabelCounter counts the failures with the same error label.
+type errorLabelCounter struct {
+	rolling    *num.RollingNumber
+	cumulative num.Adder
+}
+
+// errorLabels holds the failure counters of a command by their error labels.
+type errorLabels struct {
+	counters *sync.Map
+	// count is the number of labels, it is guarded by lock.
+	count int
+	lock  *sync.Mutex
+}
+
+func newErrorLabels() *errorLabels {
+	return &errorLabels{
+		counters: new(sync.Map),
+		lock:     new(sync.Mutex),
+	}
+}
+
+func (l *errorLabels) counter(m *CommandMetrics, label string) *errorLabelCounter {
+	if label == "" {
+		label = OtherErrorLabel
+	}
+	if c, ok := l.counters.Load(label); ok {
+		return c.(*errorLabelCounter)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if c, ok := l.counters.Load(label); ok {
+		return c.(*errorLabelCounter)
+	}
+	if l.count >= MaxErrorLabels {
+		label = OtherErrorLabel
+		if c, ok := l.counters.Load(label); ok {
+			return c.(*errorLabelCounter)
+		}
+	}
+	windowSize, windowBuckets := m.getRegistration().props.window()
+	c := &errorLabelCounter{rolling: num.NewRollingNumber(windowSize, windowBuckets, m.clock)}
+	l.counters.Store(label, c)
+	l.count++
+	return c
+}
+
+func (l *errorLabels) setWindow(windowSize time.Duration, windowBuckets int) {
+	l.counters.Range(func(key, value interface{}) bool {
+		value.(*errorLabelCounter).rolling.SetWindow(windowSize, windowBuckets)
+		return true
+	})
+}
+
+// ErrorLabels returns the sorted labels of all failures of the command.
+func (m *CommandMetrics) ErrorLabels() []string {
+	labels := make([]string, 0)
+	m.errorLabels.counters.Range(func(key, value interface{}) bool {
+		labels = append(labels, key.(string))
+		return true
+	})
+	sort.Strings(labels)
+	return labels
+}
+
+// RollingErrorCount returns the number of failures with the error label in the
+// statistical window.
+func (m *CommandMetrics) RollingErrorCount(label string) int {
+	if c, ok := m.errorLabels.counters.Load(label); ok {
+		return int(c.(*errorLabelCounter).rolling.Sum())
+	}
+	return 0
+}
+
+// CumulativeErrorCount returns the number of failures with the error label
+// since the metrics were created.
+func (m *CommandMetrics) CumulativeErrorCount(label string) int64 {
+	if c, ok := m.errorLabels.counters.Load(label); ok {
+		return c.(*errorLabelCounter).cumulative.Sum()
+	}
+	return 0
+}
+
+// RollingErrorCounts returns the number of failures in the statistical window
+// by their error labels.
+func (m *CommandMetrics) RollingErrorCounts() map[string]int {
+	return m.rollingErrorCountsAt(m.clock.Now())
+}
+
+func (m *CommandMetrics) rollingErrorCountsAt(now time.Time) map[string]int {
+	counts := make(map[string]int)
+	m.errorLabels.counters.Range(func(key, value interface{}) bool {
+		counts[key.(string)] = int(value.(*errorLabelCounter).rolling.SumAt(now))
+		return true
+	})
+	return counts
+}
+
+func (m *CommandMetrics) recordError(label string) {
+	c := m.errorLabels.counter(m, label)
+	c.rolling.Increment()
+	c.cumulative.Increment()
+}
+
+// UpdateError records a failure of the command classified with the error label.
+// It must be called in addition to the update of the failure event.
+func (m *ExecutionMetrics) UpdateError(name, label string) {
+	m.fetchMetrics(name).recordError(label)
+}
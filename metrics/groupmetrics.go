@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/util"
+)
+
+// GroupMetrics holds the concurrency metrics of all commands in a group.
+// Statistics are collected in the default statistical window.
+type GroupMetrics struct {
+	name          string
+	concurrent    int64
+	maxConcurrent *num.RollingNumber
+}
+
+func newGroupMetrics(clock util.Clock, name string) *GroupMetrics {
+	return &GroupMetrics{
+		name:          name,
+		maxConcurrent: num.NewRollingNumber(num.DefaultWindowSize, num.DefaultWindowBuckets, clock),
+	}
+}
+
+func (m *GroupMetrics) GroupName() string {
+	return m.name
+}
+
+func (m *GroupMetrics) executionStarted() {
+	m.maxConcurrent.UpdateMax(atomic.AddInt64(&m.concurrent, 1))
+}
+
+func (m *GroupMetrics) executionFinished() {
+	atomic.AddInt64(&m.concurrent, -1)
+}
+
+// CurrentConcurrentExecutionCount returns the number of executions of commands
+// in the group currently in flight.
+func (m *GroupMetrics) CurrentConcurrentExecutionCount() int {
+	return int(atomic.LoadInt64(&m.concurrent))
+}
+
+// RollingMaxConcurrentExecutionCount returns the maximum number of concurrent
+// executions of commands in the group in the statistical window.
+func (m *GroupMetrics) RollingMaxConcurrentExecutionCount() int {
+	return int(m.maxConcurrent.Max())
+}
+
+// RollingWindowSize returns the size of the statistical window of the group
+// metrics.
+func (m *GroupMetrics) RollingWindowSize() time.Duration {
+	return m.maxConcurrent.WindowSize()
+}
+
+// AllGroups returns the metrics of all groups with at least one execution
+// sorted by the group name.
+func (m *ExecutionMetrics) AllGroups() []*GroupMetrics {
+	g := make([]*GroupMetrics, 0)
+	m.groupMetrics.Range(func(key, value interface{}) bool {
+		g = append(g, value.(*GroupMetrics))
+		return true
+	})
+	sort.Sort(groupsByName(g))
+	return g
+}
+
+func (m *ExecutionMetrics) ForGroup(name string) *GroupMetrics {
+	return m.fetchGroupMetrics(name)
+}
+
+func (m *ExecutionMetrics) fetchGroupMetrics(name string) *GroupMetrics {
+	if metrics, ok := m.groupMetrics.Load(name); ok {
+		return metrics.(*GroupMetrics)
+	}
+	metrics, _ := m.groupMetrics.LoadOrStore(name, newGroupMetrics(m.clock, name))
+	return metrics.(*GroupMetrics)
+}
+
+type groupsByName []*GroupMetrics
+
+func (g groupsByName) Len() int           { return len(g) }
+func (g groupsByName) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g groupsByName) Less(i, j int) bool { return g[i].name < g[j].name }
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/arjantop/cuirass/util"
+)
+
+// publishQueueSize is the number of updates queued for publishing. Updates are
+// dropped while the queue is full.
+const publishQueueSize = 1024
+
+// Publisher pushes command metrics to a monitoring backend.
+// Publisher must be safe to be accessed by multiple goroutines.
+type Publisher interface {
+	// Publish publishes the current state of the given command metrics.
+	Publish(metrics []*CommandMetrics)
+}
+
+// CommandRemover is implemented by publishers that keep state for every
+// command. RemoveCommand is called for every command evicted from the metrics.
+type CommandRemover interface {
+	RemoveCommand(name string)
+}
+
+// publishRequest is an update of the command metrics queued for publishing
+// to the publishers at the time of the update.
+type publishRequest struct {
+	metrics    *CommandMetrics
+	publishers []Publisher
+}
+
+// AddPublisher adds a publisher the command metrics are pushed to.
+// Depending on the flush interval property the metrics of a command are pushed
+// after each update or the metrics of all commands are pushed periodically.
+// Publishers are always called in the background so they never slow down the
+// command executions. If the publishers fall behind the updates of the
+// metrics, some updates are not published.
+func (m *ExecutionMetrics) AddPublisher(p Publisher) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old := m.getPublishers()
+	publishers := make([]Publisher, len(old), len(old)+1)
+	copy(publishers, old)
+	publishers = append(publishers, p)
+	atomic.StorePointer(&m.publishers, unsafe.Pointer(&publishers))
+	if len(publishers) == 1 {
+		m.stopFlush = make(chan struct{})
+		go m.runFlush(m.stopFlush)
+	}
+}
+
+// RemovePublisher removes a previously added publisher.
+func (m *ExecutionMetrics) RemovePublisher(p Publisher) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old := m.getPublishers()
+	publishers := make([]Publisher, 0, len(old))
+	for _, pp := range old {
+		if pp != p {
+			publishers = append(publishers, pp)
+		}
+	}
+	if len(publishers) == 0 && len(old) > 0 {
+		close(m.stopFlush)
+	}
+	atomic.StorePointer(&m.publishers, unsafe.Pointer(&publishers))
+}
+
+// Flush pushes the metrics of all commands to all publishers.
+func (m *ExecutionMetrics) Flush() {
+	all := m.All()
+	for _, p := range m.getPublishers() {
+		p.Publish(all)
+	}
+}
+
+// getPublishers returns the publishers. The returned slice must not be modified.
+func (m *ExecutionMetrics) getPublishers() []Publisher {
+	if p := (*[]Publisher)(atomic.LoadPointer(&m.publishers)); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// publish queues the updated metrics of the command for publishing if the
+// metrics are pushed after each update. The update is also queued if the
+// flushing goroutine waits for updates, so it notices the changed flush
+// interval.
+func (m *ExecutionMetrics) publish(metrics *CommandMetrics) {
+	publishers := m.getPublishers()
+	if len(publishers) == 0 ||
+		(m.props.PublisherFlushInterval.Get() != 0 && atomic.LoadUint32(&m.waitingForUpdates) == 0) {
+		return
+	}
+	select {
+	case m.updates <- publishRequest{metrics, publishers}:
+	default:
+		// The publishers fall behind, the next update publishes the current
+		// state of the command again.
+	}
+}
+
+// runFlush publishes the queued updates or periodically flushes the metrics,
+// depending on the flush interval, until stop is closed. The queued updates are
+// published before returning.
+func (m *ExecutionMetrics) runFlush(stop chan struct{}) {
+	for {
+		if interval := m.props.PublisherFlushInterval.Get(); interval != 0 {
+			select {
+			case <-stop:
+				m.drainUpdates()
+				return
+			case <-util.After(m.clock, interval):
+				m.Flush()
+			}
+			continue
+		}
+		atomic.StoreUint32(&m.waitingForUpdates, 1)
+		select {
+		case <-stop:
+			atomic.StoreUint32(&m.waitingForUpdates, 0)
+			m.drainUpdates()
+			return
+		case r := <-m.updates:
+			atomic.StoreUint32(&m.waitingForUpdates, 0)
+			r.publish()
+		}
+	}
+}
+
+// drainUpdates publishes all queued updates.
+func (m *ExecutionMetrics) drainUpdates() {
+	for {
+		select {
+		case r := <-m.updates:
+			r.publish()
+		default:
+			return
+		}
+	}
+}
+
+func (r publishRequest) publish() {
+	for _, p := range r.publishers {
+		p.Publish([]*CommandMetrics{r.metrics})
+	}
+}
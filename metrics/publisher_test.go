@@ -0,0 +1,137 @@
+package metrics_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingPublisher struct {
+	published chan []string
+}
+
+func newRecordingPublisher() *recordingPublisher {
+	return &recordingPublisher{
+		published: make(chan []string, 100),
+	}
+}
+
+func (p *recordingPublisher) Publish(metrics []*metrics.CommandMetrics) {
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.CommandName())
+	}
+	p.published <- names
+}
+
+func TestExecutionMetricsPublishOnUpdate(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	p := newRecordingPublisher()
+	em.AddPublisher(p)
+	defer em.RemovePublisher(p)
+
+	em.Update("cmd1", 0, requestlog.Success)
+	em.Update("cmd2", 0, requestlog.Success)
+	assert.Equal(t, []string{"cmd1"}, <-p.published)
+	assert.Equal(t, []string{"cmd2"}, <-p.published)
+}
+
+func TestExecutionMetricsPublishOnFlushInterval(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("flushInterval", "10")
+	f := vaquita.NewPropertyFactory(cfg)
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		PublisherFlushInterval:      f.GetDurationProperty("flushInterval", 0, time.Millisecond),
+	}, util.NewClock())
+	p := newRecordingPublisher()
+	em.AddPublisher(p)
+	defer em.RemovePublisher(p)
+
+	em.Update("cmd1", 0, requestlog.Success)
+	select {
+	case names := <-p.published:
+		assert.Equal(t, []string{"cmd1"}, names)
+	case <-time.After(time.Second):
+		t.Fatal("metrics were not flushed")
+	}
+}
+
+func TestExecutionMetricsRemovePublisher(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	p1 := newRecordingPublisher()
+	p2 := newRecordingPublisher()
+	em.AddPublisher(p1)
+	em.AddPublisher(p2)
+	em.RemovePublisher(p1)
+
+	em.Update("cmd1", 0, requestlog.Success)
+	assert.Equal(t, []string{"cmd1"}, <-p2.published)
+	assert.Equal(t, 0, len(p1.published))
+	em.RemovePublisher(p2)
+}
+
+type blockingPublisher struct {
+	unblock chan struct{}
+}
+
+func (p *blockingPublisher) Publish(metrics []*metrics.CommandMetrics) {
+	<-p.unblock
+}
+
+func TestExecutionMetricsPublishInBackground(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	p := &blockingPublisher{make(chan struct{})}
+	em.AddPublisher(p)
+	defer em.RemovePublisher(p)
+	defer close(p.unblock)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10000; i++ {
+			em.Update("cmd", 0, requestlog.Success)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("updates waited for the publisher")
+	}
+}
+
+func TestExecutionMetricsPublishQueuedUpdatesOnRemove(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	p := newRecordingPublisher()
+	em.AddPublisher(p)
+	em.Update("cmd1", 0, requestlog.Success)
+	em.RemovePublisher(p)
+	select {
+	case names := <-p.published:
+		assert.Equal(t, []string{"cmd1"}, names)
+	case <-time.After(time.Second):
+		t.Fatal("queued update was not published")
+	}
+}
+
+func TestExecutionMetricsConcurrentPublishers(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := newRecordingPublisher()
+			em.AddPublisher(p)
+			em.Update("cmd", 0, requestlog.Success)
+			em.RemovePublisher(p)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/util"
+)
+
+// FloatProperty is a dynamic property with a floating point value.
+type FloatProperty interface {
+	Get() float64
+}
+
+// SLO is a service level objective of a command. A request is good if it
+// succeeded within the latency objective.
+type SLO struct {
+	// Target is the percentage of requests that must be good.
+	Target float64
+	// LatencyObjective is the maximum execution time of a good request. Zero
+	// means only failed requests are bad.
+	LatencyObjective time.Duration
+}
+
+// BurnRateAlert fires when the error budget is consumed at least Threshold
+// times faster than allowed in both the long and the short window. The short
+// window makes the alert resolve quickly once the problem is fixed.
+type BurnRateAlert struct {
+	Name      string
+	Long      time.Duration
+	Short     time.Duration
+	Threshold float64
+}
+
+// BurnRateAlerts are the burn rate alerts evaluated for every command with an
+// SLO. They are the multiwindow alerts of the SRE workbook for a 30 day error
+// budget: the fast alert fires when 2% of the budget is consumed in an hour and
+// the slow alert when 5% is consumed in six hours. The thresholds are derived
+// from the long windows, so they must change together with them.
+// Windows of the alerts must be one of the Windows.
+// BurnRateAlerts must be set before the metrics are constructed.
+var BurnRateAlerts = []BurnRateAlert{
+	{Name: "fast", Long: time.Hour, Short: 5 * time.Minute, Threshold: 14.4},
+	{Name: "slow", Long: 6 * time.Hour, Short: 30 * time.Minute, Threshold: 6},
+}
+
+// BurnRateEvent is an event of a burn rate alert that started or stopped firing.
+type BurnRateEvent struct {
+	CommandName          string
+	Alert                BurnRateAlert
+	Firing               bool
+	LongBurnRate         float64
+	ShortBurnRate        float64
+	ErrorBudgetRemaining float64
+}
+
+// BurnRateListener is called for every burn rate alert that starts or stops
+// firing. Listeners are called from a single goroutine.
+type BurnRateListener func(e BurnRateEvent)
+
+// BurnRateListenerID identifies an added burn rate listener.
+type BurnRateListenerID uint64
+
+type burnRateListener struct {
+	id BurnRateListenerID
+	l  BurnRateListener
+}
+
+// errorBudget counts all and bad requests in the ErrorBudgetWindow.
+type errorBudget struct {
+	requests *num.RollingNumber
+	bad      *num.RollingNumber
+}
+
+// ErrorBudgetWindow is the window over which the error budget of an SLO is
+// computed and ErrorBudgetWindowBuckets is its number of buckets.
+// They must be set before the metrics are constructed.
+var (
+	ErrorBudgetWindow        = 30 * 24 * time.Hour
+	ErrorBudgetWindowBuckets = 30
+)
+
+// SLO returns the service level objective of the command. If the command has
+// no SLO ok is false.
+func (m *CommandMetrics) SLO() (slo SLO, ok bool) {
+	props := m.getRegistration().props
+	if props == nil || props.SLOTarget == nil {
+		return SLO{}, false
+	}
+	target := props.SLOTarget.Get()
+	if target <= 0 || target >= 100 {
+		return SLO{}, false
+	}
+	slo = SLO{Target: target}
+	if props.SLOLatencyObjective != nil {
+		slo.LatencyObjective = props.SLOLatencyObjective.Get()
+	}
+	return slo, true
+}
+
+// errorBudget returns the error budget counters of the command. They are
+// allocated together with the windows of the burn rate alerts when the command
+// is first executed with an SLO.
+func (m *CommandMetrics) errorBudget() *errorBudget {
+	if b := atomic.LoadPointer(&m.budget); b != nil {
+		return (*errorBudget)(b)
+	}
+	b := &errorBudget{
+		requests: num.NewRollingNumber(ErrorBudgetWindow, ErrorBudgetWindowBuckets, m.clock),
+		bad:      num.NewRollingNumber(ErrorBudgetWindow, ErrorBudgetWindowBuckets, m.clock),
+	}
+	if atomic.CompareAndSwapPointer(&m.budget, nil, unsafe.Pointer(b)) {
+		for _, a := range BurnRateAlerts {
+			m.Window(a.Long)
+			m.Window(a.Short)
+		}
+	}
+	return (*errorBudget)(atomic.LoadPointer(&m.budget))
+}
+
+// BurnRate returns the rate at which the error budget of the SLO is consumed
+// in the statistical window with the given size. It returns zero if the command
+// has no SLO or there is no such window.
+func (m *CommandMetrics) BurnRate(window time.Duration) float64 {
+	slo, ok := m.SLO()
+	if !ok {
+		return 0
+	}
+	if w, ok := m.Window(window); ok {
+		return w.BurnRate(slo.Target)
+	}
+	return 0
+}
+
+// ErrorBudgetRemaining returns the fraction of the error budget of the SLO that
+// was not consumed in the ErrorBudgetWindow. The value is negative when the
+// budget is exhausted and one if the command has no SLO.
+func (m *CommandMetrics) ErrorBudgetRemaining() float64 {
+	slo, ok := m.SLO()
+	if !ok {
+		return 1
+	}
+	b := m.errorBudget()
+	return 1 - burnRate(int(b.requests.Sum()), int(b.bad.Sum()), slo.Target)
+}
+
+// FiringBurnRateAlerts returns the burn rate alerts of the command that are
+// currently firing.
+func (m *CommandMetrics) FiringBurnRateAlerts() []BurnRateAlert {
+	firing := atomic.LoadUint64(&m.firingAlerts)
+	alerts := make([]BurnRateAlert, 0)
+	for i, a := range BurnRateAlerts {
+		if firing&(1<<uint(i)) != 0 {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// evaluateBurnRateAlerts updates the state of burn rate alerts and returns the
+// events of alerts that changed the state.
+func (m *CommandMetrics) evaluateBurnRateAlerts() []BurnRateEvent {
+	_, ok := m.SLO()
+	old := atomic.LoadUint64(&m.firingAlerts)
+	firing := uint64(0)
+	events := make([]BurnRateEvent, 0)
+	for i, a := range BurnRateAlerts {
+		bit := uint64(1) << uint(i)
+		var long, short float64
+		if ok {
+			long, short = m.BurnRate(a.Long), m.BurnRate(a.Short)
+			if long >= a.Threshold && short >= a.Threshold {
+				firing |= bit
+			}
+		}
+		if firing&bit != old&bit {
+			events = append(events, BurnRateEvent{
+				CommandName:          m.name,
+				Alert:                a,
+				Firing:               firing&bit != 0,
+				LongBurnRate:         long,
+				ShortBurnRate:        short,
+				ErrorBudgetRemaining: m.ErrorBudgetRemaining(),
+			})
+		}
+	}
+	atomic.StoreUint64(&m.firingAlerts, firing)
+	return events
+}
+
+// burnRate returns the ratio of bad requests relative to the ratio allowed by
+// the target percentage.
+func burnRate(total, bad int, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - target/100)
+}
+
+// AddBurnRateListener adds a listener notified when burn rate alerts of
+// commands start or stop firing. Alerts are evaluated on the health snapshot
+// interval while there are any listeners. The returned id removes the listener.
+func (m *ExecutionMetrics) AddBurnRateListener(l BurnRateListener) BurnRateListenerID {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastListenerID++
+	old := m.getBurnRateListeners()
+	listeners := make([]burnRateListener, len(old), len(old)+1)
+	copy(listeners, old)
+	listeners = append(listeners, burnRateListener{m.lastListenerID, l})
+	atomic.StorePointer(&m.burnRateListeners, unsafe.Pointer(&listeners))
+	if len(listeners) == 1 {
+		m.stopSLOEvaluation = make(chan struct{})
+		go m.runSLOEvaluation(m.stopSLOEvaluation)
+	}
+	return m.lastListenerID
+}
+
+// RemoveBurnRateListener removes a previously added listener. The periodic
+// evaluation of the alerts stops when the last listener is removed.
+func (m *ExecutionMetrics) RemoveBurnRateListener(id BurnRateListenerID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old := m.getBurnRateListeners()
+	listeners := make([]burnRateListener, 0, len(old))
+	for _, l := range old {
+		if l.id != id {
+			listeners = append(listeners, l)
+		}
+	}
+	if len(listeners) == 0 && len(old) > 0 {
+		close(m.stopSLOEvaluation)
+	}
+	atomic.StorePointer(&m.burnRateListeners, unsafe.Pointer(&listeners))
+}
+
+func (m *ExecutionMetrics) getBurnRateListeners() []burnRateListener {
+	if l := (*[]burnRateListener)(atomic.LoadPointer(&m.burnRateListeners)); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// EvaluateSLOs evaluates the burn rate alerts of all commands and notifies the
+// listeners of alerts that changed the state.
+func (m *ExecutionMetrics) EvaluateSLOs() {
+	m.sloLock.Lock()
+	defer m.sloLock.Unlock()
+	listeners := m.getBurnRateListeners()
+	for _, cm := range m.All() {
+		for _, e := range cm.evaluateBurnRateAlerts() {
+			for _, l := range listeners {
+				l.l(e)
+			}
+		}
+	}
+}
+
+// runSLOEvaluation periodically evaluates the SLOs of all commands until stop
+// is closed.
+func (m *ExecutionMetrics) runSLOEvaluation(stop chan struct{}) {
+	for {
+		interval := HealthSnapshotIntervalDefault
+		if p := m.props.HealthSnapshotInterval; p != nil && p.Get() > 0 {
+			interval = p.Get()
+		}
+		select {
+		case <-stop:
+			return
+		case <-util.After(m.clock, interval):
+		}
+		m.EvaluateSLOs()
+	}
+}
@@ -0,0 +1,128 @@
+package metrics_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+)
+
+type testingFloatProperty float64
+
+func (p testingFloatProperty) Get() float64 { return float64(p) }
+
+func newTestingSLOMetrics(clock util.Clock, target float64) *metrics.ExecutionMetrics {
+	f := vaquita.NewPropertyFactory(vaquita.NewEmptyMapConfig())
+	em := metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		PublisherFlushInterval: f.GetDurationProperty("flushInterval", 0, time.Millisecond),
+		HealthSnapshotInterval: f.GetDurationProperty("healthSnapshot", time.Hour, time.Millisecond),
+	}, clock)
+	em.Register("cmd", "group", &metrics.CommandMetricsProperties{
+		RollingStatisticalWindow:        f.GetDurationProperty("window", 10*time.Second, time.Millisecond),
+		RollingStatisticalWindowBuckets: f.GetIntProperty("buckets", 10),
+		SLOTarget:                       testingFloatProperty(target),
+		SLOLatencyObjective:             f.GetDurationProperty("objective", 50*time.Millisecond, time.Millisecond),
+	})
+	return em
+}
+
+func TestCommandMetricsWithoutSLO(t *testing.T) {
+	em := newTestingSLOMetrics(util.NewClock(), 100)
+	m := em.ForCommand("cmd")
+	em.Update("cmd", time.Millisecond, requestlog.Failure)
+	_, ok := m.SLO()
+	assert.False(t, ok)
+	assert.Equal(t, 0.0, m.BurnRate(time.Minute))
+	assert.Equal(t, 1.0, m.ErrorBudgetRemaining())
+}
+
+func TestCommandMetricsSLOBurnRateAlerts(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	em := newTestingSLOMetrics(clock, 99)
+	lock := new(sync.Mutex)
+	events := make([]metrics.BurnRateEvent, 0)
+	em.AddBurnRateListener(func(e metrics.BurnRateEvent) {
+		lock.Lock()
+		events = append(events, e)
+		lock.Unlock()
+	})
+
+	for i := 0; i < 90; i++ {
+		em.Update("cmd", 10*time.Millisecond, requestlog.Success)
+	}
+	for i := 0; i < 5; i++ {
+		em.Update("cmd", 100*time.Millisecond, requestlog.Success)
+		em.Update("cmd", 10*time.Millisecond, requestlog.Failure, requestlog.FallbackSuccess)
+	}
+
+	m := em.ForCommand("cmd")
+	slo, ok := m.SLO()
+	assert.True(t, ok)
+	assert.Equal(t, metrics.SLO{Target: 99, LatencyObjective: 50 * time.Millisecond}, slo)
+	assert.InDelta(t, 10, m.BurnRate(5*time.Minute), 0.0001)
+	assert.InDelta(t, -9, m.ErrorBudgetRemaining(), 0.0001)
+
+	em.EvaluateSLOs()
+	lock.Lock()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "cmd", events[0].CommandName)
+		assert.Equal(t, "slow", events[0].Alert.Name)
+		assert.True(t, events[0].Firing)
+	}
+	lock.Unlock()
+	assert.Equal(t, []metrics.BurnRateAlert{metrics.BurnRateAlerts[1]}, m.FiringBurnRateAlerts())
+
+	clock.Add(31 * time.Minute)
+	em.EvaluateSLOs()
+	lock.Lock()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "slow", events[1].Alert.Name)
+		assert.False(t, events[1].Firing)
+	}
+	lock.Unlock()
+	assert.Empty(t, m.FiringBurnRateAlerts())
+}
+
+func TestCommandMetricsErrorBudgetWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	em := newTestingSLOMetrics(clock, 99)
+	m := em.ForCommand("cmd")
+	for i := 0; i < 9; i++ {
+		em.Update("cmd", 10*time.Millisecond, requestlog.Success)
+	}
+	em.Update("cmd", 10*time.Millisecond, requestlog.Failure)
+	assert.InDelta(t, -9, m.ErrorBudgetRemaining(), 0.0001)
+
+	clock.Add(metrics.ErrorBudgetWindow)
+	assert.Equal(t, 1.0, m.ErrorBudgetRemaining(), "Requests outside of the budget window are not counted")
+	assert.Equal(t, int64(1), m.CumulativeSum(requestlog.Failure))
+}
+
+func TestCommandMetricsRemoveBurnRateListener(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	em := newTestingSLOMetrics(clock, 99)
+	lock := new(sync.Mutex)
+	events := 0
+	id := em.AddBurnRateListener(func(e metrics.BurnRateEvent) {
+		lock.Lock()
+		events++
+		lock.Unlock()
+	})
+	for i := 0; i < 10; i++ {
+		em.Update("cmd", 10*time.Millisecond, requestlog.Failure)
+	}
+	assert.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+
+	em.RemoveBurnRateListener(id)
+	clock.Add(time.Hour)
+	assert.Never(t, func() bool { return clock.Waiters() > 0 }, 50*time.Millisecond, time.Millisecond,
+		"Evaluation stops when the last listener is removed")
+	lock.Lock()
+	assert.Equal(t, 0, events)
+	lock.Unlock()
+}
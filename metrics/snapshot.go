@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/requestlog"
+)
+
+// SnapshotPercentiles are the percentiles of latencies included in snapshots.
+var SnapshotPercentiles = []float64{0, 25, 50, 75, 90, 95, 99, 99.5, 100}
+
+// CommandState provides the state of commands that is kept outside of the
+// metrics, like the state of circuit breakers and the command properties.
+// CommandState must be safe to be accessed by multiple goroutines.
+type CommandState interface {
+	IsCircuitBreakerOpen(name string) bool
+	// CircuitBreakerKeys returns the breaker keys of the keyed circuit
+	// breakers of the command.
+	CircuitBreakerKeys(name string) []string
+	IsCircuitBreakerOpenForKey(name, key string) bool
+	IsGroupCircuitBreakerOpen(group string) bool
+	// CommandPropertyValues returns the effective values of the command
+	// properties by their names.
+	CommandPropertyValues(name, group string) map[string]interface{}
+}
+
+// LatencySnapshot holds the mean and the percentiles of a latency in the
+// statistical window. Percentiles are keyed by their formatted values.
+type LatencySnapshot struct {
+	Mean        time.Duration            `json:"mean"`
+	Percentiles map[string]time.Duration `json:"percentiles"`
+}
+
+// CommandSnapshot holds the metrics of a command taken at the same moment.
+// Counts are keyed by the event names and error counts by the error labels.
+// States of the keyed circuit breakers are keyed by the breaker keys, the
+// shared breaker of the command is reported in CircuitBreakerOpen. Durations
+// are encoded in JSON as nanoseconds.
+type CommandSnapshot struct {
+	Name                               string                 `json:"name"`
+	Group                              string                 `json:"group"`
+	Time                               time.Time              `json:"time"`
+	RequestCount                       int                    `json:"requestCount"`
+	ErrorCount                         int                    `json:"errorCount"`
+	ErrorPercentage                    int                    `json:"errorPercentage"`
+	RollingCounts                      map[string]int         `json:"rollingCounts"`
+	CumulativeCounts                   map[string]int64       `json:"cumulativeCounts"`
+	RollingErrorCounts                 map[string]int         `json:"rollingErrorCounts"`
+	Cache                              CacheSnapshot          `json:"cache"`
+	CurrentConcurrentExecutionCount    int                    `json:"currentConcurrentExecutionCount"`
+	RollingMaxConcurrentExecutionCount int                    `json:"rollingMaxConcurrentExecutionCount"`
+	LatencyExecute                     LatencySnapshot        `json:"latencyExecute"`
+	LatencyTotal                       LatencySnapshot        `json:"latencyTotal"`
+	LatencyPermitWait                  LatencySnapshot        `json:"latencyPermitWait"`
+	CircuitBreakerOpen                 bool                   `json:"circuitBreakerOpen"`
+	KeyCircuitBreakersOpen             map[string]bool        `json:"keyCircuitBreakersOpen"`
+	GroupCircuitBreakerOpen            bool                   `json:"groupCircuitBreakerOpen"`
+	Properties                         map[string]interface{} `json:"properties"`
+	Windows                            []WindowSnapshot       `json:"windows"`
+}
+
+// CacheSnapshot holds the request cache statistics of a command in the
+// statistical window.
+type CacheSnapshot struct {
+	Lookups  int     `json:"lookups"`
+	Hits     int     `json:"hits"`
+	Misses   int     `json:"misses"`
+	Stores   int     `json:"stores"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// WindowSnapshot holds the metrics of a command in a coarse statistical window.
+type WindowSnapshot struct {
+	Size            time.Duration   `json:"size"`
+	RequestCount    int             `json:"requestCount"`
+	ErrorCount      int             `json:"errorCount"`
+	ErrorPercentage int             `json:"errorPercentage"`
+	RequestRate     float64         `json:"requestRate"`
+	LatencyExecute  LatencySnapshot `json:"latencyExecute"`
+}
+
+// SetCommandState sets the provider of the command state included in snapshots.
+func (m *ExecutionMetrics) SetCommandState(s CommandState) {
+	m.lock.Lock()
+	m.state = s
+	m.lock.Unlock()
+}
+
+func (m *ExecutionMetrics) getCommandState() CommandState {
+	m.lock.RLock()
+	s := m.state
+	m.lock.RUnlock()
+	return s
+}
+
+// Snapshot returns the snapshots of metrics of all commands sorted by the
+// command name. Derived values like the error percentage are computed from the
+// same counts so they are always consistent with each other. All rolling
+// values are read at the same time, so the windows of all commands end at
+// the time of the snapshot.
+func (m *ExecutionMetrics) Snapshot() []CommandSnapshot {
+	all := m.All()
+	sort.Sort(commandsByName(all))
+	state := m.getCommandState()
+	now := m.clock.Now()
+	snapshots := make([]CommandSnapshot, len(all))
+	for i, cm := range all {
+		snapshots[i] = cm.snapshot(now, state)
+	}
+	return snapshots
+}
+
+func (m *CommandMetrics) snapshot(now time.Time, state CommandState) CommandSnapshot {
+	s := CommandSnapshot{
+		Name:                               m.CommandName(),
+		Group:                              m.CommandGroup(),
+		Time:                               now,
+		RollingCounts:                      make(map[string]int, len(requestlog.ExecutionEvents)),
+		CumulativeCounts:                   make(map[string]int64, len(requestlog.ExecutionEvents)),
+		RollingErrorCounts:                 m.rollingErrorCountsAt(now),
+		CurrentConcurrentExecutionCount:    m.CurrentConcurrentExecutionCount(),
+		RollingMaxConcurrentExecutionCount: int(m.maxConcurrent.MaxAt(now)),
+		LatencyExecute:                     latencySnapshot(m.rolling.executionTime, now),
+		LatencyTotal:                       latencySnapshot(m.totalTime, now),
+		LatencyPermitWait:                  latencySnapshot(m.permitWait, now),
+	}
+	counts := make([]int, len(requestlog.ExecutionEvents))
+	for _, e := range requestlog.ExecutionEvents {
+		counts[e] = m.rolling.rollingSumAt(e, now)
+		s.RollingCounts[e.String()] = counts[e]
+		s.CumulativeCounts[e.String()] = m.CumulativeSum(e)
+	}
+	s.Cache = CacheSnapshot{
+		Hits:   int(m.cacheCounters.rolling[CacheHit].SumAt(now)),
+		Misses: int(m.cacheCounters.rolling[CacheMiss].SumAt(now)),
+		Stores: int(m.cacheCounters.rolling[CacheStore].SumAt(now)),
+	}
+	s.Cache.Lookups = s.Cache.Hits + s.Cache.Misses
+	if s.Cache.Lookups > 0 {
+		s.Cache.HitRatio = float64(s.Cache.Hits) / float64(s.Cache.Lookups)
+	}
+	s.ErrorCount = errorCount(func(e requestlog.ExecutionEvent) int { return counts[e] })
+	s.RequestCount = counts[requestlog.Success] + s.ErrorCount
+	s.ErrorPercentage = errorPercentage(s.RequestCount, s.ErrorCount)
+	windows := m.Windows()
+	s.Windows = make([]WindowSnapshot, len(windows))
+	for i, w := range windows {
+		s.Windows[i] = w.snapshot(now)
+	}
+	if state != nil {
+		s.CircuitBreakerOpen = state.IsCircuitBreakerOpen(s.Name)
+		if keys := state.CircuitBreakerKeys(s.Name); len(keys) > 0 {
+			s.KeyCircuitBreakersOpen = make(map[string]bool, len(keys))
+			for _, key := range keys {
+				s.KeyCircuitBreakersOpen[key] = state.IsCircuitBreakerOpenForKey(s.Name, key)
+			}
+		}
+		s.GroupCircuitBreakerOpen = state.IsGroupCircuitBreakerOpen(s.Group)
+		s.Properties = state.CommandPropertyValues(s.Name, s.Group)
+	}
+	return s
+}
+
+func (w *WindowMetrics) snapshot(now time.Time) WindowSnapshot {
+	s := WindowSnapshot{
+		Size:           w.Size(),
+		LatencyExecute: latencySnapshot(w.executionTime, now),
+	}
+	success := w.rollingSumAt(requestlog.Success, now)
+	s.ErrorCount = errorCount(func(e requestlog.ExecutionEvent) int { return w.rollingSumAt(e, now) })
+	s.RequestCount = success + s.ErrorCount
+	s.ErrorPercentage = errorPercentage(s.RequestCount, s.ErrorCount)
+	s.RequestRate = float64(s.RequestCount) / s.Size.Seconds()
+	return s
+}
+
+func latencySnapshot(h *num.RollingHistogram, now time.Time) LatencySnapshot {
+	values := h.PercentilesAt(now, SnapshotPercentiles...)
+	ps := make(map[string]time.Duration, len(values))
+	for i, v := range values {
+		ps[strconv.FormatFloat(SnapshotPercentiles[i], 'f', -1, 64)] = toDuration(v)
+	}
+	return LatencySnapshot{Mean: toDuration(h.MeanAt(now)), Percentiles: ps}
+}
+
+type commandsByName []*CommandMetrics
+
+func (c commandsByName) Len() int           { return len(c) }
+func (c commandsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c commandsByName) Less(i, j int) bool { return c[i].name < c[j].name }
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+)
+
+// Windows are the sizes of the coarse statistical windows a command can keep in
+// addition to its rolling statistical window. They are used for reviews,
+// capacity planning and burn rate alerts where the rolling window is too noisy.
+// A coarse window of a command is allocated when it is first read or when the
+// command gets an SLO with a burn rate alert over the window, executions before
+// that are not counted in it.
+// Windows must be set before the metrics are constructed.
+var Windows = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+}
+
+// WindowBuckets is the number of buckets of each coarse statistical window.
+var WindowBuckets = 12
+
+// WindowMetrics holds the counts and execution times of a command in a single
+// statistical window.
+type WindowMetrics struct {
+	eventCounters []*num.RollingNumber
+	executionTime *num.RollingHistogram
+	// slowCounter counts successful requests slower than the latency objective.
+	slowCounter *num.RollingNumber
+}
+
+func newWindowMetrics(size time.Duration, buckets int, clock util.Clock) *WindowMetrics {
+	w := &WindowMetrics{
+		eventCounters: make([]*num.RollingNumber, len(requestlog.ExecutionEvents)),
+		executionTime: num.NewRollingHistogram(size, buckets, num.DefaultSignificantDigits, clock),
+		slowCounter:   num.NewRollingNumber(size, buckets, clock),
+	}
+	for i := range w.eventCounters {
+		w.eventCounters[i] = num.NewRollingNumber(size, buckets, clock)
+	}
+	return w
+}
+
+func (w *WindowMetrics) increment(e requestlog.ExecutionEvent) {
+	if int(e) < len(w.eventCounters) {
+		w.eventCounters[e].Increment()
+	}
+}
+
+// Size returns the size of the statistical window.
+func (w *WindowMetrics) Size() time.Duration {
+	return w.eventCounters[0].WindowSize()
+}
+
+func (w *WindowMetrics) RollingSum(e requestlog.ExecutionEvent) int {
+	if int(e) < len(w.eventCounters) {
+		return int(w.eventCounters[e].Sum())
+	}
+	return 0
+}
+
+// rollingSumAt returns the number of events in the window ending at now.
+func (w *WindowMetrics) rollingSumAt(e requestlog.ExecutionEvent, now time.Time) int {
+	if int(e) < len(w.eventCounters) {
+		return int(w.eventCounters[e].SumAt(now))
+	}
+	return 0
+}
+
+func (w *WindowMetrics) TotalRequests() int {
+	return w.RollingSum(requestlog.Success) + w.ErrorCount()
+}
+
+func (w *WindowMetrics) ErrorCount() int {
+	return errorCount(w.RollingSum)
+}
+
+func (w *WindowMetrics) ErrorPercentage() int {
+	errors := w.ErrorCount()
+	return errorPercentage(w.RollingSum(requestlog.Success)+errors, errors)
+}
+
+// SlowCount returns the number of successful requests slower than the latency
+// objective of the command.
+func (w *WindowMetrics) SlowCount() int {
+	return int(w.slowCounter.Sum())
+}
+
+// BurnRate returns the rate at which the error budget of the SLO with the given
+// target percentage is consumed. Rate of 1 consumes exactly the whole budget
+// over the SLO period.
+func (w *WindowMetrics) BurnRate(target float64) float64 {
+	errors := w.ErrorCount()
+	total := w.RollingSum(requestlog.Success) + errors
+	return burnRate(total, errors+w.SlowCount(), target)
+}
+
+// RequestRate returns the number of requests per second averaged over the
+// size of the window.
+func (w *WindowMetrics) RequestRate() float64 {
+	return float64(w.TotalRequests()) / w.Size().Seconds()
+}
+
+func (w *WindowMetrics) ExecutionTimeMean() time.Duration {
+	return toDuration(w.executionTime.Mean())
+}
+
+// ExecutionTimePercentiles returns the execution times at the given percentiles.
+func (w *WindowMetrics) ExecutionTimePercentiles(ps ...float64) []time.Duration {
+	return toDurations(w.executionTime.Percentiles(ps...))
+}
+
+// Window returns the metrics of the command in the statistical window with the
+// given size. Size of zero selects the rolling statistical window of the command.
+func (m *CommandMetrics) Window(size time.Duration) (*WindowMetrics, bool) {
+	if size == 0 {
+		return m.rolling, true
+	}
+	for i := range m.windows {
+		if Windows[i] == size {
+			return m.window(i), true
+		}
+	}
+	if m.rolling.Size() == size {
+		return m.rolling, true
+	}
+	return nil, false
+}
+
+// Windows returns the metrics of the command in the coarse statistical windows.
+func (m *CommandMetrics) Windows() []*WindowMetrics {
+	windows := make([]*WindowMetrics, len(m.windows))
+	for i := range m.windows {
+		windows[i] = m.window(i)
+	}
+	return windows
+}
+
+// window returns the coarse window with the index and allocates it if it does
+// not exist yet.
+func (m *CommandMetrics) window(i int) *WindowMetrics {
+	if w := atomic.LoadPointer(&m.windows[i]); w != nil {
+		return (*WindowMetrics)(w)
+	}
+	w := newWindowMetrics(Windows[i], WindowBuckets, m.clock)
+	if !atomic.CompareAndSwapPointer(&m.windows[i], nil, unsafe.Pointer(w)) {
+		return (*WindowMetrics)(atomic.LoadPointer(&m.windows[i]))
+	}
+	for {
+		p := atomic.LoadPointer(&m.activeWindows)
+		var old []*WindowMetrics
+		if p != nil {
+			old = *(*[]*WindowMetrics)(p)
+		}
+		active := make([]*WindowMetrics, len(old), len(old)+1)
+		copy(active, old)
+		active = append(active, w)
+		if atomic.CompareAndSwapPointer(&m.activeWindows, p, unsafe.Pointer(&active)) {
+			return w
+		}
+	}
+}
+
+// getActiveWindows returns the coarse windows that were already allocated.
+// The returned slice must not be modified.
+func (m *CommandMetrics) getActiveWindows() []*WindowMetrics {
+	if p := (*[]*WindowMetrics)(atomic.LoadPointer(&m.activeWindows)); p != nil {
+		return *p
+	}
+	return nil
+}
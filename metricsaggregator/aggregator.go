@@ -0,0 +1,321 @@
+// Package metricsaggregator merges the metrics streams of multiple instances
+// into a single cluster-wide stream, like Turbine does for Hystrix.
+package metricsaggregator
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultRetryInterval is the default delay before reconnecting to a stream
+	// that failed or closed.
+	DefaultRetryInterval = time.Second
+	// DefaultStaleAfter is the default age after which records of an instance
+	// are no longer merged.
+	DefaultStaleAfter = 10 * time.Second
+)
+
+// record is the latest record of a command or a group received from an
+// instance.
+type record struct {
+	data     map[string]interface{}
+	received time.Time
+}
+
+// mergedTypes are the types of records that are merged across instances.
+// Records of other types, like the SLOs, carry values that cannot be summed
+// and are passed through per instance with the url of the instance in host.
+var mergedTypes = map[string]bool{
+	"HystrixCommand":    true,
+	"HystrixThreadPool": true,
+}
+
+// Aggregator subscribes to the metrics streams of instances and merges their
+// command and thread pool records of the same name.
+// As in Turbine, numeric values are summed, including latencies and property
+// values that the Hystrix dashboard divides by reportingHosts. The error
+// percentage is computed from the summed counts, the current time is the
+// latest one, booleans are true if true for any instance and strings are taken
+// from the first instance. reportingHosts is the number of instances that
+// reported the record.
+// Aggregator must be safe to be accessed by multiple goroutines.
+type Aggregator struct {
+	urls          []string
+	client        *http.Client
+	retryInterval time.Duration
+	staleAfter    time.Duration
+	// records holds the records of every instance by their keys.
+	records map[string]map[string]*record
+	cancel  func()
+	lock    *sync.Mutex
+}
+
+// NewAggregator constructs a new aggregator of the metrics streams at the urls.
+// Duplicate urls are subscribed to only once.
+func NewAggregator(urls ...string) *Aggregator {
+	records := make(map[string]map[string]*record, len(urls))
+	unique := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if _, ok := records[url]; ok {
+			continue
+		}
+		records[url] = make(map[string]*record)
+		unique = append(unique, url)
+	}
+	return &Aggregator{
+		urls:          unique,
+		client:        http.DefaultClient,
+		retryInterval: DefaultRetryInterval,
+		staleAfter:    DefaultStaleAfter,
+		records:       records,
+		lock:          new(sync.Mutex),
+	}
+}
+
+// SetRetryInterval sets the delay before reconnecting to a stream.
+// SetRetryInterval must be called before Start.
+func (a *Aggregator) SetRetryInterval(d time.Duration) {
+	a.retryInterval = d
+}
+
+// SetStaleAfter sets the age after which records are no longer merged. Commands
+// that an instance stopped reporting disappear from the merged stream after it.
+// SetStaleAfter must be called before Start.
+func (a *Aggregator) SetStaleAfter(d time.Duration) {
+	a.staleAfter = d
+}
+
+// Start subscribes to all the streams until Stop is called. Streams that fail
+// are reconnected after the retry interval.
+func (a *Aggregator) Start() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	for _, url := range a.urls {
+		go a.subscribe(ctx, url)
+	}
+}
+
+// Stop closes the connections to all the streams.
+func (a *Aggregator) Stop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+}
+
+// subscribe reads the stream at the url until the context is done.
+func (a *Aggregator) subscribe(ctx context.Context, url string) {
+	for {
+		a.read(ctx, url)
+		// Records of an instance that is not connected are not merged.
+		a.clear(url)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.retryInterval):
+		}
+	}
+}
+
+// read reads the records of the stream until it fails or the context is done.
+func (a *Aggregator) read(ctx context.Context, url string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			// Pings and empty lines separating the events.
+			continue
+		}
+		data := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &data); err != nil {
+			continue
+		}
+		a.add(url, data)
+	}
+}
+
+func (a *Aggregator) add(url string, data map[string]interface{}) {
+	key, ok := recordKey(data)
+	if !ok {
+		return
+	}
+	a.lock.Lock()
+	a.records[url][key] = &record{data, time.Now()}
+	a.lock.Unlock()
+}
+
+func (a *Aggregator) clear(url string) {
+	a.lock.Lock()
+	a.records[url] = make(map[string]*record)
+	a.lock.Unlock()
+}
+
+// recordKey returns the key identifying the records of the same command or
+// group in the streams of different instances.
+func recordKey(data map[string]interface{}) (string, bool) {
+	t, ok := data["type"].(string)
+	if !ok {
+		return "", false
+	}
+	name, _ := data["name"].(string)
+	return t + "/" + name, true
+}
+
+// Records returns the merged records of all instances sorted by their type
+// and name. Records that are not merged are reported once for every instance
+// and sorted by the host too.
+func (a *Aggregator) Records() []map[string]interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	deadline := time.Now().Add(-a.staleAfter)
+	merged := make(map[string]map[string]interface{})
+	hosts := make(map[string]int)
+	for _, url := range a.urls {
+		for key, r := range a.records[url] {
+			if r.received.Before(deadline) {
+				continue
+			}
+			if !mergedTypes[r.data["type"].(string)] {
+				key += "/" + url
+				m := copyValue(r.data).(map[string]interface{})
+				m["host"] = url
+				merged[key] = m
+			} else if m, ok := merged[key]; ok {
+				mergeRecord(m, r.data)
+			} else {
+				merged[key] = copyValue(r.data).(map[string]interface{})
+			}
+			hosts[key] += 1
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		m := merged[key]
+		m["reportingHosts"] = hosts[key]
+		if errorCount, ok := m["errorCount"].(float64); ok {
+			if requests, ok := m["requestCount"].(float64); ok && requests > 0 {
+				m["errorPercentage"] = int(errorCount / requests * 100)
+			} else {
+				m["errorPercentage"] = 0
+			}
+		}
+		records[i] = m
+	}
+	return records
+}
+
+// mergeRecord merges the values of the record src into the record dst.
+func mergeRecord(dst, src map[string]interface{}) {
+	for k, v := range src {
+		old, ok := dst[k]
+		switch {
+		case !ok:
+			dst[k] = copyValue(v)
+		case k == "currentTime":
+			if t, ok := v.(float64); ok {
+				if oldTime, ok := old.(float64); !ok || t > oldTime {
+					dst[k] = t
+				}
+			}
+		default:
+			dst[k] = mergeValue(old, v)
+		}
+	}
+}
+
+// mergeValue returns the merged value of two values with the same key.
+// Values of different types are not merged and the first value is returned.
+func mergeValue(a, b interface{}) interface{} {
+	switch av := a.(type) {
+	case float64:
+		if bv, ok := b.(float64); ok {
+			return av + bv
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			return av || bv
+		}
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			mergeRecord(av, bv)
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			for _, v := range bv {
+				if !contains(av, v) {
+					av = append(av, copyValue(v))
+				}
+			}
+			return av
+		}
+	}
+	return a
+}
+
+// contains returns true if the values contain the value. Maps and slices are
+// never contained because they are not comparable.
+func contains(values []interface{}, v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	for _, e := range values {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// copyValue returns a deep copy of a decoded JSON value.
+func copyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(x))
+		for i, e := range x {
+			s[i] = copyValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,138 @@
+package metricsaggregator_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/metricsaggregator"
+	"github.com/arjantop/cuirass/metricsstream"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newInstance starts a stream server of an executor that executed the command
+// with the results.
+func newInstance(results ...error) *httptest.Server {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.Cmd.slo.target", "99.5")
+	ex := cuirass.NewExecutor(cfg)
+	for _, result := range results {
+		err := result
+		ex.Exec(context.Background(), cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+			return "ok", err
+		}).Group("Group").Build())
+	}
+	return httptest.NewServer(metricsstream.NewMetricsStream(ex))
+}
+
+// waitForRecord waits until the aggregator merged the record from the number
+// of hosts.
+func waitForRecord(a *metricsaggregator.Aggregator, t, name string, hosts int) map[string]interface{} {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, r := range a.Records() {
+			if r["type"] == t && r["name"] == name && r["reportingHosts"] == hosts {
+				return r
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestAggregatorMergesStreams(t *testing.T) {
+	s1 := newInstance(nil, nil)
+	defer s1.Close()
+	s2 := newInstance(nil, errors.New("foo"))
+	defer s2.Close()
+	a := metricsaggregator.NewAggregator(s1.URL+"?delay=100", s2.URL+"?delay=100")
+	a.Start()
+	defer a.Stop()
+
+	r := waitForRecord(a, "HystrixCommand", "Cmd", 2)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, "Group", r["group"])
+		assert.Equal(t, 3.0, r["rollingCountSuccess"])
+		assert.Equal(t, 1.0, r["rollingCountFailure"])
+		assert.Equal(t, 4.0, r["requestCount"])
+		assert.Equal(t, 25, r["errorPercentage"])
+		assert.Equal(t, 40.0, r["propertyValue_circuitBreakerRequestVolumeThreshold"])
+		assert.Equal(t, false, r["isCircuitBreakerOpen"])
+		assert.Contains(t, r["latencyExecute"], "99")
+	}
+	assert.NotNil(t, waitForRecord(a, "HystrixThreadPool", "Group", 2))
+}
+
+func TestAggregatorPassesThroughSLOsPerInstance(t *testing.T) {
+	s1 := newInstance(nil)
+	defer s1.Close()
+	s2 := newInstance(nil)
+	defer s2.Close()
+	a := metricsaggregator.NewAggregator(s1.URL+"?delay=100", s2.URL+"?delay=100")
+	a.Start()
+	defer a.Stop()
+	assert.NotNil(t, waitForRecord(a, "HystrixCommand", "Cmd", 2))
+	assert.NotNil(t, waitForRecord(a, "CuirassSLO", "Cmd", 1))
+
+	hosts := make([]interface{}, 0)
+	for _, r := range a.Records() {
+		if r["type"] == "CuirassSLO" {
+			assert.Equal(t, 99.5, r["target"])
+			assert.Equal(t, 1, r["reportingHosts"])
+			hosts = append(hosts, r["host"])
+		}
+	}
+	assert.ElementsMatch(t, []interface{}{s1.URL + "?delay=100", s2.URL + "?delay=100"}, hosts)
+}
+
+func TestAggregatorSubscribesToDuplicateUrlsOnce(t *testing.T) {
+	s := newInstance(nil)
+	defer s.Close()
+	a := metricsaggregator.NewAggregator(s.URL+"?delay=100", s.URL+"?delay=100")
+	a.Start()
+	defer a.Stop()
+
+	r := waitForRecord(a, "HystrixCommand", "Cmd", 1)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, 1.0, r["rollingCountSuccess"])
+	}
+}
+
+func TestAggregatorDropsDisconnectedInstances(t *testing.T) {
+	s1 := newInstance(nil)
+	defer s1.Close()
+	s2 := newInstance(nil)
+	a := metricsaggregator.NewAggregator(s1.URL+"?delay=100", s2.URL+"?delay=100")
+	a.SetRetryInterval(50 * time.Millisecond)
+	a.Start()
+	defer a.Stop()
+	assert.NotNil(t, waitForRecord(a, "HystrixCommand", "Cmd", 2))
+
+	s2.CloseClientConnections()
+	s2.Close()
+	assert.NotNil(t, waitForRecord(a, "HystrixCommand", "Cmd", 1))
+}
+
+func TestStreamServesMergedRecords(t *testing.T) {
+	s1 := newInstance(nil)
+	defer s1.Close()
+	s2 := newInstance(nil)
+	defer s2.Close()
+	a := metricsaggregator.NewAggregator(s1.URL+"?delay=100", s2.URL+"?delay=100")
+	a.Start()
+	defer a.Stop()
+	assert.NotNil(t, waitForRecord(a, "HystrixCommand", "Cmd", 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	metricsaggregator.NewStream(a).ServeHTTP(w, httptest.NewRequest("GET", "/cuirass.stream", nil).WithContext(ctx))
+	assert.Equal(t, "text/event-stream;charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"name":"Cmd"`)
+	assert.Contains(t, w.Body.String(), `"reportingHosts":2`)
+	assert.Contains(t, w.Body.String(), `"rollingCountSuccess":2`)
+}
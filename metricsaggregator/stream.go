@@ -0,0 +1,54 @@
+package metricsaggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/arjantop/cuirass/metricsstream"
+)
+
+// Stream is a http.Handler streaming the merged records of an aggregator as
+// server-sent events in the format of the Hystrix metrics stream. The delay
+// query parameter sets the delay between updates in milliseconds, as in
+// metricsstream.MetricsStream.
+type Stream struct {
+	aggregator *Aggregator
+}
+
+// NewStream constructs a new Stream of the merged records of the aggregator.
+func NewStream(a *Aggregator) *Stream {
+	return &Stream{
+		aggregator: a,
+	}
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delay, err := metricsstream.ParseDelay(r.URL.Query().Get("delay"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metricsstream.ServeEvents(w, r, delay, s.writeRecords)
+}
+
+// writeRecords writes all the merged records. If there are no records a ping
+// is written instead.
+func (s *Stream) writeRecords(w io.Writer) error {
+	records := s.aggregator.Records()
+	if len(records) == 0 {
+		_, err := fmt.Fprintln(w, "ping: ")
+		return err
+	}
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Package metricsjson serves the snapshot of command metrics of an executor as
+// JSON for consumers that poll the metrics instead of using the stream.
+package metricsjson
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/arjantop/cuirass"
+)
+
+// Handler is a http.Handler rendering the metrics snapshot of all executed
+// commands as a JSON array.
+type Handler struct {
+	executor *cuirass.CommandExecutor
+}
+
+// NewHandler constructs a new Handler for the metrics of the executor.
+func NewHandler(e *cuirass.CommandExecutor) *Handler {
+	return &Handler{
+		executor: e,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(h.executor.Metrics().Snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
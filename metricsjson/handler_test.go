@@ -0,0 +1,54 @@
+package metricsjson_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/metricsjson"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestHandlerRendersSnapshot(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.Cmd.circuitbreaker.requestVolumeThreshold", "7")
+	ex := cuirass.NewExecutor(cfg)
+	ok := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Group("Group").Build()
+	failing := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("foo")
+	}).Group("Group").Build()
+	h := metricsjson.NewHandler(ex)
+	ex.Exec(context.Background(), ok)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics.json", nil))
+	ex.Exec(context.Background(), failing)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics.json", nil))
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	var snapshots []metrics.CommandSnapshot
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshots)) && assert.Len(t, snapshots, 1) {
+		s := snapshots[0]
+		assert.Equal(t, "Cmd", s.Name)
+		assert.Equal(t, "Group", s.Group)
+		assert.Equal(t, 2, s.RequestCount)
+		assert.Equal(t, 1, s.ErrorCount)
+		assert.Equal(t, 50, s.ErrorPercentage)
+		assert.Equal(t, 1, s.RollingCounts["SUCCESS"])
+		assert.Equal(t, int64(1), s.CumulativeCounts["FAILURE"])
+		assert.Len(t, s.LatencyExecute.Percentiles, len(metrics.SnapshotPercentiles))
+		assert.Contains(t, s.LatencyTotal.Percentiles, "99.5")
+		assert.False(t, s.CircuitBreakerOpen)
+		assert.Equal(t, float64(7), s.Properties["circuitBreakerRequestVolumeThreshold"])
+		if assert.Len(t, s.Windows, len(metrics.Windows)) {
+			assert.Equal(t, 1, s.Windows[0].RequestCount, "Windows count executions after the first read")
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package metricsprometheus exposes the command metrics of an executor in
+// the Prometheus text exposition format.
+package metricsprometheus
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+)
+
+// Percentiles of the execution time rendered for every command.
+var percentiles = []float64{0, 25, 50, 75, 90, 95, 99, 99.5, 100}
+
+// Handler is a http.Handler rendering the metrics of all executed commands.
+type Handler struct {
+	executor *cuirass.CommandExecutor
+}
+
+// NewHandler constructs a new Handler for the metrics of the executor.
+func NewHandler(e *cuirass.CommandExecutor) *Handler {
+	return &Handler{
+		executor: e,
+	}
+}
+
+// ServeHTTP renders the metrics. The window query parameter selects the
+// statistical window of the rolling metrics by its size, for example
+// ?window=5m. By default the rolling statistical window of commands is used.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	window, err := parseWindow(r.URL.Query().Get("window"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b bytes.Buffer
+	h.writeMetrics(&b, window)
+	w.Write(b.Bytes())
+}
+
+// parseWindow parses the size of the statistical window. Empty value selects
+// the rolling statistical window.
+func parseWindow(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	for _, w := range metrics.Windows {
+		if w == size {
+			return size, nil
+		}
+	}
+	return 0, errors.New("unknown window: " + s)
+}
+
+// writeMetrics writes all the metric families to the buffer. Rolling metrics
+// are taken from the statistical window of the given size.
+func (h *Handler) writeMetrics(b *bytes.Buffer, window time.Duration) {
+	all := h.executor.Metrics().All()
+	sort.Sort(byName(all))
+	windows := make([]*metrics.WindowMetrics, len(all))
+	for i, m := range all {
+		windows[i], _ = m.Window(window)
+	}
+
+	writeHeader(b, "cuirass_command_rolling_events", "gauge",
+		"Number of execution events in the rolling statistical window.")
+	for i, m := range all {
+		for _, e := range requestlog.ExecutionEvents {
+			writeSample(b, "cuirass_command_rolling_events", commandLabels(m, "event", eventLabel(e)), float64(windows[i].RollingSum(e)))
+		}
+	}
+
+	writeHeader(b, "cuirass_command_events_total", "counter",
+		"Number of execution events since the start of the process.")
+	for _, m := range all {
+		for _, e := range requestlog.ExecutionEvents {
+			writeSample(b, "cuirass_command_events_total", commandLabels(m, "event", eventLabel(e)), float64(m.CumulativeSum(e)))
+		}
+	}
+
+	writeHeader(b, "cuirass_command_rolling_errors", "gauge",
+		"Number of failures by the error label in the rolling statistical window of the command.")
+	for _, m := range all {
+		for _, l := range m.ErrorLabels() {
+			writeSample(b, "cuirass_command_rolling_errors", commandLabels(m, "error", l), float64(m.RollingErrorCount(l)))
+		}
+	}
+
+	writeHeader(b, "cuirass_command_errors_total", "counter",
+		"Number of failures by the error label since the start of the process.")
+	for _, m := range all {
+		for _, l := range m.ErrorLabels() {
+			writeSample(b, "cuirass_command_errors_total", commandLabels(m, "error", l), float64(m.CumulativeErrorCount(l)))
+		}
+	}
+
+	writeHeader(b, "cuirass_command_execution_seconds", "summary",
+		"Command execution time since the start of the process.")
+	for _, m := range all {
+		for i, v := range m.CumulativeExecutionTimePercentiles(percentiles...) {
+			writeSample(b, "cuirass_command_execution_seconds",
+				commandLabels(m, "quantile", formatFloat(percentiles[i]/100)),
+				v.Seconds())
+		}
+		writeSample(b, "cuirass_command_execution_seconds_sum", commandLabels(m), m.CumulativeExecutionTimeSum().Seconds())
+		writeSample(b, "cuirass_command_execution_seconds_count", commandLabels(m), float64(m.CumulativeExecutionTimeCount()))
+	}
+
+	writeHeader(b, "cuirass_command_error_percentage", "gauge",
+		"Percentage of failed requests in the rolling statistical window.")
+	for i, m := range all {
+		writeSample(b, "cuirass_command_error_percentage", commandLabels(m), float64(windows[i].ErrorPercentage()))
+	}
+
+	writeHeader(b, "cuirass_command_latency_seconds", "gauge",
+		"Percentiles of command execution time in the rolling statistical window.")
+	for i, m := range all {
+		for j, v := range windows[i].ExecutionTimePercentiles(percentiles...) {
+			writeSample(b, "cuirass_command_latency_seconds",
+				commandLabels(m, "quantile", formatFloat(percentiles[j]/100)),
+				v.Seconds())
+		}
+	}
+
+	writeHeader(b, "cuirass_command_latency_mean_seconds", "gauge",
+		"Mean command execution time in the rolling statistical window.")
+	for i, m := range all {
+		writeSample(b, "cuirass_command_latency_mean_seconds", commandLabels(m), windows[i].ExecutionTimeMean().Seconds())
+	}
+
+	writeHeader(b, "cuirass_command_request_rate", "gauge",
+		"Number of requests per second averaged over the rolling statistical window.")
+	for i, m := range all {
+		writeSample(b, "cuirass_command_request_rate", commandLabels(m), windows[i].RequestRate())
+	}
+
+	writeHeader(b, "cuirass_command_circuit_open", "gauge",
+		"Whether the circuit breaker of the command is open (1) or closed (0).")
+	for _, m := range all {
+		writeSample(b, "cuirass_command_circuit_open", commandLabels(m),
+			boolValue(h.executor.IsCircuitBreakerOpen(m.CommandName())))
+	}
+
+	writeHeader(b, "cuirass_command_key_circuit_open", "gauge",
+		"Whether the circuit breaker of the command for the breaker key is open (1) or closed (0).")
+	for _, m := range all {
+		for _, key := range h.executor.CircuitBreakerKeys(m.CommandName()) {
+			writeSample(b, "cuirass_command_key_circuit_open", commandLabels(m, "key", key),
+				boolValue(h.executor.IsCircuitBreakerOpenForKey(m.CommandName(), key)))
+		}
+	}
+
+	writeHeader(b, "cuirass_command_concurrent_executions", "gauge",
+		"Number of executions of the command currently in flight.")
+	for _, m := range all {
+		writeSample(b, "cuirass_command_concurrent_executions", commandLabels(m), float64(m.CurrentConcurrentExecutionCount()))
+	}
+
+	writeHeader(b, "cuirass_command_rolling_max_concurrent_executions", "gauge",
+		"Maximum number of concurrent executions in the rolling statistical window.")
+	for _, m := range all {
+		writeSample(b, "cuirass_command_rolling_max_concurrent_executions", commandLabels(m),
+			float64(m.RollingMaxConcurrentExecutionCount()))
+	}
+
+	writeHeader(b, "cuirass_dropped_command_executions_total", "counter",
+		"Number of executions of commands not tracked because the limit of tracked commands was reached.")
+	writeSample(b, "cuirass_dropped_command_executions_total", "", float64(h.executor.Metrics().DroppedExecutionCount()))
+
+	writeHeader(b, "cuirass_dropped_commands_total", "counter",
+		"Number of distinct commands not tracked because the limit of tracked commands was reached.")
+	writeSample(b, "cuirass_dropped_commands_total", "", float64(h.executor.Metrics().DroppedCommandCount()))
+
+	groups := commandGroups(all)
+	writeHeader(b, "cuirass_group_circuit_open", "gauge",
+		"Whether the circuit breaker of the group is open (1) or closed (0).")
+	for _, g := range groups {
+		writeSample(b, "cuirass_group_circuit_open", labels("group", g),
+			boolValue(h.executor.IsGroupCircuitBreakerOpen(g)))
+	}
+
+	writeHeader(b, "cuirass_group_semaphore_in_use", "gauge",
+		"Number of acquired execution semaphore permits of the group.")
+	for _, g := range groups {
+		if s, ok := h.executor.Semaphore(g); ok {
+			writeSample(b, "cuirass_group_semaphore_in_use", labels("group", g), float64(s.Used()))
+		}
+	}
+
+	writeHeader(b, "cuirass_group_semaphore_capacity", "gauge",
+		"Capacity of the execution semaphore of the group.")
+	for _, g := range groups {
+		if s, ok := h.executor.Semaphore(g); ok {
+			writeSample(b, "cuirass_group_semaphore_capacity", labels("group", g), float64(s.Capacity()))
+		}
+	}
+
+	writeHeader(b, "cuirass_group_rolling_max_concurrent_executions", "gauge",
+		"Maximum number of concurrent executions of the group in the rolling statistical window.")
+	for _, g := range groups {
+		writeSample(b, "cuirass_group_rolling_max_concurrent_executions", labels("group", g),
+			float64(h.executor.Metrics().ForGroup(g).RollingMaxConcurrentExecutionCount()))
+	}
+
+	writeHeader(b, "cuirass_command_property", "gauge",
+		"Effective value of the command property. Booleans are 1 or 0.")
+	for _, m := range all {
+		props := h.executor.CommandProperties(m.CommandName(), m.CommandGroup())
+		for _, p := range propertyValues(props) {
+			writeSample(b, "cuirass_command_property", commandLabels(m, "property", p.name), p.value)
+		}
+	}
+}
+
+type propertyValue struct {
+	name  string
+	value float64
+}
+
+// propertyValues returns the current values of command properties sorted by
+// their names. Booleans are converted to 1 or 0.
+func propertyValues(p *cuirass.CommandProperties) []propertyValue {
+	values := make([]propertyValue, 0)
+	for name, v := range p.Values() {
+		switch x := v.(type) {
+		case bool:
+			values = append(values, propertyValue{name, boolValue(x)})
+		case int:
+			values = append(values, propertyValue{name, float64(x)})
+		case int64:
+			values = append(values, propertyValue{name, float64(x)})
+		case float64:
+			values = append(values, propertyValue{name, x})
+		}
+	}
+	sort.Sort(byPropertyName(values))
+	return values
+}
+
+type byPropertyName []propertyValue
+
+func (s byPropertyName) Len() int           { return len(s) }
+func (s byPropertyName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byPropertyName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// commandGroups returns the sorted unique groups of the commands.
+func commandGroups(all []*metrics.CommandMetrics) []string {
+	seen := make(map[string]bool)
+	groups := make([]string, 0)
+	for _, m := range all {
+		if g := m.CommandGroup(); !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func writeHeader(b *bytes.Buffer, name, typ, help string) {
+	b.WriteString("# HELP " + name + " " + help + "\n")
+	b.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(b *bytes.Buffer, name, labels string, value float64) {
+	b.WriteString(name)
+	b.WriteString(labels)
+	b.WriteString(" ")
+	b.WriteString(formatFloat(value))
+	b.WriteString("\n")
+}
+
+// commandLabels returns the command and group labels followed by the additional
+// label name and value pairs.
+func commandLabels(m *metrics.CommandMetrics, nameValues ...string) string {
+	return labels(append([]string{"command", m.CommandName(), "group", m.CommandGroup()}, nameValues...)...)
+}
+
+// labels formats the label name and value pairs.
+func labels(nameValues ...string) string {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(nameValues[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(nameValues[i+1]))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func eventLabel(e requestlog.ExecutionEvent) string {
+	return strings.ToLower(e.String())
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+type byName []*metrics.CommandMetrics
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].CommandName() < s[j].CommandName() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,102 @@
+package metricsprometheus_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/metricsprometheus"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestHandlerRendersCommandMetrics(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.Cmd.circuitbreaker.requestVolumeThreshold", "7")
+	ex := cuirass.NewExecutor(cfg)
+	cmd := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Group(`Gr"oup`).Build()
+	ex.Exec(context.Background(), cmd)
+	ex.Exec(context.Background(), cmd)
+
+	w := httptest.NewRecorder()
+	metricsprometheus.NewHandler(ex).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(t, body, "# TYPE cuirass_command_rolling_events gauge\n")
+	assert.Contains(t, body, `cuirass_command_rolling_events{command="Cmd",group="Gr\"oup",event="success"} 2`+"\n")
+	assert.Contains(t, body, `cuirass_command_rolling_events{command="Cmd",group="Gr\"oup",event="failure"} 0`+"\n")
+	assert.Contains(t, body, "# TYPE cuirass_command_events_total counter\n")
+	assert.Contains(t, body, `cuirass_command_events_total{command="Cmd",group="Gr\"oup",event="success"} 2`+"\n")
+	assert.Contains(t, body, "# TYPE cuirass_command_execution_seconds summary\n")
+	assert.Contains(t, body, `cuirass_command_execution_seconds_count{command="Cmd",group="Gr\"oup"} 2`+"\n")
+	assert.Contains(t, body, `cuirass_command_latency_seconds{command="Cmd",group="Gr\"oup",quantile="0.995"} `)
+	assert.Contains(t, body, `cuirass_command_circuit_open{command="Cmd",group="Gr\"oup"} 0`+"\n")
+	assert.Contains(t, body, `cuirass_command_concurrent_executions{command="Cmd",group="Gr\"oup"} 0`+"\n")
+	assert.Contains(t, body, `cuirass_command_rolling_max_concurrent_executions{command="Cmd",group="Gr\"oup"} 1`+"\n")
+	assert.Contains(t, body, `cuirass_group_rolling_max_concurrent_executions{group="Gr\"oup"} 1`+"\n")
+	assert.Contains(t, body, `cuirass_group_circuit_open{group="Gr\"oup"} 0`+"\n")
+	assert.Contains(t, body, `cuirass_group_semaphore_in_use{group="Gr\"oup"} 0`+"\n")
+	assert.Contains(t, body, `cuirass_group_semaphore_capacity{group="Gr\"oup"} 100`+"\n")
+	assert.Contains(t, body, `cuirass_command_property{command="Cmd",group="Gr\"oup",property="circuitBreakerRequestVolumeThreshold"} 7`+"\n")
+	assert.Contains(t, body, `cuirass_command_property{command="Cmd",group="Gr\"oup",property="circuitBreakerLatencyPercentile"} 99`+"\n")
+	assert.Contains(t, body, `cuirass_command_property{command="Cmd",group="Gr\"oup",property="groupCircuitBreakerEnabled"} 0`+"\n")
+	assert.Contains(t, body, `cuirass_command_property{command="Cmd",group="Gr\"oup",property="sloTarget"} 0`+"\n")
+}
+
+func TestHandlerRendersKeyedCircuitBreakers(t *testing.T) {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	for _, key := range []string{"host2", "host1"} {
+		ex.Exec(context.Background(), cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+			return "ok", nil
+		}).BreakerKey(key).Build())
+	}
+
+	w := httptest.NewRecorder()
+	metricsprometheus.NewHandler(ex).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, `cuirass_command_key_circuit_open{command="Cmd",group="Cmd",key="host1"} 0`+"\n"+
+		`cuirass_command_key_circuit_open{command="Cmd",group="Cmd",key="host2"} 0`+"\n")
+}
+
+func TestHandlerSelectsWindow(t *testing.T) {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	cmd := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Build()
+	h := metricsprometheus.NewHandler(ex)
+	ex.Exec(context.Background(), cmd)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics?window=5m", nil))
+	ex.Exec(context.Background(), cmd)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics?window=5m", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `cuirass_command_rolling_events{command="Cmd",group="Cmd",event="success"} 1`+"\n")
+	assert.Contains(t, w.Body.String(), `cuirass_command_request_rate{command="Cmd",group="Cmd"} 0.0033333333333333335`+"\n")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics?window=7m", nil))
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestHandlerRendersErrorLabels(t *testing.T) {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	ex.SetErrorClassifier(func(err error) string {
+		return "refused"
+	})
+	cmd := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	}).Build()
+	ex.Exec(context.Background(), cmd)
+
+	w := httptest.NewRecorder()
+	metricsprometheus.NewHandler(ex).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `cuirass_command_rolling_errors{command="Cmd",group="Cmd",error="refused"} 1`+"\n")
+	assert.Contains(t, w.Body.String(), `cuirass_command_errors_total{command="Cmd",group="Cmd",error="refused"} 1`+"\n")
+}
@@ -0,0 +1,116 @@
+// Package metricspublisher contains metrics.Publisher implementations for
+// common monitoring backends.
+package metricspublisher
+
+import (
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+)
+
+// Percentiles of the execution time that are published.
+var percentiles = []float64{50, 90, 99}
+
+// ExpvarPublisher publishes the command metrics as expvar variables.
+// Metrics of every command are published as a map of integer values under the
+// command name. Execution times are in milliseconds. They are computed when
+// the variables are read, so publishing after every update does not compute
+// the percentiles. Variables of evicted commands are removed.
+type ExpvarPublisher struct {
+	vars     *expvar.Map
+	commands map[string]*expvar.Map
+	lock     *sync.Mutex
+}
+
+// NewExpvarPublisher constructs a new ExpvarPublisher publishing the metrics
+// as an expvar map with the given name. If a map with the name already exists,
+// eg. from a previous publisher, it is reused. Like expvar.NewMap it panics if
+// a variable with the name exists and is not a map.
+func NewExpvarPublisher(name string) *ExpvarPublisher {
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+	return &ExpvarPublisher{
+		vars:     vars,
+		commands: make(map[string]*expvar.Map),
+		lock:     new(sync.Mutex),
+	}
+}
+
+func (p *ExpvarPublisher) Publish(all []*metrics.CommandMetrics) {
+	for _, m := range all {
+		vars := p.commandVars(m)
+		setInt(vars, "requestCount", int64(m.TotalRequests()))
+		setInt(vars, "errorCount", int64(m.ErrorCount()))
+		setInt(vars, "errorPercentage", int64(m.ErrorPercentage()))
+		for _, e := range requestlog.ExecutionEvents {
+			setInt(vars, "rollingCount"+eventName(e), int64(m.RollingSum(e)))
+		}
+	}
+}
+
+// RemoveCommand removes the variables of the evicted command.
+func (p *ExpvarPublisher) RemoveCommand(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.commands[name]; ok {
+		delete(p.commands, name)
+		p.vars.Delete(name)
+	}
+}
+
+// commandVars returns the map of the variables for the command and creates it
+// if it does not exist yet.
+func (p *ExpvarPublisher) commandVars(m *metrics.CommandMetrics) *expvar.Map {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vars, ok := p.commands[m.CommandName()]
+	if !ok {
+		vars = new(expvar.Map).Init()
+		vars.Set("latencyMean", expvar.Func(func() interface{} {
+			return toMilliseconds(m.ExecutionTimeMean())
+		}))
+		for _, pct := range percentiles {
+			pct := pct
+			vars.Set("latency"+percentileName(pct), expvar.Func(func() interface{} {
+				return toMilliseconds(m.ExecutionTimePercentile(pct))
+			}))
+		}
+		p.vars.Set(m.CommandName(), vars)
+		p.commands[m.CommandName()] = vars
+	}
+	return vars
+}
+
+func setInt(m *expvar.Map, key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	m.Set(key, v)
+}
+
+// eventName returns a camel case name of the event, eg. ShortCircuited for
+// SHORT_CIRCUITED.
+func eventName(e requestlog.ExecutionEvent) string {
+	parts := strings.Split(strings.ToLower(e.String()), "_")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// percentileName returns the name of the percentile, eg. P99 or P99_5.
+func percentileName(p float64) string {
+	return "P" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+func toMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
@@ -0,0 +1,76 @@
+package metricspublisher_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/metricspublisher"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/arjantop/cuirass/util"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestingExecutionMetrics() *metrics.ExecutionMetrics {
+	f := vaquita.NewPropertyFactory(vaquita.NewEmptyMapConfig())
+	return metrics.NewExecutionMetrics(&metrics.MetricsProperties{
+		RollingPercentileBucketSize: f.GetIntProperty("percentileBucketSize", 100),
+		PublisherFlushInterval:      f.GetDurationProperty("flushInterval", 0, time.Millisecond),
+	}, util.NewClock())
+}
+
+func TestExpvarPublisher(t *testing.T) {
+	em := newTestingExecutionMetrics()
+	p := metricspublisher.NewExpvarPublisher("cuirass_test")
+	em.AddPublisher(p)
+	em.Update("cmd", 10*time.Millisecond, requestlog.Success)
+	em.Update("cmd", 20*time.Millisecond, requestlog.ShortCircuited, requestlog.FallbackSuccess)
+	// Removing the publisher publishes the queued updates.
+	em.RemovePublisher(p)
+
+	var vars map[string]map[string]int
+	assert.Eventually(t, func() bool {
+		json.Unmarshal([]byte(expvar.Get("cuirass_test").String()), &vars)
+		return vars["cmd"]["requestCount"] == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, vars["cmd"]["requestCount"])
+	assert.Equal(t, 1, vars["cmd"]["errorCount"])
+	assert.Equal(t, 50, vars["cmd"]["errorPercentage"])
+	assert.Equal(t, 1, vars["cmd"]["rollingCountSuccess"])
+	assert.Equal(t, 1, vars["cmd"]["rollingCountShortCircuited"])
+	assert.Equal(t, 1, vars["cmd"]["rollingCountFallbackSuccess"])
+	assert.Equal(t, 0, vars["cmd"]["rollingCountTimeout"])
+	assert.Equal(t, 10, vars["cmd"]["latencyMean"])
+	assert.Equal(t, 10, vars["cmd"]["latencyP99"])
+}
+
+func TestExpvarPublisherReusesMap(t *testing.T) {
+	p1 := metricspublisher.NewExpvarPublisher("cuirass_test_reused")
+	p2 := metricspublisher.NewExpvarPublisher("cuirass_test_reused")
+	em := newTestingExecutionMetrics()
+	em.Update("cmd", 0, requestlog.Success)
+	p1.Publish(em.All())
+	p2.Publish(em.All())
+	assert.Contains(t, expvar.Get("cuirass_test_reused").String(), `"requestCount": 1`)
+}
+
+func TestExpvarPublisherRemovesEvictedCommands(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("metrics.publisher.flushIntervalInMilliseconds", "3600000")
+	cfg.SetProperty("metrics.commandIdleTimeoutInMilliseconds", "60000")
+	clock := util.NewTestableClock(time.Now())
+	em := metrics.NewExecutionMetrics(metrics.NewMetricsProperties(cfg), clock)
+	p := metricspublisher.NewExpvarPublisher("cuirass_test_evicted")
+	em.AddPublisher(p)
+	defer em.RemovePublisher(p)
+	em.Update("cmd", 10*time.Millisecond, requestlog.Success)
+	p.Publish(em.All())
+	assert.Contains(t, expvar.Get("cuirass_test_evicted").String(), `"latencyP99": 10`)
+
+	clock.Add(2 * time.Minute)
+	assert.Equal(t, 1, em.EvictIdle())
+	assert.NotContains(t, expvar.Get("cuirass_test_evicted").String(), `"cmd"`)
+}
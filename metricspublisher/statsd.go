@@ -0,0 +1,115 @@
+package metricspublisher
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+)
+
+// maxPacketSize is the maximum size of a single UDP packet. It is chosen so
+// packets fit into the common Ethernet MTU.
+const maxPacketSize = 1432
+
+// StatsdPublisher publishes the command metrics as gauges to a StatsD or
+// DogStatsD server over UDP.
+// Metrics are sent on a best effort basis, write errors are ignored.
+type StatsdPublisher struct {
+	conn   net.Conn
+	prefix string
+	tagged bool
+}
+
+// NewStatsdPublisher constructs a new StatsdPublisher sending the metrics to
+// the StatsD server at addr. Metric names are prefixed with the prefix, group
+// and command name, eg. prefix.group.command.request_count.
+func NewStatsdPublisher(addr, prefix string) (*StatsdPublisher, error) {
+	return newStatsdPublisher(addr, prefix, false)
+}
+
+// NewDogStatsdPublisher constructs a new StatsdPublisher sending the metrics to
+// the DogStatsD server at addr. Metric names are prefixed with the prefix and
+// the command and group are sent as tags, eg.
+// prefix.request_count|#command:command,group:group.
+func NewDogStatsdPublisher(addr, prefix string) (*StatsdPublisher, error) {
+	return newStatsdPublisher(addr, prefix, true)
+}
+
+func newStatsdPublisher(addr, prefix string, tagged bool) (*StatsdPublisher, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdPublisher{
+		conn:   conn,
+		prefix: prefix,
+		tagged: tagged,
+	}, nil
+}
+
+// Close closes the connection to the server.
+func (p *StatsdPublisher) Close() error {
+	return p.conn.Close()
+}
+
+func (p *StatsdPublisher) Publish(all []*metrics.CommandMetrics) {
+	var packet bytes.Buffer
+	for _, m := range all {
+		for _, line := range p.lines(m) {
+			if packet.Len() > 0 && packet.Len()+len(line)+1 > maxPacketSize {
+				p.conn.Write(packet.Bytes())
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	if packet.Len() > 0 {
+		p.conn.Write(packet.Bytes())
+	}
+}
+
+// lines returns the gauges of the command metrics in the StatsD line format.
+func (p *StatsdPublisher) lines(m *metrics.CommandMetrics) []string {
+	prefix, suffix := p.prefix, ""
+	if p.tagged {
+		suffix = "|#command:" + sanitizeTag(m.CommandName()) + ",group:" + sanitizeTag(m.CommandGroup())
+	} else {
+		prefix += "." + sanitizeName(m.CommandGroup()) + "." + sanitizeName(m.CommandName())
+	}
+	gauge := func(name string, value int64) string {
+		return prefix + "." + name + ":" + strconv.FormatInt(value, 10) + "|g" + suffix
+	}
+	lines := []string{
+		gauge("request_count", int64(m.TotalRequests())),
+		gauge("error_count", int64(m.ErrorCount())),
+		gauge("error_percentage", int64(m.ErrorPercentage())),
+	}
+	for _, e := range requestlog.ExecutionEvents {
+		lines = append(lines, gauge("rolling_count."+strings.ToLower(e.String()), int64(m.RollingSum(e))))
+	}
+	lines = append(lines, gauge("latency.mean", toMilliseconds(m.ExecutionTimeMean())))
+	for i, v := range m.ExecutionTimePercentiles(percentiles...) {
+		lines = append(lines, gauge("latency."+strings.ToLower(percentileName(percentiles[i])), toMilliseconds(v)))
+	}
+	return lines
+}
+
+// statsdReplacer replaces the characters with a special meaning in the
+// StatsD line format.
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+// sanitizeName makes the value safe to be used as a single metric name segment.
+func sanitizeName(s string) string {
+	return strings.Replace(statsdReplacer.Replace(s), ".", "_", -1)
+}
+
+// sanitizeTag makes the value safe to be used as a tag value.
+func sanitizeTag(s string) string {
+	return statsdReplacer.Replace(s)
+}
@@ -0,0 +1,75 @@
+package metricspublisher_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/metricspublisher"
+	"github.com/arjantop/cuirass/requestlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// receiveLines reads the packets until n lines are received.
+func receiveLines(t *testing.T, conn *net.UDPConn, n int) []string {
+	lines := make([]string, 0, n)
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < n {
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.Split(string(buf[:size]), "\n")...)
+	}
+	return lines
+}
+
+func publishTestMetrics(p metrics.Publisher) {
+	em := newTestingExecutionMetrics()
+	em.Register("cmd.get", "Backend", nil)
+	em.AddPublisher(p)
+	defer em.RemovePublisher(p)
+	em.Update("cmd.get", 15*time.Millisecond, requestlog.Success)
+}
+
+func TestStatsdPublisher(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	p, err := metricspublisher.NewStatsdPublisher(conn.LocalAddr().String(), "cuirass")
+	assert.Nil(t, err)
+	defer p.Close()
+
+	publishTestMetrics(p)
+	lines := receiveLines(t, conn, 16)
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.request_count:1|g")
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.error_count:0|g")
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.rolling_count.success:1|g")
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.rolling_count.short_circuited:0|g")
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.latency.mean:15|g")
+	assert.Contains(t, lines, "cuirass.Backend.cmd_get.latency.p99:15|g")
+}
+
+func TestDogStatsdPublisher(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	p, err := metricspublisher.NewDogStatsdPublisher(conn.LocalAddr().String(), "cuirass")
+	assert.Nil(t, err)
+	defer p.Close()
+
+	publishTestMetrics(p)
+	lines := receiveLines(t, conn, 16)
+	assert.Contains(t, lines, "cuirass.request_count:1|g|#command:cmd.get,group:Backend")
+	assert.Contains(t, lines, "cuirass.rolling_count.success:1|g|#command:cmd.get,group:Backend")
+	assert.Contains(t, lines, "cuirass.latency.p50:15|g|#command:cmd.get,group:Backend")
+}
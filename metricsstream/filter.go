@@ -0,0 +1,132 @@
+package metricsstream
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/arjantop/cuirass/metrics"
+	"github.com/arjantop/cuirass/requestlog"
+)
+
+// filter selects the commands written to a stream. Commands are selected by
+// the command query parameters with their names, the group query parameters
+// with their groups and the match query parameters with patterns of their
+// names. In a pattern * matches any sequence of characters, including none,
+// and every other character matches itself, so User* selects both UserGet and
+// User/List. A command is selected if it matches any of the parameters and
+// all commands are selected if there are none.
+// If the changed query parameter is true only commands whose metrics changed
+// since the previous update are selected.
+type filter struct {
+	commands    map[string]bool
+	groups      map[string]bool
+	patterns    []string
+	changedOnly bool
+	// last holds the state of the commands written in the previous update.
+	last map[string]commandState
+}
+
+// commandState is the state of the command metrics used for detecting changes.
+type commandState struct {
+	cumulative int64
+	rolling    int
+	concurrent int
+	open       bool
+}
+
+func parseFilter(q url.Values) (*filter, error) {
+	f := &filter{
+		commands: make(map[string]bool),
+		groups:   make(map[string]bool),
+		patterns: q["match"],
+		last:     make(map[string]commandState),
+	}
+	for _, name := range q["command"] {
+		f.commands[name] = true
+	}
+	for _, group := range q["group"] {
+		f.groups[group] = true
+	}
+	if changed := q.Get("changed"); changed != "" {
+		var err error
+		if f.changedOnly, err = strconv.ParseBool(changed); err != nil {
+			return nil, errors.New("invalid changed: " + changed)
+		}
+	}
+	return f, nil
+}
+
+// matches returns true if the command is selected by its name or group.
+func (f *filter) matches(m *metrics.CommandMetrics) bool {
+	if len(f.commands) == 0 && len(f.groups) == 0 && len(f.patterns) == 0 {
+		return true
+	}
+	if f.commands[m.CommandName()] || f.groups[m.CommandGroup()] {
+		return true
+	}
+	for _, p := range f.patterns {
+		if matchPattern(p, m.CommandName()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern returns true if the name matches the pattern where * matches any
+// sequence of characters.
+func matchPattern(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// selected returns the commands that should be written in the update.
+func (f *filter) selected(all []*metrics.CommandMetrics, isOpen func(name string) bool) []*metrics.CommandMetrics {
+	selected := make([]*metrics.CommandMetrics, 0, len(all))
+	next := make(map[string]commandState)
+	for _, m := range all {
+		if !f.matches(m) {
+			continue
+		}
+		if f.changedOnly {
+			state := stateOf(m, isOpen(m.CommandName()))
+			next[m.CommandName()] = state
+			if last, ok := f.last[m.CommandName()]; ok && last == state {
+				continue
+			}
+		}
+		selected = append(selected, m)
+	}
+	// Only the states of current commands are kept so the states of evicted
+	// commands are discarded.
+	f.last = next
+	return selected
+}
+
+func stateOf(m *metrics.CommandMetrics, open bool) commandState {
+	s := commandState{
+		concurrent: m.CurrentConcurrentExecutionCount(),
+		open:       open,
+	}
+	for _, e := range requestlog.ExecutionEvents {
+		s.cumulative += m.CumulativeSum(e)
+		s.rolling += m.RollingSum(e)
+	}
+	return s
+}
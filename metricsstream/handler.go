@@ -2,8 +2,12 @@ package metricsstream
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/arjantop/cuirass"
@@ -11,41 +15,174 @@ import (
 	"github.com/arjantop/cuirass/requestlog"
 )
 
+const (
+	// DefaultDelay is the delay between metrics updates used when the request
+	// has no delay query parameter.
+	DefaultDelay = 2000 * time.Millisecond
+	// MinDelay is the minimum delay between metrics updates a client can request.
+	MinDelay = 100 * time.Millisecond
+	// DefaultMaxConnections is the default maximum number of concurrent
+	// stream connections.
+	DefaultMaxConnections = 5
+)
+
+// PingInterval is the interval of keep-alive pings sent to clients.
+const PingInterval = 10 * time.Second
+
+// MetricsStream is a http.Handler streaming the metrics of all commands and
+// groups as server-sent events in the format of the Hystrix metrics stream.
+// The delay query parameter sets the delay between updates in milliseconds.
+// The command, group, match and changed query parameters select the commands
+// that are written, see filter.
 type MetricsStream struct {
-	executor *cuirass.CommandExecutor
+	executor       *cuirass.CommandExecutor
+	maxConnections int32
+	connections    int32
 }
 
 func NewMetricsStream(e *cuirass.CommandExecutor) *MetricsStream {
 	return &MetricsStream{
-		executor: e,
+		executor:       e,
+		maxConnections: DefaultMaxConnections,
 	}
 }
 
+// SetMaxConnections sets the maximum number of concurrent stream connections.
+// Clients over the limit are rejected with 503 Service Unavailable.
+func (h *MetricsStream) SetMaxConnections(n int) {
+	atomic.StoreInt32(&h.maxConnections, int32(n))
+}
+
+// Connections returns the number of currently open stream connections.
+func (h *MetricsStream) Connections() int {
+	return int(atomic.LoadInt32(&h.connections))
+}
+
 func (h *MetricsStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delay, err := ParseDelay(r.URL.Query().Get("delay"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer atomic.AddInt32(&h.connections, -1)
+	if atomic.AddInt32(&h.connections, 1) > atomic.LoadInt32(&h.maxConnections) {
+		http.Error(w, "too many stream connections", http.StatusServiceUnavailable)
+		return
+	}
+	ServeEvents(w, r, delay, func(w io.Writer) error {
+		return h.writeAll(w, f)
+	})
+}
+
+// ServeEvents streams server-sent events to the client until it goes away.
+// The events are written by write right away and then after every delay,
+// keep-alive pings are sent every PingInterval. Writers that do not support
+// flushing are rejected with 500 Internal Server Error.
+func ServeEvents(w http.ResponseWriter, r *http.Request, delay time.Duration, write func(w io.Writer) error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "text/event-stream;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
 
-	for {
-		metrics := h.executor.Metrics().All()
-		if len(metrics) == 0 {
-			fmt.Fprintln(w, "ping: ")
-		} else {
-			encoder := json.NewEncoder(w)
-			for _, m := range metrics {
-				w.Write([]byte("data: "))
-				h.writeMetrics(m, encoder)
-				w.Write([]byte("\n"))
-			}
+	updates := time.NewTicker(delay)
+	defer updates.Stop()
+	pings := time.NewTicker(PingInterval)
+	defer pings.Stop()
+	// Writes fail once the client went away.
+	err := write(w)
+	for err == nil {
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates.C:
+			err = write(w)
+		case <-pings.C:
+			_, err = fmt.Fprintln(w, "ping: ")
 		}
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		} else {
-			panic("Flush not supported")
+	}
+}
+
+// ParseDelay parses the delay between updates in milliseconds. Empty value
+// selects the DefaultDelay and delays shorter than MinDelay are raised to it.
+func ParseDelay(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultDelay, nil
+	}
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return 0, errors.New("invalid delay: " + s)
+	}
+	if delay := time.Duration(ms) * time.Millisecond; delay > MinDelay {
+		return delay, nil
+	}
+	return MinDelay, nil
+}
+
+// writeAll writes the metrics of the commands selected by the filter and of
+// their groups. If no command is selected a ping is written instead.
+func (h *MetricsStream) writeAll(w io.Writer, f *filter) error {
+	all := f.selected(h.executor.Metrics().All(), h.executor.IsCircuitBreakerOpen)
+	if len(all) == 0 {
+		_, err := fmt.Fprintln(w, "ping: ")
+		return err
+	}
+	ew := &errWriter{w: w}
+	encoder := json.NewEncoder(ew)
+	for _, m := range all {
+		ew.Write([]byte("data: "))
+		h.writeMetrics(m, encoder)
+		ew.Write([]byte("\n"))
+	}
+	for _, m := range all {
+		if slo, ok := m.SLO(); ok {
+			ew.Write([]byte("data: "))
+			h.writeSLO(m, slo, encoder)
+			ew.Write([]byte("\n"))
 		}
-		time.Sleep(2000 * time.Millisecond)
 	}
+	groups := make(map[string]bool)
+	for _, m := range all {
+		groups[m.CommandGroup()] = true
+	}
+	for _, g := range h.executor.Metrics().AllGroups() {
+		if !groups[g.GroupName()] {
+			continue
+		}
+		ew.Write([]byte("data: "))
+		h.writeGroupMetrics(g, encoder)
+		ew.Write([]byte("\n"))
+	}
+	return ew.err
+}
+
+// errWriter remembers the first write error and discards the following writes.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	n, w.err = w.w.Write(p)
+	return n, w.err
 }
 
+// writeMetrics writes the metrics of a command together with the effective
+// values of its properties.
 func (h *MetricsStream) writeMetrics(m *metrics.CommandMetrics, e *json.Encoder) {
+	props := h.executor.CommandProperties(m.CommandName(), m.CommandGroup())
 	metrics := struct {
 		Type                                                     string         `json:"type"`
 		Name                                                     string         `json:"name"`
@@ -58,6 +195,7 @@ func (h *MetricsStream) writeMetrics(m *metrics.CommandMetrics, e *json.Encoder)
 		RollingCountCollapsedRequests                            int            `json:"rollingCountCollapsedRequests"`
 		RollingCountExceptionsThrown                             int            `json:"rollingCountExceptionsThrown"`
 		RollingCountFailure                                      int            `json:"rollingCountFailure"`
+		RollingCountFailureByLabel                               map[string]int `json:"rollingCountFailureByLabel"`
 		RollingCountFallbackFailure                              int            `json:"rollingCountFallbackFailure"`
 		RollingCountFallbackRejection                            int            `json:"rollingCountFallbackRejection"`
 		RollingCountFallbackSuccess                              int            `json:"rollingCountFallbackSuccess"`
@@ -67,11 +205,31 @@ func (h *MetricsStream) writeMetrics(m *metrics.CommandMetrics, e *json.Encoder)
 		RollingCountSuccess                                      int            `json:"rollingCountSuccess"`
 		RollingCountThreadPoolRejected                           int            `json:"rollingCountThreadPoolRejected"`
 		RollingCountTimeout                                      int            `json:"rollingCountTimeout"`
+		CumulativeCountCollapsedRequests                         int64          `json:"cumulativeCountCollapsedRequests"`
+		CumulativeCountExceptionsThrown                          int64          `json:"cumulativeCountExceptionsThrown"`
+		CumulativeCountFailure                                   int64          `json:"cumulativeCountFailure"`
+		CumulativeCountFallbackFailure                           int64          `json:"cumulativeCountFallbackFailure"`
+		CumulativeCountFallbackRejection                         int64          `json:"cumulativeCountFallbackRejection"`
+		CumulativeCountFallbackSuccess                           int64          `json:"cumulativeCountFallbackSuccess"`
+		CumulativeCountResponseFromCache                         int64          `json:"cumulativeCountResponsesFromCache"`
+		CumulativeCountSemaphoreRejected                         int64          `json:"cumulativeCountSemaphoreRejected"`
+		CumulativeCountShortCircuited                            int64          `json:"cumulativeCountShortCircuited"`
+		CumulativeCountSuccess                                   int64          `json:"cumulativeCountSuccess"`
+		CumulativeCountThreadPoolRejected                        int64          `json:"cumulativeCountThreadPoolRejected"`
+		CumulativeCountTimeout                                   int64          `json:"cumulativeCountTimeout"`
 		CurrentConcurrentExecutionCount                          int            `json:"currentConcurrentExecutionCount"`
+		RollingMaxConcurrentExecutionCount                       int            `json:"rollingMaxConcurrentExecutionCount"`
+		RollingCountCacheLookups                                 int            `json:"rollingCountCacheLookups"`
+		RollingCountCacheMisses                                  int            `json:"rollingCountCacheMisses"`
+		RollingCountCacheStores                                  int            `json:"rollingCountCacheStores"`
+		CumulativeCountCacheLookups                              int64          `json:"cumulativeCountCacheLookups"`
+		CumulativeCountCacheStores                               int64          `json:"cumulativeCountCacheStores"`
+		CacheHitRatio                                            float64        `json:"cacheHitRatio"`
 		LatencyExecuteMean                                       int            `json:"latencyExecute_mean"`
 		LatencyExecute                                           map[string]int `json:"latencyExecute"`
 		LatencyTotalMean                                         int            `json:"latencyTotal_mean"`
 		LatencyTotal                                             map[string]int `json:"latencyTotal"`
+		PropertyCircuitBreakerEnabled                            bool           `json:"propertyValue_circuitBreakerEnabled"`
 		PropertyCircuitBreakerRequestVolumeThreshold             int            `json:"propertyValue_circuitBreakerRequestVolumeThreshold"`
 		PropertyCircuitbreakerSleepWindowInMilliseconds          int            `json:"propertyValue_circuitBreakerSleepWindowInMilliseconds"`
 		PropertyCircuitBreakerErrorThresholdPercentage           int            `json:"propertyValue_circuitBreakerErrorThresholdPercentage"`
@@ -89,7 +247,7 @@ func (h *MetricsStream) writeMetrics(m *metrics.CommandMetrics, e *json.Encoder)
 	}{
 		"HystrixCommand",
 		m.CommandName(),
-		m.CommandName(),
+		m.CommandGroup(),
 		int(time.Now().UnixNano() / 1000000),
 		h.executor.IsCircuitBreakerOpen(m.CommandName()),
 		m.ErrorPercentage(),
@@ -98,49 +256,140 @@ func (h *MetricsStream) writeMetrics(m *metrics.CommandMetrics, e *json.Encoder)
 		0,
 		0,
 		m.RollingSum(requestlog.Failure),
+		m.RollingErrorCounts(),
 		m.RollingSum(requestlog.FallbackFailure),
 		0,
 		m.RollingSum(requestlog.FallbackSuccess),
 		m.RollingSum(requestlog.ResponseFromCache),
 		0,
-		m.RollingSum(requestlog.ShortCircuited),
+		m.RollingSum(requestlog.ShortCircuited) + m.RollingSum(requestlog.GroupShortCircuited),
 		m.RollingSum(requestlog.Success),
 		m.RollingSum(requestlog.SemaphoreRejected),
 		m.RollingSum(requestlog.Timeout),
 		0,
+		0,
+		m.CumulativeSum(requestlog.Failure),
+		m.CumulativeSum(requestlog.FallbackFailure),
+		0,
+		m.CumulativeSum(requestlog.FallbackSuccess),
+		m.CumulativeSum(requestlog.ResponseFromCache),
+		m.CumulativeSum(requestlog.SemaphoreRejected),
+		m.CumulativeSum(requestlog.ShortCircuited) + m.CumulativeSum(requestlog.GroupShortCircuited),
+		m.CumulativeSum(requestlog.Success),
+		0,
+		m.CumulativeSum(requestlog.Timeout),
+		m.CurrentConcurrentExecutionCount(),
+		m.RollingMaxConcurrentExecutionCount(),
+		m.CacheLookups(),
+		m.RollingCacheSum(metrics.CacheMiss),
+		m.RollingCacheSum(metrics.CacheStore),
+		m.CumulativeCacheSum(metrics.CacheHit) + m.CumulativeCacheSum(metrics.CacheMiss),
+		m.CumulativeCacheSum(metrics.CacheStore),
+		m.CacheHitRatio(),
 		toMilliseconds(m.ExecutionTimeMean()),
-		collectExecutionPercentiles(m),
-		toMilliseconds(m.ExecutionTimeMean()),
-		collectExecutionPercentiles(m),
-		20,
-		5000,
-		50,
-		false,
-		false,
-		"THREAD",
-		1000,
-		true,
-		10,
-		10,
+		toPercentileMap(m.ExecutionTimePercentiles(percentiles...)),
+		toMilliseconds(m.TotalExecutionTimeMean()),
+		toPercentileMap(m.TotalExecutionTimePercentiles(percentiles...)),
+		props.CircuitBreaker.Enabled.Get(),
+		props.CircuitBreaker.RequestVolumeThreshold.Get(),
+		toMilliseconds(props.CircuitBreaker.SleepWindow.Get()),
+		props.CircuitBreaker.ErrorThresholdPercentage.Get(),
+		props.CircuitBreaker.ForceOpen.Get(),
+		props.CircuitBreaker.ForceClosed.Get(),
+		// Commands are isolated with semaphores and cancelled through the
+		// context on timeout.
+		"SEMAPHORE",
+		toMilliseconds(props.ExecutionTimeout.Get()),
 		true,
-		true,
-		10000,
+		props.ExecutionMaxConcurrentRequests.Get(),
+		// Fallbacks are not limited.
+		0,
+		props.RequestCacheEnabled.Get(),
+		props.RequestLogEnabled.Get(),
+		toMilliseconds(props.Metrics.RollingStatisticalWindow.Get()),
 		1,
 	}
 	e.Encode(&metrics)
 }
 
-func collectExecutionPercentiles(m *metrics.CommandMetrics) map[string]int {
+// writeSLO writes the error budget, the burn rates and the firing burn rate
+// alerts of a command with an SLO.
+func (h *MetricsStream) writeSLO(m *metrics.CommandMetrics, slo metrics.SLO, e *json.Encoder) {
+	burnRates := make(map[string]float64)
+	for _, w := range m.Windows() {
+		burnRates[w.Size().String()] = w.BurnRate(slo.Target)
+	}
+	firing := make([]string, 0)
+	for _, a := range m.FiringBurnRateAlerts() {
+		firing = append(firing, a.Name)
+	}
+	metrics := struct {
+		Type                           string             `json:"type"`
+		Name                           string             `json:"name"`
+		Group                          string             `json:"group"`
+		CurrentTime                    int                `json:"currentTime"`
+		Target                         float64            `json:"target"`
+		LatencyObjectiveInMilliseconds int                `json:"latencyObjectiveInMilliseconds"`
+		ErrorBudgetRemaining           float64            `json:"errorBudgetRemaining"`
+		BurnRates                      map[string]float64 `json:"burnRates"`
+		FiringAlerts                   []string           `json:"firingAlerts"`
+	}{
+		"CuirassSLO",
+		m.CommandName(),
+		m.CommandGroup(),
+		int(time.Now().UnixNano() / 1000000),
+		slo.Target,
+		toMilliseconds(slo.LatencyObjective),
+		m.ErrorBudgetRemaining(),
+		burnRates,
+		firing,
+	}
+	e.Encode(&metrics)
+}
+
+// writeGroupMetrics writes the concurrency metrics of a group. Groups are
+// reported as thread pools so they are shown by the dashboard.
+func (h *MetricsStream) writeGroupMetrics(g *metrics.GroupMetrics, e *json.Encoder) {
+	capacity := 0
+	if s, ok := h.executor.Semaphore(g.GroupName()); ok {
+		capacity = s.Capacity()
+	}
+	metrics := struct {
+		Type                                                  string `json:"type"`
+		Name                                                  string `json:"name"`
+		CurrentTime                                           int    `json:"currentTime"`
+		CurrentActiveCount                                    int    `json:"currentActiveCount"`
+		CurrentMaximumPoolSize                                int    `json:"currentMaximumPoolSize"`
+		CurrentQueueSize                                      int    `json:"currentQueueSize"`
+		RollingMaxActiveThreads                               int    `json:"rollingMaxActiveThreads"`
+		PropertyMetricsRollingStatisticalWindowInMilliseconds int    `json:"propertyValue_metricsRollingStatisticalWindowInMilliseconds"`
+		ReportingHosts                                        int    `json:"reportingHosts"`
+	}{
+		"HystrixThreadPool",
+		g.GroupName(),
+		int(time.Now().UnixNano() / 1000000),
+		g.CurrentConcurrentExecutionCount(),
+		capacity,
+		0,
+		g.RollingMaxConcurrentExecutionCount(),
+		toMilliseconds(g.RollingWindowSize()),
+		1,
+	}
+	e.Encode(&metrics)
+}
+
+// Percentiles of the execution time and their names in the stream.
+var (
+	percentiles     = []float64{0, 25, 50, 75, 90, 95, 99, 99.5, 100}
+	percentileNames = []string{"0", "25", "50", "75", "90", "95", "99", "99.5", "100"}
+)
+
+// toPercentileMap maps the percentile names to the durations in milliseconds.
+func toPercentileMap(values []time.Duration) map[string]int {
 	ps := make(map[string]int)
-	ps["0"] = toMilliseconds(m.ExecutionTimePercentile(0))
-	ps["25"] = toMilliseconds(m.ExecutionTimePercentile(25))
-	ps["50"] = toMilliseconds(m.ExecutionTimePercentile(50))
-	ps["75"] = toMilliseconds(m.ExecutionTimePercentile(75))
-	ps["90"] = toMilliseconds(m.ExecutionTimePercentile(90))
-	ps["95"] = toMilliseconds(m.ExecutionTimePercentile(95))
-	ps["99"] = toMilliseconds(m.ExecutionTimePercentile(99))
-	ps["99.5"] = toMilliseconds(m.ExecutionTimePercentile(99.5))
-	ps["100"] = toMilliseconds(m.ExecutionTimePercentile(100))
+	for i, v := range values {
+		ps[percentileNames[i]] = toMilliseconds(v)
+	}
 	return ps
 }
 
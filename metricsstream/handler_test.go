@@ -0,0 +1,128 @@
+package metricsstream_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/metricsstream"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStreamWritesMetricsUntilClientGoesAway(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.Cmd.circuitbreaker.requestVolumeThreshold", "7")
+	ex := cuirass.NewExecutor(cfg)
+	ex.Exec(context.Background(), cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Group("Group").Build())
+
+	stream := metricsstream.NewMetricsStream(ex)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		stream.ServeHTTP(w, httptest.NewRequest("GET", "/stream?delay=100", nil).WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 1, stream.Connections())
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream did not stop")
+	}
+
+	assert.Equal(t, 0, stream.Connections())
+	assert.Equal(t, "text/event-stream;charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `"type":"HystrixCommand","name":"Cmd","group":"Group"`)
+	assert.Contains(t, body, `"propertyValue_circuitBreakerRequestVolumeThreshold":7`)
+	assert.Contains(t, body, `"propertyValue_executionIsolationSemaphoreMaxConcurrentRequests":100`)
+}
+
+func TestStreamRejectsConnectionsOverLimit(t *testing.T) {
+	stream := metricsstream.NewMetricsStream(cuirass.NewExecutor(vaquita.NewEmptyMapConfig()))
+	stream.SetMaxConnections(0)
+	w := httptest.NewRecorder()
+	stream.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, 0, stream.Connections())
+}
+
+func TestStreamRejectsInvalidDelay(t *testing.T) {
+	stream := metricsstream.NewMetricsStream(cuirass.NewExecutor(vaquita.NewEmptyMapConfig()))
+	w := httptest.NewRecorder()
+	stream.ServeHTTP(w, httptest.NewRequest("GET", "/stream?delay=abc", nil))
+	assert.Equal(t, 400, w.Code)
+}
+
+// serveStream serves the stream for the duration and returns the written body.
+func serveStream(stream *metricsstream.MetricsStream, url string, d time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	w := httptest.NewRecorder()
+	stream.ServeHTTP(w, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+	return w.Body.String()
+}
+
+func newTestingStream() *metricsstream.MetricsStream {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	for _, c := range []struct{ name, group string }{{"UserGet", "Users"}, {"UserList", "Users"}, {"OrderGet", "Orders"}, {"Audit", "Audit"}} {
+		ex.Exec(context.Background(), cuirass.NewCommand(c.name, func(ctx context.Context) (interface{}, error) {
+			return "ok", nil
+		}).Group(c.group).Build())
+	}
+	return metricsstream.NewMetricsStream(ex)
+}
+
+func TestStreamFiltersCommands(t *testing.T) {
+	stream := newTestingStream()
+	body := serveStream(stream, "/stream?group=Orders&match=User*", 50*time.Millisecond)
+	assert.Contains(t, body, `"name":"UserGet"`)
+	assert.Contains(t, body, `"name":"UserList"`)
+	assert.Contains(t, body, `"name":"OrderGet"`)
+	assert.Contains(t, body, `"type":"HystrixThreadPool","name":"Users"`)
+	assert.Contains(t, body, `"propertyValue_metricsRollingStatisticalWindowInMilliseconds":10000`)
+	assert.NotContains(t, body, `"name":"Audit"`)
+
+	body = serveStream(stream, "/stream?command=Audit", 50*time.Millisecond)
+	assert.Contains(t, body, `"name":"Audit"`)
+	assert.NotContains(t, body, `"name":"UserGet"`)
+	assert.NotContains(t, body, `"name":"Users"`)
+}
+
+func TestStreamMatchesPatternsAcrossSeparators(t *testing.T) {
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	for _, name := range []string{"api/users.get", "api/users/list", "apiX", "web/users.get"} {
+		ex.Exec(context.Background(), cuirass.NewCommand(name, func(ctx context.Context) (interface{}, error) {
+			return "ok", nil
+		}).Build())
+	}
+	body := serveStream(metricsstream.NewMetricsStream(ex), "/stream?match=api/*.get&match=*/list", 50*time.Millisecond)
+	assert.Contains(t, body, `"name":"api/users.get"`)
+	assert.Contains(t, body, `"name":"api/users/list"`)
+	assert.NotContains(t, body, `"name":"apiX"`)
+	assert.NotContains(t, body, `"name":"web/users.get"`)
+}
+
+func TestStreamSendsOnlyChangedCommands(t *testing.T) {
+	stream := newTestingStream()
+	body := serveStream(stream, "/stream?command=Audit&changed=true&delay=100", 250*time.Millisecond)
+	assert.Equal(t, 1, strings.Count(body, `"type":"HystrixCommand"`))
+	assert.Contains(t, body, "ping: ")
+}
+
+func TestStreamRejectsInvalidFilter(t *testing.T) {
+	stream := newTestingStream()
+	for _, url := range []string{"/stream?changed=maybe", "/stream?delay=x"} {
+		w := httptest.NewRecorder()
+		stream.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, 400, w.Code)
+	}
+}
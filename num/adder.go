@@ -0,0 +1,83 @@
+package num
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maxAdderCells is the maximum number of cells of an Adder.
+const maxAdderCells = 64
+
+// Adder is a counter optimized for frequent concurrent updates and rare reads.
+// Uncontended updates are applied to a single base value. When updates start
+// to contend the counter is striped across multiple cells so the goroutines
+// update different cache lines, like LongAdder in Java.
+// The zero value is ready to use. The implementation is thread-safe.
+type Adder struct {
+	base  int64
+	cells unsafe.Pointer // *[]adderCell
+}
+
+// adderCell is a single stripe of an Adder padded to a cache line.
+type adderCell struct {
+	v int64
+	_ [56]byte
+}
+
+// Add adds delta to the counter.
+func (a *Adder) Add(delta int64) {
+	cells := (*[]adderCell)(atomic.LoadPointer(&a.cells))
+	if cells == nil {
+		v := atomic.LoadInt64(&a.base)
+		if atomic.CompareAndSwapInt64(&a.base, v, v+delta) {
+			return
+		}
+		// The base is contended, stripe the counter.
+		cells = a.initCells()
+	}
+	// The address of a local variable differs between goroutines and is
+	// a cheap hint of the cell to use.
+	var probe byte
+	h := uint32(uintptr(unsafe.Pointer(&probe)) >> 6)
+	mask := uint32(len(*cells) - 1)
+	for {
+		c := &(*cells)[h&mask]
+		v := atomic.LoadInt64(&c.v)
+		if atomic.CompareAndSwapInt64(&c.v, v, v+delta) {
+			return
+		}
+		// Move to another cell on contention.
+		h ^= h << 13
+		h ^= h >> 17
+		h ^= h << 5
+	}
+}
+
+// initCells creates the cells if no other goroutine created them yet.
+func (a *Adder) initCells() *[]adderCell {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxAdderCells {
+		n <<= 1
+	}
+	cells := make([]adderCell, n)
+	atomic.CompareAndSwapPointer(&a.cells, nil, unsafe.Pointer(&cells))
+	return (*[]adderCell)(atomic.LoadPointer(&a.cells))
+}
+
+// Increment adds one to the counter.
+func (a *Adder) Increment() {
+	a.Add(1)
+}
+
+// Sum returns the current value of the counter. Updates that happen
+// concurrently with Sum may or may not be included.
+func (a *Adder) Sum() int64 {
+	sum := atomic.LoadInt64(&a.base)
+	if cells := (*[]adderCell)(atomic.LoadPointer(&a.cells)); cells != nil {
+		for i := range *cells {
+			sum += atomic.LoadInt64(&(*cells)[i].v)
+		}
+	}
+	return sum
+}
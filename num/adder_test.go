@@ -0,0 +1,53 @@
+package num_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdderZeroValue(t *testing.T) {
+	var a num.Adder
+	assert.Equal(t, int64(0), a.Sum())
+	a.Increment()
+	a.Add(4)
+	assert.Equal(t, int64(5), a.Sum())
+}
+
+func TestAdderConcurrentUpdates(t *testing.T) {
+	var a num.Adder
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				a.Increment()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(160000), a.Sum())
+}
+
+func BenchmarkAdderIncrement(b *testing.B) {
+	var a num.Adder
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			a.Increment()
+		}
+	})
+}
+
+// BenchmarkAtomicIncrement is a baseline for BenchmarkAdderIncrement.
+func BenchmarkAtomicIncrement(b *testing.B) {
+	var v int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			atomic.AddInt64(&v, 1)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package num
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// Histogram is a histogram of all the values recorded since its construction.
+// Values are recorded with a bounded relative error the same way as in
+// RollingHistogram. The implementation is thread-safe.
+type Histogram struct {
+	h    histogram
+	lock *sync.Mutex
+}
+
+// NewHistogram constructs a new empty Histogram recording the values with the
+// precision of the given number of significant decimal digits.
+func NewHistogram(significantDigits int) *Histogram {
+	h := &Histogram{
+		lock: new(sync.Mutex),
+	}
+	h.h.reset(subBucketBitsForDigits(significantDigits))
+	return h
+}
+
+// Add records the value. Negative values are recorded as zero.
+func (h *Histogram) Add(v int) {
+	h.lock.Lock()
+	h.h.record(v)
+	h.lock.Unlock()
+}
+
+func (h *Histogram) snapshot() *histogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := &histogramSnapshot{subBucketBits: h.h.subBucketBits}
+	s.add(&h.h)
+	return s
+}
+
+// Get returns the value at the given percentile.
+func (h *Histogram) Get(percentile float64) int {
+	return h.Percentiles(percentile)[0]
+}
+
+// Percentiles returns the values at the given percentiles. All the values are
+// computed in a single pass over the recorded values.
+func (h *Histogram) Percentiles(percentiles ...float64) []int {
+	return h.snapshot().percentiles(percentiles)
+}
+
+// Mean returns the mean of the recorded values.
+func (h *Histogram) Mean() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.h.total == 0 {
+		return 0
+	}
+	return int(h.h.sum / h.h.total)
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.h.total
+}
+
+// Sum returns the sum of the recorded values.
+func (h *Histogram) Sum() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.h.sum
+}
+
+// histogram records non-negative integer values in buckets with exponentially
+// growing widths, the same way as HdrHistogram. Values smaller than the number
+// of sub-buckets are recorded exactly and every other value is recorded with a
+// relative error bounded by the number of significant decimal digits.
+// Only the buckets between the smallest and the largest recorded value are
+// allocated, so the memory used depends on the range of the recorded values.
+type histogram struct {
+	subBucketBits uint
+	// counts holds the counts of the buckets starting with the bucket with
+	// the index offset. The histogram is never reset, so the counts must not
+	// wrap around for long running processes.
+	counts   []uint64
+	offset   int
+	total    int64
+	sum      int64
+	min, max int
+}
+
+// subBucketBitsForDigits returns the number of bits needed for sub-buckets
+// to keep the given number of significant decimal digits.
+func subBucketBitsForDigits(significantDigits int) uint {
+	if significantDigits < 1 {
+		significantDigits = 1
+	} else if significantDigits > 5 {
+		significantDigits = 5
+	}
+	largest := 2 * int(math.Pow10(significantDigits))
+	b := uint(1)
+	for 1<<b < largest {
+		b++
+	}
+	return b
+}
+
+// bucketIndex returns the index of the bucket recording the value.
+func bucketIndex(v int, subBucketBits uint) int {
+	if v < 1<<subBucketBits {
+		return v
+	}
+	half := 1 << (subBucketBits - 1)
+	e := bits.Len64(uint64(v)) - int(subBucketBits)
+	return e*half + v>>uint(e)
+}
+
+// highestEquivalentValue returns the largest value recorded by the bucket
+// with the given index.
+func highestEquivalentValue(index int, subBucketBits uint) int {
+	if index < 1<<subBucketBits {
+		return index
+	}
+	half := 1 << (subBucketBits - 1)
+	e := index/half - 1
+	sub := index - e*half
+	v := uint64(sub+1)<<uint(e) - 1
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int(v)
+}
+
+func (h *histogram) record(v int) {
+	if v < 0 {
+		v = 0
+	}
+	i := bucketIndex(v, h.subBucketBits)
+	if len(h.counts) == 0 {
+		h.offset = i
+		h.counts = append(h.counts, 0)
+	} else if i < h.offset {
+		h.counts = append(make([]uint64, h.offset-i, h.offset-i+len(h.counts)), h.counts...)
+		h.offset = i
+	} else if i-h.offset >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i-h.offset+1-len(h.counts))...)
+	}
+	h.counts[i-h.offset]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if h.total == 0 || v > h.max {
+		h.max = v
+	}
+	h.total++
+	h.sum += int64(v)
+}
+
+// reset removes all the recorded values but keeps the allocated buckets.
+func (h *histogram) reset(subBucketBits uint) {
+	if h.subBucketBits != subBucketBits {
+		h.subBucketBits = subBucketBits
+		h.counts = nil
+	}
+	h.counts = h.counts[:0]
+	h.offset = 0
+	h.total = 0
+	h.sum = 0
+	h.min = 0
+	h.max = 0
+}
+
+// histogramSnapshot is a sum of multiple histograms with the same precision.
+type histogramSnapshot struct {
+	subBucketBits uint
+	counts        []int64
+	total         int64
+	sum           int64
+	min, max      int
+}
+
+// add adds the recorded values of the histogram to the snapshot.
+func (s *histogramSnapshot) add(h *histogram) {
+	if h.total == 0 {
+		return
+	}
+	if n := h.offset + len(h.counts); n > len(s.counts) {
+		s.counts = append(s.counts, make([]int64, n-len(s.counts))...)
+	}
+	for i, c := range h.counts {
+		s.counts[h.offset+i] += int64(c)
+	}
+	if s.total == 0 || h.min < s.min {
+		s.min = h.min
+	}
+	if s.total == 0 || h.max > s.max {
+		s.max = h.max
+	}
+	s.total += h.total
+	s.sum += h.sum
+}
+
+func (s *histogramSnapshot) mean() int {
+	if s.total == 0 {
+		return 0
+	}
+	return int(s.sum / s.total)
+}
+
+// percentiles returns the values at the given percentiles. All the percentiles
+// are computed in a single pass over the buckets.
+func (s *histogramSnapshot) percentiles(ps []float64) []int {
+	values := make([]int, len(ps))
+	if s.total == 0 {
+		return values
+	}
+	order := make([]int, len(ps))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(percentileOrder{order, ps})
+
+	var cumulative int64
+	index := 0
+	for _, i := range order {
+		p := ps[i]
+		if p <= 0 {
+			values[i] = s.min
+			continue
+		} else if p >= 100 {
+			values[i] = s.max
+			continue
+		}
+		target := int64(math.Ceil(p / 100 * float64(s.total)))
+		if target < 1 {
+			target = 1
+		}
+		for index < len(s.counts) && cumulative+s.counts[index] < target {
+			cumulative += s.counts[index]
+			index++
+		}
+		values[i] = s.clamp(highestEquivalentValue(index, s.subBucketBits))
+	}
+	return values
+}
+
+// clamp limits the value to the range of the recorded values.
+func (s *histogramSnapshot) clamp(v int) int {
+	if v < s.min {
+		return s.min
+	} else if v > s.max {
+		return s.max
+	}
+	return v
+}
+
+// percentileOrder sorts the indexes of percentiles by their values.
+type percentileOrder struct {
+	indexes     []int
+	percentiles []float64
+}
+
+func (o percentileOrder) Len() int { return len(o.indexes) }
+func (o percentileOrder) Less(i, j int) bool {
+	return o.percentiles[o.indexes[i]] < o.percentiles[o.indexes[j]]
+}
+func (o percentileOrder) Swap(i, j int) { o.indexes[i], o.indexes[j] = o.indexes[j], o.indexes[i] }
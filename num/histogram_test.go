@@ -0,0 +1,37 @@
+package num_test
+
+import (
+	"testing"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := num.NewHistogram(2)
+	assert.Equal(t, 0, h.Get(50))
+	assert.Equal(t, 0, h.Mean())
+
+	for i := 1; i <= 100; i++ {
+		h.Add(i)
+	}
+	assert.Equal(t, 1, h.Get(0))
+	assert.Equal(t, 50, h.Get(50))
+	assert.Equal(t, 100, h.Get(100))
+	assert.Equal(t, []int{99, 25}, h.Percentiles(99, 25))
+	assert.Equal(t, 50, h.Mean())
+	assert.Equal(t, int64(100), h.Count())
+	assert.Equal(t, int64(5050), h.Sum())
+}
+
+func TestHistogramValuesRecordedOutOfOrder(t *testing.T) {
+	h := num.NewHistogram(2)
+	h.Add(5000000)
+	h.Add(300)
+	h.Add(10)
+	h.Add(70000)
+	assert.Equal(t, 10, h.Get(0))
+	assert.InEpsilon(t, 300, h.Get(50), 0.01)
+	assert.InEpsilon(t, 70000, h.Get(75), 0.01)
+	assert.Equal(t, 5000000, h.Get(100))
+}
@@ -0,0 +1,345 @@
+package num
+
+import (
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/arjantop/cuirass/util"
+)
+
+// Default number of significant decimal digits of values recorded in a histogram.
+var DefaultSignificantDigits int = 2
+
+// maxHistogramStripes is the maximum number of stripes of a RollingHistogram.
+const maxHistogramStripes = 16
+
+// RollingHistogram is a histogram of values defined for a specified window.
+// Values are recorded in HDR histograms with a bounded relative error so the
+// memory used does not depend on the number of recorded values.
+// Values that fall out of the sliding window are discarded.
+// The implementation is thread-safe and lock-free. Bucket counts are updated
+// atomically in a single stripe until concurrent updates start to contend,
+// then the histogram is striped so the goroutines update different counters,
+// like Adder.
+type RollingHistogram struct {
+	state         unsafe.Pointer // *rollingHistogramState
+	subBucketBits uint
+	clock         util.Clock
+}
+
+// rollingHistogramState is the immutable configuration of the window together
+// with its stripes. Changing the window replaces the whole state.
+type rollingHistogramState struct {
+	startTime  time.Time
+	bucketSize time.Duration
+	base       histogramStripe
+	stripes    unsafe.Pointer // *[]histogramStripe
+}
+
+// histogramStripe holds a histogram for every bucket of the window.
+type histogramStripe struct {
+	buckets []unsafe.Pointer // *atomicHistogram
+}
+
+// atomicHistogram is a histogram of a single bucket of the window that is
+// updated atomically. Epoch is the number of bucket sizes between the start
+// of the window and the start of the bucket. Counts are allocated in chunks of
+// sub-buckets with the same width when a value is first recorded in them.
+type atomicHistogram struct {
+	epoch    int64
+	total    int64
+	sum      int64
+	min, max int64
+	chunks   []unsafe.Pointer // *[]uint64
+}
+
+// NewRollingHistogram constructs a new empty RollingHistogram. Values are
+// recorded with the precision of the given number of significant decimal
+// digits (between 1 and 5), eg. 2 digits guarantee a relative error of less
+// than 1%.
+// If the window size or the number of buckets is not positive the default
+// window is used.
+func NewRollingHistogram(windowSize time.Duration, windowBuckets, significantDigits int, clock util.Clock) *RollingHistogram {
+	if !isValidWindow(windowSize, windowBuckets) {
+		windowSize, windowBuckets = DefaultWindowSize, DefaultWindowBuckets
+	}
+	h := &RollingHistogram{
+		subBucketBits: subBucketBitsForDigits(significantDigits),
+		clock:         clock,
+	}
+	h.state = unsafe.Pointer(h.newState(calculateBucketSize(windowSize, windowBuckets), windowBuckets))
+	return h
+}
+
+func (h *RollingHistogram) newState(bucketSize time.Duration, windowBuckets int) *rollingHistogramState {
+	s := &rollingHistogramState{
+		startTime:  h.clock.Now(),
+		bucketSize: bucketSize,
+	}
+	s.base.init(windowBuckets)
+	return s
+}
+
+func (h *RollingHistogram) getState() *rollingHistogramState {
+	return (*rollingHistogramState)(atomic.LoadPointer(&h.state))
+}
+
+func (h *RollingHistogram) BucketSize() time.Duration {
+	return h.getState().bucketSize
+}
+
+// SetWindow changes the size of the statistical window and the number of buckets.
+// If the window changed the buckets are rebuilt and all the values are discarded.
+// Windows with a size or a number of buckets that is not positive are ignored
+// and the previous window is kept.
+func (h *RollingHistogram) SetWindow(windowSize time.Duration, windowBuckets int) {
+	if !isValidWindow(windowSize, windowBuckets) {
+		return
+	}
+	bucketSize := calculateBucketSize(windowSize, windowBuckets)
+	for {
+		s := h.getState()
+		if bucketSize == s.bucketSize && windowBuckets == len(s.base.buckets) {
+			return
+		}
+		newState := h.newState(bucketSize, windowBuckets)
+		if atomic.CompareAndSwapPointer(&h.state, unsafe.Pointer(s), unsafe.Pointer(newState)) {
+			return
+		}
+	}
+}
+
+// Add records the value in the current bucket. Negative values are recorded
+// as zero.
+func (h *RollingHistogram) Add(v int) {
+	if v < 0 {
+		v = 0
+	}
+	s := h.getState()
+	epoch := s.epoch(h.clock.Now())
+	stripes := (*[]histogramStripe)(atomic.LoadPointer(&s.stripes))
+	if stripes == nil {
+		if s.base.bucket(epoch, h.subBucketBits).tryRecord(v, h.subBucketBits) {
+			return
+		}
+		// The base stripe is contended, stripe the histogram.
+		stripes = s.initStripes()
+	}
+	// The address of a local variable differs between goroutines and is
+	// a cheap hint of the stripe to use.
+	var probe byte
+	i := uint32(uintptr(unsafe.Pointer(&probe))>>6) & uint32(len(*stripes)-1)
+	(*stripes)[i].bucket(epoch, h.subBucketBits).record(v, h.subBucketBits)
+}
+
+// epoch returns the epoch of the bucket for the given time.
+func (s *rollingHistogramState) epoch(now time.Time) int64 {
+	d := now.Sub(s.startTime)
+	if d < 0 {
+		return 0
+	}
+	return int64(d / s.bucketSize)
+}
+
+// initStripes creates the stripes if no other goroutine created them yet.
+func (s *rollingHistogramState) initStripes() *[]histogramStripe {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxHistogramStripes {
+		n <<= 1
+	}
+	stripes := make([]histogramStripe, n)
+	for i := range stripes {
+		stripes[i].init(len(s.base.buckets))
+	}
+	atomic.CompareAndSwapPointer(&s.stripes, nil, unsafe.Pointer(&stripes))
+	return (*[]histogramStripe)(atomic.LoadPointer(&s.stripes))
+}
+
+// snapshot returns the sum of all the buckets in the window ending at now.
+func (h *RollingHistogram) snapshot(now time.Time) *histogramSnapshot {
+	s := h.getState()
+	epoch := s.epoch(now)
+	snapshot := &histogramSnapshot{subBucketBits: h.subBucketBits}
+	s.base.addTo(snapshot, epoch)
+	if stripes := (*[]histogramStripe)(atomic.LoadPointer(&s.stripes)); stripes != nil {
+		for i := range *stripes {
+			(*stripes)[i].addTo(snapshot, epoch)
+		}
+	}
+	return snapshot
+}
+
+func (s *histogramStripe) init(windowBuckets int) {
+	s.buckets = make([]unsafe.Pointer, windowBuckets)
+	for i := range s.buckets {
+		// Buckets start out of the window.
+		s.buckets[i] = unsafe.Pointer(&atomicHistogram{epoch: -1})
+	}
+}
+
+// bucket returns the histogram for the epoch. The histogram that previously
+// used the same slot fell out of the window, it is replaced with a new empty
+// histogram.
+func (s *histogramStripe) bucket(epoch int64, subBucketBits uint) *atomicHistogram {
+	slot := &s.buckets[epoch%int64(len(s.buckets))]
+	for {
+		p := atomic.LoadPointer(slot)
+		b := (*atomicHistogram)(p)
+		if b.epoch >= epoch {
+			return b
+		}
+		nb := newAtomicHistogram(epoch, subBucketBits)
+		if atomic.CompareAndSwapPointer(slot, p, unsafe.Pointer(nb)) {
+			return nb
+		}
+	}
+}
+
+// addTo adds the buckets in the window ending with the bucket of the epoch
+// to the snapshot.
+func (s *histogramStripe) addTo(snapshot *histogramSnapshot, epoch int64) {
+	for i := range s.buckets {
+		b := (*atomicHistogram)(atomic.LoadPointer(&s.buckets[i]))
+		if b.epoch <= epoch && b.epoch > epoch-int64(len(s.buckets)) {
+			b.addTo(snapshot)
+		}
+	}
+}
+
+func newAtomicHistogram(epoch int64, subBucketBits uint) *atomicHistogram {
+	// Every exponent of a positive int64 value has its own chunk, values
+	// smaller than the number of sub-buckets take the first two chunks.
+	return &atomicHistogram{
+		epoch: epoch,
+		// The range is empty until the first value is recorded.
+		min:    math.MaxInt64,
+		max:    -1,
+		chunks: make([]unsafe.Pointer, 65-subBucketBits),
+	}
+}
+
+// tryRecord records the value unless another goroutine updates the histogram
+// at the same time. It returns false if the value was not recorded.
+func (h *atomicHistogram) tryRecord(v int, subBucketBits uint) bool {
+	total := atomic.LoadInt64(&h.total)
+	if !atomic.CompareAndSwapInt64(&h.total, total, total+1) {
+		return false
+	}
+	h.recordValue(v, subBucketBits)
+	return true
+}
+
+func (h *atomicHistogram) record(v int, subBucketBits uint) {
+	atomic.AddInt64(&h.total, 1)
+	h.recordValue(v, subBucketBits)
+}
+
+// recordValue records the value in the counts, the sum and the range. The total
+// is updated by the caller.
+func (h *atomicHistogram) recordValue(v int, subBucketBits uint) {
+	i := bucketIndex(v, subBucketBits)
+	chunkSize := 1 << (subBucketBits - 1)
+	counts := h.chunk(i/chunkSize, chunkSize)
+	atomic.AddUint64(&(*counts)[i%chunkSize], 1)
+	atomic.AddInt64(&h.sum, int64(v))
+	for {
+		min := atomic.LoadInt64(&h.min)
+		if int64(v) >= min || atomic.CompareAndSwapInt64(&h.min, min, int64(v)) {
+			break
+		}
+	}
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(v) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(v)) {
+			break
+		}
+	}
+}
+
+// chunk returns the counts of the chunk with the index and allocates them if
+// they do not exist yet.
+func (h *atomicHistogram) chunk(index, size int) *[]uint64 {
+	if c := atomic.LoadPointer(&h.chunks[index]); c != nil {
+		return (*[]uint64)(c)
+	}
+	counts := make([]uint64, size)
+	atomic.CompareAndSwapPointer(&h.chunks[index], nil, unsafe.Pointer(&counts))
+	return (*[]uint64)(atomic.LoadPointer(&h.chunks[index]))
+}
+
+// addTo adds the recorded values to the snapshot. Values recorded concurrently
+// may or may not be included.
+func (h *atomicHistogram) addTo(s *histogramSnapshot) {
+	chunkSize := 1 << (s.subBucketBits - 1)
+	last := len(h.chunks) - 1
+	for last >= 0 && atomic.LoadPointer(&h.chunks[last]) == nil {
+		last--
+	}
+	if n := (last + 1) * chunkSize; n > len(s.counts) {
+		s.counts = append(s.counts, make([]int64, n-len(s.counts))...)
+	}
+	var total int64
+	for c := 0; c <= last; c++ {
+		p := atomic.LoadPointer(&h.chunks[c])
+		if p == nil {
+			continue
+		}
+		counts := *(*[]uint64)(p)
+		dst := s.counts[c*chunkSize:]
+		for j := range counts {
+			n := int64(atomic.LoadUint64(&counts[j]))
+			dst[j] += n
+			total += n
+		}
+	}
+	if total == 0 {
+		return
+	}
+	// The range of a value recorded concurrently may not be updated yet.
+	min, max := int(atomic.LoadInt64(&h.min)), int(atomic.LoadInt64(&h.max))
+	if min <= max {
+		if s.total == 0 || min < s.min {
+			s.min = min
+		}
+		if s.total == 0 || max > s.max {
+			s.max = max
+		}
+	}
+	s.total += total
+	s.sum += atomic.LoadInt64(&h.sum)
+}
+
+// Get returns the value at the given percentile.
+func (h *RollingHistogram) Get(percentile float64) int {
+	return h.Percentiles(percentile)[0]
+}
+
+// Percentiles returns the values at the given percentiles. All the values are
+// computed in a single pass over the recorded values.
+func (h *RollingHistogram) Percentiles(percentiles ...float64) []int {
+	return h.PercentilesAt(h.clock.Now(), percentiles...)
+}
+
+// PercentilesAt returns the values at the given percentiles of the window
+// ending at the given time.
+func (h *RollingHistogram) PercentilesAt(now time.Time, percentiles ...float64) []int {
+	return h.snapshot(now).percentiles(percentiles)
+}
+
+// Mean returns the mean of the values in the window.
+func (h *RollingHistogram) Mean() int {
+	return h.MeanAt(h.clock.Now())
+}
+
+// MeanAt returns the mean of the values in the window ending at the given time.
+func (h *RollingHistogram) MeanAt(now time.Time) int {
+	return h.snapshot(now).mean()
+}
+
+// Count returns the number of values in the window.
+func (h *RollingHistogram) Count() int64 {
+	return h.snapshot(h.clock.Now()).total
+}
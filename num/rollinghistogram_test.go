@@ -0,0 +1,201 @@
+package num_test
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/num"
+	"github.com/arjantop/cuirass/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestingRollingHistogram(clock util.Clock) *num.RollingHistogram {
+	if clock == nil {
+		clock = util.NewClock()
+	}
+	return num.NewRollingHistogram(time.Millisecond, 3, 2, clock)
+}
+
+func addAllHistogram(h *num.RollingHistogram, vs ...int) {
+	for _, v := range vs {
+		h.Add(v)
+	}
+}
+
+func TestRollingHistogramBasic(t *testing.T) {
+	h := newTestingRollingHistogram(nil)
+	assert.Equal(t, 0, h.Get(50))
+	assert.Equal(t, 0, h.Mean())
+
+	addAllHistogram(h, 3, 10, 7, 5)
+	assert.Equal(t, 3, h.Get(0))
+	assert.Equal(t, 3, h.Get(-10))
+	assert.Equal(t, 5, h.Get(50))
+	assert.Equal(t, 7, h.Get(75))
+	assert.Equal(t, 10, h.Get(100))
+	assert.Equal(t, 10, h.Get(120))
+	assert.Equal(t, 6, h.Mean())
+	assert.Equal(t, int64(4), h.Count())
+}
+
+func TestRollingHistogramNegativeValues(t *testing.T) {
+	h := newTestingRollingHistogram(nil)
+	addAllHistogram(h, -5)
+	assert.Equal(t, 0, h.Get(100))
+}
+
+func TestRollingHistogramRelativeError(t *testing.T) {
+	h := num.NewRollingHistogram(time.Minute, 10, 2, util.NewClock())
+	for i := 1; i <= 100000; i++ {
+		h.Add(i * 1000)
+	}
+	for _, p := range []float64{1, 25, 50, 90, 99, 99.5, 99.9} {
+		expected := p / 100 * 100000 * 1000
+		relativeError := math.Abs(float64(h.Get(p))-expected) / expected
+		assert.True(t, relativeError < 0.01, "Relative error of %v percentile is %v", p, relativeError)
+	}
+	assert.Equal(t, 1000, h.Get(0))
+	assert.Equal(t, 100000000, h.Get(100))
+	assert.Equal(t, 50000500, h.Mean())
+}
+
+func TestRollingHistogramLargeValues(t *testing.T) {
+	h := newTestingRollingHistogram(nil)
+	addAllHistogram(h, math.MaxInt64, math.MaxInt64-1)
+	assert.Equal(t, math.MaxInt64-1, h.Get(0))
+	assert.Equal(t, math.MaxInt64, h.Get(100))
+	assert.Equal(t, math.MaxInt64, h.Get(99))
+}
+
+func TestRollingHistogramPercentiles(t *testing.T) {
+	h := newTestingRollingHistogram(util.NewTestableClock(time.Now()))
+	for i := 1; i <= 1000; i++ {
+		h.Add(i)
+	}
+	ps := []float64{99, 0, 50, 100, 25}
+	values := h.Percentiles(ps...)
+	assert.Equal(t, len(ps), len(values))
+	for i, p := range ps {
+		assert.Equal(t, h.Get(p), values[i])
+	}
+}
+
+func TestRollingHistogramInWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	h := newTestingRollingHistogram(clock)
+
+	addAllHistogram(h, 1)
+	assert.Equal(t, 1, h.Get(100))
+	clock.Add(time.Millisecond)
+	addAllHistogram(h, 3)
+	assert.Equal(t, 3, h.Get(100))
+	assert.Equal(t, 2, h.Mean())
+	clock.Add(time.Millisecond)
+	addAllHistogram(h, 2)
+	clock.Add(time.Millisecond)
+	assert.Equal(t, 2, h.Get(0))
+	assert.Equal(t, 3, h.Get(100), "The value 3 is still in the window")
+	clock.Add(time.Millisecond)
+	assert.Equal(t, 2, h.Get(100))
+	clock.Add(time.Millisecond)
+	assert.Equal(t, 0, h.Get(100))
+	assert.Equal(t, int64(0), h.Count())
+}
+
+func TestRollingHistogramPercentilesAt(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	h := newTestingRollingHistogram(clock)
+	start := clock.Now()
+	addAllHistogram(h, 1)
+	clock.Add(time.Millisecond)
+	addAllHistogram(h, 3)
+	clock.Add(3 * time.Millisecond)
+	assert.Equal(t, 0, h.Get(100))
+	assert.Equal(t, []int{1, 3}, h.PercentilesAt(start.Add(time.Millisecond), 0, 100))
+	assert.Equal(t, 2, h.MeanAt(start.Add(time.Millisecond)))
+}
+
+func TestRollingHistogramWholeWindowElapsed(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	h := newTestingRollingHistogram(clock)
+	addAllHistogram(h, 1)
+	clock.Add(3 * time.Millisecond)
+	assert.Equal(t, int64(0), h.Count())
+}
+
+func TestRollingHistogramSetWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	h := newTestingRollingHistogram(clock)
+	addAllHistogram(h, 5)
+	h.SetWindow(time.Millisecond, 3)
+	assert.Equal(t, 5, h.Get(100), "Values are kept if the window did not change")
+
+	h.SetWindow(time.Second, 2)
+	assert.Equal(t, 500*time.Millisecond, h.BucketSize())
+	assert.Equal(t, 0, h.Get(100))
+	addAllHistogram(h, 7)
+	clock.Add(500 * time.Millisecond)
+	assert.Equal(t, 7, h.Get(100))
+	clock.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, h.Get(100))
+}
+
+func TestRollingHistogramInvalidWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	h := newTestingRollingHistogram(clock)
+	addAllHistogram(h, 5)
+	h.SetWindow(0, 2)
+	h.SetWindow(time.Second, -1)
+	assert.Equal(t, time.Millisecond, h.BucketSize(), "Previous window is kept")
+	assert.Equal(t, 5, h.Get(100))
+}
+
+func TestRollingHistogramConcurrentAdd(t *testing.T) {
+	h := num.NewRollingHistogram(time.Minute, 10, 2, util.NewClock())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= 1000; j++ {
+				h.Add(j)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(8000), h.Count())
+	assert.Equal(t, 1, h.Get(0))
+	assert.Equal(t, 1000, h.Get(100))
+}
+
+func BenchmarkRollingHistogramAdd(b *testing.B) {
+	h := num.NewRollingHistogram(time.Minute, 10, 2, util.NewClock())
+	for i := 0; i < b.N; i++ {
+		h.Add(i)
+	}
+}
+
+// Concurrent adds are spread over the stripes of the current bucket.
+func BenchmarkRollingHistogramAddParallel(b *testing.B) {
+	h := num.NewRollingHistogram(time.Minute, 10, 2, util.NewClock())
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			h.Add(i)
+			i++
+		}
+	})
+}
+
+func BenchmarkRollingHistogramPercentiles(b *testing.B) {
+	h := num.NewRollingHistogram(time.Minute, 10, 2, util.NewClock())
+	for i := 0; i < 100000; i++ {
+		h.Add(i * 1000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Percentiles(0, 25, 50, 75, 90, 95, 99, 99.5, 100)
+	}
+}
@@ -1,8 +1,9 @@
 package num
 
 import (
-	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/arjantop/cuirass/util"
 )
@@ -16,26 +17,62 @@ var (
 
 // RollingNumber is an implementation of a number that is defined for a specified
 // window. Value changes that fall out of the sliding window are discarded.
-// The implementation is thread-safe.
+// The implementation is thread-safe and lock-free. Buckets are striped
+// counters that are replaced when they fall out of the window, so concurrent
+// increments do not contend on a single lock or cache line.
 type RollingNumber struct {
-	bucketSize        time.Duration
-	currentBucket     int
-	currentBucketTime time.Time
-	buckets           []int64
-	clock             util.Clock
-	lock              *sync.RWMutex
+	state unsafe.Pointer // *rollingNumberState
+	clock util.Clock
+}
+
+// rollingNumberState is the immutable configuration of the window together with
+// its buckets. Changing the window replaces the whole state.
+type rollingNumberState struct {
+	startTime  time.Time
+	bucketSize time.Duration
+	buckets    []unsafe.Pointer // *rollingNumberBucket
+}
+
+// rollingNumberBucket is a counter for a single bucket of the window. Epoch is
+// the number of bucket sizes between the start of the window and the start of
+// the bucket.
+type rollingNumberBucket struct {
+	epoch int64
+	value Adder
+	max   int64
 }
 
 // NewRollingNumber constructs a new RollingNumber with a default value of zero.
+// If the window size or the number of buckets is not positive the default
+// window is used.
 func NewRollingNumber(windowSize time.Duration, windowBuckets int, clock util.Clock) *RollingNumber {
-	return &RollingNumber{
-		bucketSize:        calculateBucketSize(windowSize, windowBuckets),
-		currentBucket:     0,
-		currentBucketTime: clock.Now(),
-		buckets:           make([]int64, windowBuckets),
-		clock:             clock,
-		lock:              new(sync.RWMutex),
+	n := &RollingNumber{
+		clock: clock,
+	}
+	if !isValidWindow(windowSize, windowBuckets) {
+		windowSize, windowBuckets = DefaultWindowSize, DefaultWindowBuckets
 	}
+	n.state = unsafe.Pointer(newRollingNumberState(calculateBucketSize(windowSize, windowBuckets), windowBuckets, clock.Now()))
+	return n
+}
+
+func newRollingNumberState(bucketSize time.Duration, windowBuckets int, now time.Time) *rollingNumberState {
+	s := &rollingNumberState{
+		startTime:  now,
+		bucketSize: bucketSize,
+		buckets:    make([]unsafe.Pointer, windowBuckets),
+	}
+	for i := range s.buckets {
+		// Buckets start out of the window.
+		s.buckets[i] = unsafe.Pointer(&rollingNumberBucket{epoch: -1})
+	}
+	return s
+}
+
+// isValidWindow returns true if both the window size and the number of buckets
+// are positive.
+func isValidWindow(windowSize time.Duration, windowBuckets int) bool {
+	return windowSize > 0 && windowBuckets > 0
 }
 
 // calculatebucketsize calculates a bucket size based on requested window size
@@ -54,57 +91,134 @@ func calculateBucketSize(windowSize time.Duration, windowBuckets int) time.Durat
 
 // BucketSize returns the calculated bucket size based on requested sliding window parameters.
 func (n *RollingNumber) BucketSize() time.Duration {
-	n.lock.RLock()
-	size := n.bucketSize
-	n.lock.RUnlock()
-	return size
+	return n.getState().bucketSize
+}
+
+// WindowSize returns the size of the sliding window covered by all the buckets.
+func (n *RollingNumber) WindowSize() time.Duration {
+	s := n.getState()
+	return s.bucketSize * time.Duration(len(s.buckets))
+}
+
+func (n *RollingNumber) getState() *rollingNumberState {
+	return (*rollingNumberState)(atomic.LoadPointer(&n.state))
+}
+
+// SetWindow changes the size of the statistical window and the number of buckets.
+// If the window changed the buckets are rebuilt and all the values are discarded.
+// Windows with a size or a number of buckets that is not positive are ignored
+// and the previous window is kept.
+func (n *RollingNumber) SetWindow(windowSize time.Duration, windowBuckets int) {
+	if !isValidWindow(windowSize, windowBuckets) {
+		return
+	}
+	bucketSize := calculateBucketSize(windowSize, windowBuckets)
+	for {
+		s := n.getState()
+		if bucketSize == s.bucketSize && windowBuckets == len(s.buckets) {
+			return
+		}
+		newState := newRollingNumberState(bucketSize, windowBuckets, n.clock.Now())
+		if atomic.CompareAndSwapPointer(&n.state, unsafe.Pointer(s), unsafe.Pointer(newState)) {
+			return
+		}
+	}
 }
 
 // Increment increments the number by one.
 func (n *RollingNumber) Increment() {
-	n.lock.Lock()
-	n.buckets[n.findCurrentBucket()] += 1
-	n.lock.Unlock()
+	s := n.getState()
+	epoch := s.epoch(n.clock.Now())
+	s.bucket(epoch).value.Increment()
 }
 
 // Sum sums all the bucket values of the sliding window and returns the result.
 func (n *RollingNumber) Sum() int64 {
-	n.lock.Lock()
-	// We don't need the current bucket but we must still recalculate which bucket is current
-	// and reset values that are no longer valid.
-	n.findCurrentBucket()
+	return n.SumAt(n.clock.Now())
+}
+
+// SumAt returns the sum of the sliding window ending at the given time. It lets
+// callers read several numbers at the same point in time.
+func (n *RollingNumber) SumAt(now time.Time) int64 {
+	s := n.getState()
+	epoch := s.epoch(now)
 	sum := int64(0)
-	for _, v := range n.buckets {
-		sum += v
+	for i := range s.buckets {
+		b := (*rollingNumberBucket)(atomic.LoadPointer(&s.buckets[i]))
+		if s.inWindow(b, epoch) {
+			sum += b.value.Sum()
+		}
 	}
-	n.lock.Unlock()
 	return sum
 }
 
+// UpdateMax updates the maximum value of the current bucket if v is larger.
+func (n *RollingNumber) UpdateMax(v int64) {
+	s := n.getState()
+	b := s.bucket(s.epoch(n.clock.Now()))
+	for {
+		max := atomic.LoadInt64(&b.max)
+		if v <= max || atomic.CompareAndSwapInt64(&b.max, max, v) {
+			return
+		}
+	}
+}
+
+// Max returns the largest value passed to UpdateMax in the sliding window.
+func (n *RollingNumber) Max() int64 {
+	return n.MaxAt(n.clock.Now())
+}
+
+// MaxAt returns the largest value in the sliding window ending at the given time.
+func (n *RollingNumber) MaxAt(now time.Time) int64 {
+	s := n.getState()
+	epoch := s.epoch(now)
+	max := int64(0)
+	for i := range s.buckets {
+		b := (*rollingNumberBucket)(atomic.LoadPointer(&s.buckets[i]))
+		if s.inWindow(b, epoch) {
+			if v := atomic.LoadInt64(&b.max); v > max {
+				max = v
+			}
+		}
+	}
+	return max
+}
+
 // Reset resets a number to a default value.
 func (n *RollingNumber) Reset() {
-	n.currentBucket = 0
-	n.currentBucketTime = n.clock.Now()
-	for i, _ := range n.buckets {
-		n.buckets[i] = 0
+	s := n.getState()
+	atomic.StorePointer(&n.state, unsafe.Pointer(newRollingNumberState(s.bucketSize, len(s.buckets), n.clock.Now())))
+}
+
+// epoch returns the epoch of the bucket for the given time.
+func (s *rollingNumberState) epoch(now time.Time) int64 {
+	d := now.Sub(s.startTime)
+	if d < 0 {
+		return 0
 	}
+	return int64(d / s.bucketSize)
+}
+
+// inWindow returns true if the bucket is in the sliding window ending with the
+// bucket of the epoch. Buckets that fell out of the window are ignored.
+func (s *rollingNumberState) inWindow(b *rollingNumberBucket, epoch int64) bool {
+	return b.epoch <= epoch && b.epoch > epoch-int64(len(s.buckets))
 }
 
-// findCurrentBucket returns an index of the current bucket and updates the buckets
-// that should be reset for reuse based on the time elapsed since last access.
-func (n *RollingNumber) findCurrentBucket() int {
-	now := n.clock.Now()
-	timeDiffFromFirstBucket := now.Sub(n.currentBucketTime)
-	bucketsBehind := int(timeDiffFromFirstBucket / n.bucketSize)
-	if bucketsBehind > 0 {
-		// We are not in the current bucket so we must reset the values of
-		// buckets that fell out of the sliding window.
-		numBuckets := len(n.buckets)
-		for i := 1; i <= bucketsBehind; i++ {
-			n.buckets[(n.currentBucket+i)%numBuckets] = 0
+// bucket returns the bucket for the epoch. The bucket that previously used the
+// same slot fell out of the window, it is replaced with a new empty bucket.
+func (s *rollingNumberState) bucket(epoch int64) *rollingNumberBucket {
+	slot := &s.buckets[epoch%int64(len(s.buckets))]
+	for {
+		p := atomic.LoadPointer(slot)
+		b := (*rollingNumberBucket)(p)
+		if b.epoch >= epoch {
+			return b
+		}
+		nb := &rollingNumberBucket{epoch: epoch}
+		if atomic.CompareAndSwapPointer(slot, p, unsafe.Pointer(nb)) {
+			return nb
 		}
-		n.currentBucket = (n.currentBucket + bucketsBehind) % numBuckets
-		n.currentBucketTime = now
 	}
-	return n.currentBucket
 }
@@ -1,6 +1,7 @@
 package num_test
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +25,7 @@ func newTestingRollingNumber(clock util.Clock) *num.RollingNumber {
 func TestBucketSizeIsCalculated(t *testing.T) {
 	n := num.NewRollingNumber(time.Minute, 30, util.NewClock())
 	assert.Equal(t, 2*time.Second, n.BucketSize())
+	assert.Equal(t, time.Minute, n.WindowSize())
 	n2 := newTestingRollingNumber(nil)
 	assert.Equal(t, time.Millisecond, n2.BucketSize())
 }
@@ -64,6 +66,20 @@ func TestRollingNumberSumInWindow(t *testing.T) {
 	assert.Equal(t, 0, n.Sum())
 }
 
+func TestRollingNumberSumAt(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	n := newTestingRollingNumber(clock)
+	start := clock.Now()
+	n.Increment()
+	clock.Add(5 * time.Millisecond)
+	n.Increment()
+	n.UpdateMax(2)
+	clock.Add(10 * time.Millisecond)
+	assert.Equal(t, 0, n.Sum())
+	assert.Equal(t, 2, n.SumAt(start.Add(5*time.Millisecond)))
+	assert.Equal(t, 2, n.MaxAt(start.Add(5*time.Millisecond)))
+}
+
 func TestRollingNumberReset(t *testing.T) {
 	clock := util.NewTestableClock(time.Now())
 	n := newTestingRollingNumber(clock)
@@ -76,3 +92,84 @@ func TestRollingNumberReset(t *testing.T) {
 	n.Reset()
 	assert.Equal(t, 0, n.Sum())
 }
+
+func TestRollingNumberSetWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	n := newTestingRollingNumber(clock)
+	n.Increment()
+	n.SetWindow(10*time.Millisecond, 10)
+	assert.Equal(t, 1, n.Sum(), "Values are kept if the window did not change")
+
+	n.SetWindow(time.Second, 5)
+	assert.Equal(t, 200*time.Millisecond, n.BucketSize())
+	assert.Equal(t, 0, n.Sum())
+	n.Increment()
+	clock.Add(900 * time.Millisecond)
+	assert.Equal(t, 1, n.Sum())
+	clock.Add(time.Second)
+	assert.Equal(t, 0, n.Sum())
+}
+
+func TestRollingNumberInvalidWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	n := num.NewRollingNumber(0, 0, clock)
+	assert.Equal(t, num.DefaultWindowSize, n.WindowSize(), "Default window is used")
+
+	n.Increment()
+	n.SetWindow(time.Second, 0)
+	n.SetWindow(-time.Second, 5)
+	assert.Equal(t, num.DefaultWindowSize, n.WindowSize(), "Previous window is kept")
+	assert.Equal(t, 1, n.Sum())
+}
+
+func TestRollingNumberConcurrentIncrements(t *testing.T) {
+	n := num.NewRollingNumber(time.Minute, 10, util.NewClock())
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				n.Increment()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 16000, n.Sum())
+}
+
+// Run with -cpu 1,2,4,8 to see how the throughput scales with GOMAXPROCS.
+func BenchmarkRollingNumberIncrement(b *testing.B) {
+	n := num.NewRollingNumber(10*time.Second, 10, util.NewClock())
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n.Increment()
+		}
+	})
+}
+
+func BenchmarkRollingNumberSum(b *testing.B) {
+	n := num.NewRollingNumber(10*time.Second, 10, util.NewClock())
+	n.Increment()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n.Sum()
+		}
+	})
+}
+
+func TestRollingNumberMax(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	n := newTestingRollingNumber(clock)
+	assert.Equal(t, 0, n.Max())
+	n.UpdateMax(3)
+	n.UpdateMax(1)
+	assert.Equal(t, 3, n.Max())
+	clock.Add(5 * time.Millisecond)
+	n.UpdateMax(2)
+	assert.Equal(t, 3, n.Max())
+	clock.Add(5 * time.Millisecond)
+	assert.Equal(t, 2, n.Max(), "The maximum fell out of the window")
+	clock.Add(5 * time.Millisecond)
+	assert.Equal(t, 0, n.Max())
+}
@@ -19,7 +19,12 @@ type RollingPercentile struct {
 	lock              *sync.RWMutex
 }
 
+// NewRollingPercentile constructs a new empty RollingPercentile. If the window
+// size or the number of buckets is not positive the default window is used.
 func NewRollingPercentile(windowSize time.Duration, windowBuckets, maxBucketItems int, clock util.Clock) *RollingPercentile {
+	if !isValidWindow(windowSize, windowBuckets) {
+		windowSize, windowBuckets = DefaultWindowSize, DefaultWindowBuckets
+	}
 	p := &RollingPercentile{
 		bucketSize:        calculateBucketSize(windowSize, windowBuckets),
 		maxBucketItems:    maxBucketItems,
@@ -42,6 +47,28 @@ func (p *RollingPercentile) BucketSize() time.Duration {
 	return size
 }
 
+// SetWindow changes the size of the statistical window and the number of buckets.
+// If the window changed the buckets are rebuilt and all the values are discarded.
+// Windows with a size or a number of buckets that is not positive are ignored
+// and the previous window is kept.
+func (p *RollingPercentile) SetWindow(windowSize time.Duration, windowBuckets int) {
+	if !isValidWindow(windowSize, windowBuckets) {
+		return
+	}
+	bucketSize := calculateBucketSize(windowSize, windowBuckets)
+	p.lock.Lock()
+	if bucketSize != p.bucketSize || windowBuckets != len(p.buckets) {
+		p.bucketSize = bucketSize
+		p.buckets = make([]percentileBucket, windowBuckets)
+		for i, _ := range p.buckets {
+			p.buckets[i].reset(p.maxBucketItems)
+		}
+		p.currentBucket = 0
+		p.currentBucketTime = p.clock.Now()
+	}
+	p.lock.Unlock()
+}
+
 func (p *RollingPercentile) Add(v int) {
 	p.findCurrentBucket().add(v)
 }
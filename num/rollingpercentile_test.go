@@ -117,3 +117,20 @@ func addAll(rp *num.RollingPercentile, vs ...int) {
 		rp.Add(v)
 	}
 }
+
+func TestRollingPercentileSetWindow(t *testing.T) {
+	clock := util.NewTestableClock(time.Now())
+	rp := newTestingRollingPercentile(clock)
+	addAll(rp, 5)
+	rp.SetWindow(time.Millisecond, 3)
+	assert.Equal(t, 5, rp.Get(100), "Values are kept if the window did not change")
+
+	rp.SetWindow(time.Second, 2)
+	assert.Equal(t, 500*time.Millisecond, rp.BucketSize())
+	assert.Equal(t, 0, rp.Get(100))
+	addAll(rp, 7)
+	clock.Add(500 * time.Millisecond)
+	assert.Equal(t, 7, rp.Get(100))
+	clock.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, rp.Get(100))
+}
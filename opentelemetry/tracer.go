@@ -0,0 +1,128 @@
+// Package opentelemetry integrates command executions with OpenTelemetry.
+// Every command execution is traced with a span and the execution events and
+// times are exported through OpenTelemetry meters.
+package opentelemetry
+
+import (
+	"strings"
+	"time"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/requestlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+const instrumentationName = "github.com/arjantop/cuirass/opentelemetry"
+
+// Attribute keys set on spans and measurements.
+const (
+	CommandNameKey  = attribute.Key("cuirass.command.name")
+	CommandGroupKey = attribute.Key("cuirass.command.group")
+	EventsKey       = attribute.Key("cuirass.command.events")
+	EventKey        = attribute.Key("cuirass.command.event")
+	CircuitOpenKey  = attribute.Key("cuirass.circuit.open")
+)
+
+// Tracer is a cuirass.Tracer creating OpenTelemetry spans for command
+// executions and recording the execution metrics with OpenTelemetry meters.
+//
+// The span of the execution has child spans for the primary function, the
+// fallback and the responses returned from cache. The primary and fallback
+// functions are called with the context of their span, so commands executed
+// from within them are nested under the right span.
+type Tracer struct {
+	tracer   trace.Tracer
+	events   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// NewTracer constructs a new Tracer using the given providers.
+func NewTracer(tp trace.TracerProvider, mp metric.MeterProvider) (*Tracer, error) {
+	meter := mp.Meter(instrumentationName)
+	events, err := meter.Int64Counter("cuirass.command.events",
+		metric.WithDescription("Number of command execution events."))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("cuirass.command.duration",
+		metric.WithDescription("Execution time of commands."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		tracer:   tp.Tracer(instrumentationName),
+		events:   events,
+		duration: duration,
+	}, nil
+}
+
+func (t *Tracer) Start(ctx context.Context, cmd *cuirass.Command, kind cuirass.SpanKind) (context.Context, cuirass.Span) {
+	attrs := []attribute.KeyValue{
+		CommandNameKey.String(cmd.Name()),
+		CommandGroupKey.String(cmd.Group()),
+	}
+	name := cmd.Name()
+	if kind != cuirass.ExecSpan {
+		name += "." + kind.String()
+	}
+	ctx, s := t.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, &span{
+		tracer: t,
+		ctx:    ctx,
+		span:   s,
+		kind:   kind,
+		attrs:  attrs,
+		start:  time.Now(),
+	}
+}
+
+// span wraps an OpenTelemetry span.
+type span struct {
+	tracer *Tracer
+	ctx    context.Context
+	span   trace.Span
+	kind   cuirass.SpanKind
+	attrs  []attribute.KeyValue
+	start  time.Time
+}
+
+func (s *span) End(info cuirass.SpanInfo) {
+	if len(info.Events) > 0 {
+		s.span.SetAttributes(EventsKey.StringSlice(eventNames(info.Events)))
+	}
+	if s.kind == cuirass.ExecSpan {
+		s.span.SetAttributes(CircuitOpenKey.Bool(info.CircuitOpen))
+		s.record(info)
+	}
+	if info.Err != nil {
+		s.span.RecordError(info.Err)
+		s.span.SetStatus(codes.Error, info.Err.Error())
+	}
+	s.span.End()
+}
+
+// record records the metrics of the command execution.
+func (s *span) record(info cuirass.SpanInfo) {
+	for _, e := range info.Events {
+		attrs := append(s.attrs[:len(s.attrs):len(s.attrs)], EventKey.String(eventName(e)))
+		s.tracer.events.Add(s.ctx, 1, metric.WithAttributes(attrs...))
+	}
+	s.tracer.duration.Record(s.ctx, time.Since(s.start).Seconds(), metric.WithAttributes(s.attrs...))
+}
+
+func eventNames(events []requestlog.ExecutionEvent) []string {
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = eventName(e)
+	}
+	return names
+}
+
+func eventName(e requestlog.ExecutionEvent) string {
+	return strings.ToLower(e.String())
+}
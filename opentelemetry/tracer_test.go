@@ -0,0 +1,149 @@
+package opentelemetry_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arjantop/cuirass"
+	"github.com/arjantop/cuirass/opentelemetry"
+	"github.com/arjantop/cuirass/requestcache"
+	"github.com/arjantop/vaquita"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/context"
+)
+
+func newTracedExecutor(t *testing.T) (*cuirass.CommandExecutor, *tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	spans := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	tracer, err := opentelemetry.NewTracer(
+		sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)),
+		sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	assert.Nil(t, err)
+	ex := cuirass.NewExecutor(vaquita.NewEmptyMapConfig())
+	ex.SetTracer(tracer)
+	return ex, spans, reader
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	m := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		m[s.Name()] = s
+	}
+	return m
+}
+
+func attributeValue(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracerNestedCommands(t *testing.T) {
+	ex, recorder, _ := newTracedExecutor(t)
+	inner := cuirass.NewCommand("Inner", func(ctx context.Context) (interface{}, error) {
+		return "inner", nil
+	}).Build()
+	outer := cuirass.NewCommand("Outer", func(ctx context.Context) (interface{}, error) {
+		return ex.Exec(ctx, inner)
+	}).Group("Group").Build()
+
+	r, err := ex.Exec(context.Background(), outer)
+	assert.Nil(t, err)
+	assert.Equal(t, "inner", r)
+
+	spans := spansByName(recorder.Ended())
+	assert.Equal(t, 4, len(spans))
+	outerExec, outerRun := spans["Outer"], spans["Outer.run"]
+	innerExec, innerRun := spans["Inner"], spans["Inner.run"]
+	assert.False(t, outerExec.Parent().IsValid())
+	assert.Equal(t, outerExec.SpanContext().SpanID(), outerRun.Parent().SpanID())
+	assert.Equal(t, outerRun.SpanContext().SpanID(), innerExec.Parent().SpanID())
+	assert.Equal(t, innerExec.SpanContext().SpanID(), innerRun.Parent().SpanID())
+	assert.Equal(t, outerExec.SpanContext().TraceID(), innerRun.SpanContext().TraceID())
+
+	assert.Equal(t, "Outer", attributeValue(outerExec, opentelemetry.CommandNameKey).AsString())
+	assert.Equal(t, "Group", attributeValue(outerExec, opentelemetry.CommandGroupKey).AsString())
+	assert.Equal(t, []string{"success"}, attributeValue(outerExec, opentelemetry.EventsKey).AsStringSlice())
+	assert.False(t, attributeValue(outerExec, opentelemetry.CircuitOpenKey).AsBool())
+}
+
+func TestTracerFallback(t *testing.T) {
+	ex, recorder, _ := newTracedExecutor(t)
+	cmd := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("failed")
+	}).Fallback(func(ctx context.Context) (interface{}, error) {
+		return "fallback", nil
+	}).Build()
+
+	r, err := ex.Exec(context.Background(), cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, "fallback", r)
+
+	spans := spansByName(recorder.Ended())
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, codes.Error, spans["Cmd.run"].Status().Code)
+	assert.Equal(t, codes.Unset, spans["Cmd.fallback"].Status().Code)
+	assert.Equal(t, spans["Cmd"].SpanContext().SpanID(), spans["Cmd.fallback"].Parent().SpanID())
+	assert.Equal(t, []string{"failure", "fallback_success"},
+		attributeValue(spans["Cmd"], opentelemetry.EventsKey).AsStringSlice())
+}
+
+func TestTracerCacheHit(t *testing.T) {
+	ex, recorder, _ := newTracedExecutor(t)
+	ctx := requestcache.WithRequestCache(context.Background())
+	newCmd := func() *cuirass.Command {
+		return cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+			return "ok", nil
+		}).CacheKey("key").Build()
+	}
+	ex.Exec(ctx, newCmd())
+	ex.Exec(ctx, newCmd())
+
+	var cacheSpans []sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "Cmd.cache" {
+			cacheSpans = append(cacheSpans, s)
+		}
+	}
+	assert.Equal(t, 1, len(cacheSpans))
+	assert.Equal(t, []string{"success", "response_from_cache"},
+		attributeValue(cacheSpans[0], opentelemetry.EventsKey).AsStringSlice())
+}
+
+func TestTracerMetrics(t *testing.T) {
+	ex, _, reader := newTracedExecutor(t)
+	cmd := cuirass.NewCommand("Cmd", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	}).Build()
+	ex.Exec(context.Background(), cmd)
+	ex.Exec(context.Background(), cmd)
+
+	var rm metricdata.ResourceMetrics
+	assert.Nil(t, reader.Collect(context.Background(), &rm))
+	assert.Equal(t, 1, len(rm.ScopeMetrics))
+	ms := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		ms[m.Name] = m
+	}
+
+	events := ms["cuirass.command.events"].Data.(metricdata.Sum[int64])
+	assert.Equal(t, 1, len(events.DataPoints))
+	assert.Equal(t, int64(2), events.DataPoints[0].Value)
+	event, _ := events.DataPoints[0].Attributes.Value(opentelemetry.EventKey)
+	assert.Equal(t, "success", event.AsString())
+
+	duration := ms["cuirass.command.duration"].Data.(metricdata.Histogram[float64])
+	assert.Equal(t, 1, len(duration.DataPoints))
+	assert.Equal(t, uint64(2), duration.DataPoints[0].Count)
+	name, _ := duration.DataPoints[0].Attributes.Value(opentelemetry.CommandNameKey)
+	assert.Equal(t, "Cmd", name.AsString())
+}
@@ -12,19 +12,31 @@ type key struct {
 	cfg   vaquita.DynamicConfig
 }
 
-var (
-	cache = make(map[key]*CommandProperties)
-	lock  = new(sync.Mutex)
-)
+// cache holds the properties of commands. Properties are looked up on every
+// command execution and added rarely so the lookups are lock-free.
+var cache = new(sync.Map)
 
 func GetProperties(cfg vaquita.DynamicConfig, commandName, commandGroup string) *CommandProperties {
-	lock.Lock()
-	if p, ok := cache[key{commandName, commandGroup, cfg}]; ok {
-		lock.Unlock()
-		return p
+	k := key{commandName, commandGroup, cfg}
+	if p, ok := cache.Load(k); ok {
+		return p.(*CommandProperties)
+	}
+	p, _ := cache.LoadOrStore(k, newCommandProperties(cfg, commandName, commandGroup))
+	return p.(*CommandProperties)
+}
+
+// lookupProperties returns the cached properties of the command. Properties of
+// commands that are not cached are constructed without adding them to the
+// cache, so readers of the properties do not keep them for commands that were
+// evicted or never executed.
+func lookupProperties(cfg vaquita.DynamicConfig, commandName, commandGroup string) *CommandProperties {
+	if p, ok := cache.Load(key{commandName, commandGroup, cfg}); ok {
+		return p.(*CommandProperties)
 	}
-	p := newCommandProperties(cfg, commandName, commandGroup)
-	cache[key{commandName, commandGroup, cfg}] = p
-	lock.Unlock()
-	return p
+	return newCommandProperties(cfg, commandName, commandGroup)
+}
+
+// removeProperties removes the cached properties of the command.
+func removeProperties(cfg vaquita.DynamicConfig, commandName, commandGroup string) {
+	cache.Delete(key{commandName, commandGroup, cfg})
 }
@@ -40,3 +40,15 @@ func TestGetPropertiesConfig(t *testing.T) {
 
 	assert.True(t, p1 != p2)
 }
+
+func TestGetPropertiesSLOTarget(t *testing.T) {
+	cfg := vaquita.NewEmptyMapConfig()
+	cfg.SetProperty("cuirass.command.default.slo.target", "99.5")
+	cfg.SetProperty("cuirass.command.n2.slo.target", "99.9")
+	cfg.SetProperty("cuirass.command.n3.slo.target", "invalid")
+
+	assert.Equal(t, 99.5, cuirass.GetProperties(cfg, "n", "g").Metrics.SLOTarget.Get())
+	assert.Equal(t, 99.9, cuirass.GetProperties(cfg, "n2", "g").Metrics.SLOTarget.Get())
+	assert.Equal(t, 99.5, cuirass.GetProperties(cfg, "n3", "g").Metrics.SLOTarget.Get())
+	assert.Equal(t, 0.0, cuirass.GetProperties(vaquita.NewEmptyMapConfig(), "n", "g").Metrics.SLOTarget.Get())
+}
@@ -2,6 +2,7 @@ package requestcache
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/arjantop/cuirass/requestlog"
 )
@@ -37,10 +38,55 @@ func (c *ExecutedCommand) ExecutionInfo() *requestlog.ExecutionInfo {
 	return &c.info
 }
 
+// Stats holds the number of lookups and stored entries of a request cache.
+// Every lookup is either a hit or a miss.
+type Stats struct {
+	Lookups int
+	Hits    int
+	Misses  int
+	Entries int
+}
+
+// HitRatio returns the fraction of lookups that were hits. It is zero if there
+// were no lookups.
+func (s Stats) HitRatio() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+func (s *Stats) add(o Stats) {
+	s.Lookups += o.Lookups
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Entries += o.Entries
+}
+
+// commandStats holds the counters of the cache statistics of a command. They
+// are updated atomically so lookups only need the read lock of the cache.
+type commandStats struct {
+	hits    int64
+	misses  int64
+	entries int64
+}
+
+func (s *commandStats) stats() Stats {
+	hits, misses := int(atomic.LoadInt64(&s.hits)), int(atomic.LoadInt64(&s.misses))
+	return Stats{
+		Lookups: hits + misses,
+		Hits:    hits,
+		Misses:  misses,
+		Entries: int(atomic.LoadInt64(&s.entries)),
+	}
+}
+
 // ResponseCache is a cache of command responses.
 // It is safe to access ResponseCache from multiple thread.
 type RequestCache struct {
-	cache     map[cacheKey]*ExecutedCommand
+	cache map[cacheKey]*ExecutedCommand
+	// stats maps the command names to their cache statistics.
+	stats     *sync.Map
 	cacheLock *sync.RWMutex
 }
 
@@ -48,10 +94,38 @@ type RequestCache struct {
 func newRequestCache() *RequestCache {
 	return &RequestCache{
 		cache:     make(map[cacheKey]*ExecutedCommand),
+		stats:     new(sync.Map),
 		cacheLock: new(sync.RWMutex),
 	}
 }
 
+// Stats returns the cache statistics of the command with the given name.
+func (c *RequestCache) Stats(name string) Stats {
+	if s, ok := c.stats.Load(name); ok {
+		return s.(*commandStats).stats()
+	}
+	return Stats{}
+}
+
+// TotalStats returns the cache statistics of all commands.
+func (c *RequestCache) TotalStats() Stats {
+	var total Stats
+	c.stats.Range(func(key, value interface{}) bool {
+		total.add(value.(*commandStats).stats())
+		return true
+	})
+	return total
+}
+
+// commandStats returns the statistics of the command.
+func (c *RequestCache) commandStats(name string) *commandStats {
+	if s, ok := c.stats.Load(name); ok {
+		return s.(*commandStats)
+	}
+	s, _ := c.stats.LoadOrStore(name, &commandStats{})
+	return s.(*commandStats)
+}
+
 // Get performs a lookup in the cache for the cached command with the given name
 // and key.
 // If no previous execution is in the cache nil is returned.
@@ -59,34 +133,44 @@ func (c *RequestCache) Get(name, key string) *ExecutedCommand {
 	c.cacheLock.RLock()
 	defer c.cacheLock.RUnlock()
 	r := c.cache[newCacheKey(name, key)]
-	if r != nil {
-		return &ExecutedCommand{
-			response: r.response,
-			err:      r.err,
-			info:     r.info,
-		}
+	stats := c.commandStats(name)
+	if r == nil {
+		atomic.AddInt64(&stats.misses, 1)
+		return nil
+	}
+	atomic.AddInt64(&stats.hits, 1)
+	return &ExecutedCommand{
+		response: r.response,
+		err:      r.err,
+		info:     r.info,
 	}
-	return nil
 }
 
 // Add adds a command response and execution info to the cache to be reused by
-// later executions of the command.
+// later executions of the command. It returns true if no response for the
+// command and key was cached before.
 func (c *RequestCache) Add(
 	name, key string,
 	info requestlog.ExecutionInfo,
 	r interface{},
-	err error) {
+	err error) bool {
 
 	cachedEvents := append(info.Events(), requestlog.ResponseFromCache)
 	// Execution time of cached commands is always 0ms.
-	cachedInfo := requestlog.NewExecutionInfo(info.CommandName(), 0, cachedEvents)
+	cachedInfo := requestlog.NewExecutionInfo(info.CommandName(), 0, cachedEvents).WithErrorLabel(info.ErrorLabel())
 
 	c.cacheLock.Lock()
 	defer c.cacheLock.Unlock()
 
-	c.cache[newCacheKey(name, key)] = &ExecutedCommand{
+	k := newCacheKey(name, key)
+	_, exists := c.cache[k]
+	c.cache[k] = &ExecutedCommand{
 		response: r,
 		err:      err,
 		info:     cachedInfo,
 	}
+	if !exists {
+		atomic.AddInt64(&c.commandStats(name).entries, 1)
+	}
+	return !exists
 }
@@ -43,3 +43,21 @@ func TestAddRequestFailure(t *testing.T) {
 	assert.Equal(t, "", r)
 	assert.Equal(t, cachedError, err)
 }
+
+func TestStats(t *testing.T) {
+	cache := newRequestCache()
+	info := requestlog.NewExecutionInfo("Cached", 0, []requestlog.ExecutionEvent{requestlog.Success})
+	assert.Nil(t, cache.Get("Cached", "a"))
+	assert.True(t, cache.Add("Cached", "a", info, "abc", nil))
+	assert.False(t, cache.Add("Cached", "a", info, "abc", nil))
+	cache.Get("Cached", "a")
+	cache.Get("Cached", "a")
+	cache.Get("Other", "a")
+
+	s := cache.Stats("Cached")
+	assert.Equal(t, Stats{Lookups: 3, Hits: 2, Misses: 1, Entries: 1}, s)
+	assert.InDelta(t, 2.0/3, s.HitRatio(), 1e-9)
+	assert.Equal(t, Stats{Lookups: 4, Hits: 2, Misses: 2, Entries: 1}, cache.TotalStats())
+	assert.Equal(t, Stats{}, cache.Stats("Unknown"))
+	assert.Equal(t, 0.0, Stats{}.HitRatio())
+}
@@ -35,8 +35,25 @@ const (
 	// FallbakcFailure event happens when the fallback logic returned and error
 	// or panicked while executing.
 	FallbackFailure
+
+	// GroupShortCircuited event happens when the circuit breaker for the group
+	// of the command is open.
+	GroupShortCircuited
 )
 
+// ExecutionEvents holds all the execution events in the order of their definition.
+var ExecutionEvents = []ExecutionEvent{
+	Success,
+	Failure,
+	Timeout,
+	ShortCircuited,
+	SemaphoreRejected,
+	ResponseFromCache,
+	FallbackSuccess,
+	FallbackFailure,
+	GroupShortCircuited,
+}
+
 // String returns a string representation of an execution event.
 func (e ExecutionEvent) String() (s string) {
 	switch e {
@@ -56,6 +73,8 @@ func (e ExecutionEvent) String() (s string) {
 		s = "FALLBACK_SUCCESS"
 	case FallbackFailure:
 		s = "FALLBACK_FAILURE"
+	case GroupShortCircuited:
+		s = "GROUP_SHORT_CIRCUITED"
 	}
 	return
 }
@@ -66,6 +85,7 @@ type ExecutionInfo struct {
 	commandName   string
 	executionTime time.Duration
 	events        []ExecutionEvent
+	errorLabel    string
 }
 
 // NewExecutionInfo construct a new ExecutionInfo for command name.
@@ -96,6 +116,18 @@ func (e *ExecutionInfo) ExecutionTime() time.Duration {
 	return e.executionTime
 }
 
+// ErrorLabel returns the label of the error of a failed execution. It is empty
+// if the execution did not fail or its error was not classified.
+func (e *ExecutionInfo) ErrorLabel() string {
+	return e.errorLabel
+}
+
+// WithErrorLabel returns a copy of the execution info with the error label set.
+func (e ExecutionInfo) WithErrorLabel(label string) ExecutionInfo {
+	e.errorLabel = label
+	return e
+}
+
 // Events returns a slice of events that happend in the order that they occurred.
 func (e *ExecutionInfo) Events() []ExecutionEvent {
 	r := make([]ExecutionEvent, len(e.events))
@@ -196,6 +228,11 @@ func writeCommand(b *bytes.Buffer, info ExecutionInfo) {
 			b.WriteString(", ")
 		}
 		b.WriteString(event.String())
+		if event == Failure && info.ErrorLabel() != "" {
+			b.WriteString("(")
+			b.WriteString(info.ErrorLabel())
+			b.WriteString(")")
+		}
 	}
 	b.WriteString("]")
 }
@@ -71,3 +71,11 @@ func TestStringEvents(t *testing.T) {
 	logger.AddExecutionInfo(NewExecutionInfo("Foo", 0, []ExecutionEvent{SemaphoreRejected}))
 	assert.Equal(t, "Foo[SEMAPHORE_REJECTED][0ms]", logger.String())
 }
+
+func TestStringErrorLabel(t *testing.T) {
+	logger := newRequestLog()
+	info := NewExecutionInfo("Foo", 0, []ExecutionEvent{Failure, FallbackSuccess}).WithErrorLabel("connection_refused")
+	logger.AddExecutionInfo(info)
+	assert.Equal(t, "connection_refused", info.ErrorLabel())
+	assert.Equal(t, "Foo[FAILURE(connection_refused), FALLBACK_SUCCESS][0ms]", logger.String())
+}
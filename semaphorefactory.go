@@ -12,25 +12,53 @@ type semaphore struct {
 }
 
 type SemaphoreFactory struct {
-	semaphores map[string]*semaphore
+	// semaphores maps the keys to semaphores. Semaphores are replaced rarely so
+	// the lookups are lock-free and only the replacements are serialized.
+	semaphores *sync.Map
 	lock       *sync.Mutex
 }
 
 func NewSemaphoreFactory() *SemaphoreFactory {
 	return &SemaphoreFactory{
-		semaphores: make(map[string]*semaphore),
+		semaphores: new(sync.Map),
 		lock:       new(sync.Mutex),
 	}
 }
 
 func (f *SemaphoreFactory) Get(key string, maxConcurrentRequests int) *util.Semaphore {
+	if s, ok := f.find(key); ok && maxConcurrentRequests == s.capacity {
+		return s.sem
+	}
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	// If the capacity of the semaphore changed create the new one.
-	if s, ok := f.semaphores[key]; ok && maxConcurrentRequests == s.capacity {
+	if s, ok := f.find(key); ok && maxConcurrentRequests == s.capacity {
 		return s.sem
 	}
 	s := util.NewSemaphore(maxConcurrentRequests)
-	f.semaphores[key] = &semaphore{s, maxConcurrentRequests}
+	f.semaphores.Store(key, &semaphore{s, maxConcurrentRequests})
 	return s
 }
+
+// Find returns the semaphore for the key if it exists.
+func (f *SemaphoreFactory) Find(key string) (*util.Semaphore, bool) {
+	if s, ok := f.find(key); ok {
+		return s.sem, true
+	}
+	return nil, false
+}
+
+// Remove removes the semaphore for the key. Semaphores already returned remain
+// usable.
+func (f *SemaphoreFactory) Remove(key string) {
+	f.lock.Lock()
+	f.semaphores.Delete(key)
+	f.lock.Unlock()
+}
+
+func (f *SemaphoreFactory) find(key string) (*semaphore, bool) {
+	if s, ok := f.semaphores.Load(key); ok {
+		return s.(*semaphore), true
+	}
+	return nil, false
+}
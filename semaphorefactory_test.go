@@ -35,3 +35,13 @@ func TestSemaphoreFactoryGetChangedCapacity(t *testing.T) {
 	assert.True(t, s2.TryAcquire(), "Acquired resources are reset to zero")
 	assert.True(t, s2.TryAcquire())
 }
+
+func TestSemaphoreFactoryFind(t *testing.T) {
+	sf := newTestringSemaphoreFactory()
+	_, ok := sf.Find("s1")
+	assert.False(t, ok)
+	s1 := sf.Get("s1", 1)
+	s2, ok := sf.Find("s1")
+	assert.True(t, ok)
+	assert.True(t, s1 == s2)
+}
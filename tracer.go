@@ -0,0 +1,94 @@
+package cuirass
+
+import (
+	"github.com/arjantop/cuirass/requestlog"
+	"golang.org/x/net/context"
+)
+
+// SpanKind identifies the part of a command execution that is covered by a span.
+type SpanKind int
+
+const (
+	// ExecSpan covers the whole execution of the command by the executor.
+	ExecSpan SpanKind = iota
+	// RunSpan covers the execution of the primary function of the command.
+	RunSpan
+	// FallbackSpan covers the execution of the fallback function of the command.
+	FallbackSpan
+	// CacheSpan marks a response returned from the request cache.
+	CacheSpan
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case ExecSpan:
+		return "exec"
+	case RunSpan:
+		return "run"
+	case FallbackSpan:
+		return "fallback"
+	case CacheSpan:
+		return "cache"
+	default:
+		return "unknown"
+	}
+}
+
+// SpanInfo describes the outcome of the part of a command execution covered
+// by a span.
+type SpanInfo struct {
+	// Events are the execution events of the command. They are set only for
+	// exec and cache spans.
+	Events []requestlog.ExecutionEvent
+	// Err is the error returned by the traced function.
+	Err error
+	// CircuitOpen is true if the circuit breaker of the command was open when
+	// the execution completed. It is set only for exec spans.
+	CircuitOpen bool
+}
+
+// Span is a traced part of a command execution.
+type Span interface {
+	// End ends the span.
+	End(info SpanInfo)
+}
+
+// Tracer starts spans for command executions.
+// Tracer must be safe to be accessed by multiple goroutines.
+type Tracer interface {
+	// Start starts a span of the given kind for the command. Returned context
+	// is used for the traced part of the execution so the spans of commands
+	// executed from within the command are nested correctly.
+	Start(ctx context.Context, cmd *Command, kind SpanKind) (context.Context, Span)
+}
+
+type noopSpan struct{}
+
+func (s noopSpan) End(info SpanInfo) {}
+
+// startSpan starts a span with the tracer of the executor if it is set.
+func (e *CommandExecutor) startSpan(ctx context.Context, cmd *Command, kind SpanKind) (context.Context, Span) {
+	if e.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return e.tracer.Start(ctx, cmd, kind)
+}
+
+// traceFunc executes f in a span of the given kind. Panics are recorded as
+// errors of the span and propagated.
+func (e *CommandExecutor) traceFunc(
+	ctx context.Context,
+	cmd *Command,
+	kind SpanKind,
+	f CommandFunc) (result interface{}, err error) {
+
+	ctx, span := e.startSpan(ctx, cmd, kind)
+	defer func() {
+		if r := recover(); r != nil {
+			span.End(SpanInfo{Err: panicToError(r)})
+			panic(r)
+		}
+		span.End(SpanInfo{Err: err})
+	}()
+	return f(ctx)
+}
@@ -1,11 +1,31 @@
 package util
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type Clock interface {
 	Now() time.Time
 }
 
+// Timer is a Clock that can also wait for a duration to elapse.
+type Timer interface {
+	Clock
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// After waits for the duration to elapse on the clock. Clocks that do not
+// implement Timer wait in real time.
+func After(c Clock, d time.Duration) <-chan time.Time {
+	if t, ok := c.(Timer); ok {
+		return t.After(d)
+	}
+	return time.After(d)
+}
+
 type realClock struct{}
 
 func NewClock() Clock {
@@ -16,24 +36,83 @@ func (c *realClock) Now() time.Time {
 	return time.Now()
 }
 
+func (c *realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// TestableClock is a clock whose time is changed manually. It is safe to be
+// accessed by multiple goroutines.
 type TestableClock struct {
 	now time.Time
+	// waiters are the channels returned by After that did not fire yet.
+	waiters []waiter
+	lock    *sync.Mutex
+}
+
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
 }
 
 func NewTestableClock(now time.Time) *TestableClock {
 	return &TestableClock{
-		now: now,
+		now:  now,
+		lock: new(sync.Mutex),
 	}
 }
 
 func (c *TestableClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.now
 }
 
+// After returns a channel that receives the time once the clock is moved past
+// the duration from now.
+func (c *TestableClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w := waiter{c.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+	return w.c
+}
+
 func (c *TestableClock) SetTime(t time.Time) {
+	c.lock.Lock()
 	c.now = t
+	c.fire()
+	c.lock.Unlock()
 }
 
 func (c *TestableClock) Add(d time.Duration) {
+	c.lock.Lock()
 	c.now = c.now.Add(d)
+	c.fire()
+	c.lock.Unlock()
+}
+
+// Waiters returns the number of channels returned by After that did not
+// receive the time yet.
+func (c *TestableClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+// fire sends the time to the waiters whose deadline passed. The caller must
+// hold the lock.
+func (c *TestableClock) fire() {
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if c.now.Before(w.deadline) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
 }
@@ -0,0 +1,38 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arjantop/cuirass/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestableClockAfter(t *testing.T) {
+	start := time.Now()
+	clock := util.NewTestableClock(start)
+	c := clock.After(10 * time.Millisecond)
+	assert.Equal(t, 1, clock.Waiters())
+
+	clock.Add(5 * time.Millisecond)
+	select {
+	case <-c:
+		t.Fatal("fired before the deadline")
+	default:
+	}
+	clock.Add(5 * time.Millisecond)
+	assert.Equal(t, start.Add(10*time.Millisecond), <-c)
+	assert.Equal(t, 0, clock.Waiters())
+
+	assert.Equal(t, start.Add(10*time.Millisecond), <-clock.After(0), "Zero duration fires immediately")
+}
+
+type nowClock struct{}
+
+func (nowClock) Now() time.Time { return time.Now() }
+
+func TestAfterWithoutTimer(t *testing.T) {
+	start := time.Now()
+	<-util.After(nowClock{}, 10*time.Millisecond)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond, "Clocks without a timer wait in real time")
+}
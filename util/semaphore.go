@@ -28,6 +28,11 @@ func (s *Semaphore) Release() {
 	}
 }
 
+// Used returns the number of currently acquired permits.
+func (s *Semaphore) Used() int {
+	return len(s.c)
+}
+
 func (s *Semaphore) Capacity() int {
 	return cap(s.c)
 }
@@ -33,3 +33,13 @@ func TestSemaphoreReleaseEmpty(t *testing.T) {
 		s.Release()
 	})
 }
+
+func TestSemaphoreUsed(t *testing.T) {
+	s := newTestingSemaphore(2)
+	assert.Equal(t, 0, s.Used())
+	s.TryAcquire()
+	s.TryAcquire()
+	assert.Equal(t, 2, s.Used())
+	s.Release()
+	assert.Equal(t, 1, s.Used())
+}